@@ -0,0 +1,57 @@
+package cosignperf
+
+import (
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// acceptStats is the outcome of an --accept-burst
+type acceptStats struct {
+	d        durations
+	failures map[string]int
+}
+
+// acceptBurst opens n TCP connections to the server all at once and times
+// how long each takes to be accepted, without doing anything else on them.
+// That's down to how quickly cosignd drains its listen queue rather than TLS
+// or command processing. The connections are held until the whole burst is
+// in so the queue can't empty early, then closed.
+func acceptBurst(args Args, n int) acceptStats {
+	host, port := args.addr(1)
+	addr := net.JoinHostPort(host, strconv.Itoa(port))
+	as := acceptStats{failures: make(map[string]int)}
+	var mu sync.Mutex
+	var wg, held sync.WaitGroup
+	release := make(chan struct{})
+	gate := make(chan struct{})
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		held.Add(1)
+		go func() {
+			defer wg.Done()
+			<-gate
+			start := time.Now()
+			conn, err := dial(addr, 0)
+			elapsed := time.Since(start)
+			mu.Lock()
+			if err != nil {
+				as.failures[dialFailure(err)]++
+			} else {
+				as.d = append(as.d, elapsed)
+			}
+			mu.Unlock()
+			held.Done()
+			if conn != nil {
+				<-release
+				conn.Close()
+			}
+		}()
+	}
+	close(gate)
+	held.Wait()
+	close(release)
+	wg.Wait()
+	return as
+}
@@ -0,0 +1,37 @@
+package cosignperf
+
+import (
+	"fmt"
+	"time"
+)
+
+// apdexT is the --apdex-threshold, 0 if no Apdex score is wanted
+var apdexT time.Duration
+
+// apdex counts results against apdexT: satisfied within it, tolerating
+// within four times it, and frustrated beyond that or if they failed
+type apdex struct {
+	satisfied, tolerating, frustrated int
+}
+
+func (a *apdex) add(r result) {
+	switch {
+	case !r.success || r.elapsed > 4*apdexT:
+		a.frustrated++
+	case r.elapsed > apdexT:
+		a.tolerating++
+	default:
+		a.satisfied++
+	}
+}
+
+// String gives the score, from 0 for everyone frustrated to 1 for everyone
+// satisfied, with the counts it came from
+func (a apdex) String() string {
+	n := a.satisfied + a.tolerating + a.frustrated
+	if n == 0 {
+		return "no samples"
+	}
+	score := (float64(a.satisfied) + float64(a.tolerating)/2) / float64(n)
+	return fmt.Sprintf("%.2f, satisfied: %d, tolerating: %d, frustrated: %d", score, a.satisfied, a.tolerating, a.frustrated)
+}
@@ -0,0 +1,96 @@
+package cosignperf
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// baselineRun is a run's headline numbers as saved with --save-baseline, for
+// later runs to compare against with --baseline
+type baselineRun struct {
+	Schema    int               `json:"schema_version"`
+	RunID     string            `json:"run_id"`
+	Time      time.Time         `json:"time"`
+	Target    string            `json:"target"`
+	Threads   int               `json:"threads"`
+	Successes int               `json:"successes"`
+	Failures  int               `json:"failures"`
+	ReqPerSec float64           `json:"req_per_sec"`
+	AvgNs     int64             `json:"avg_ns"`
+	P95Ns     int64             `json:"p95_ns"`
+	P99Ns     int64             `json:"p99_ns"`
+	Tags      map[string]string `json:"tags,omitempty"`
+}
+
+// baseRun is the --baseline run, nil if there isn't one, and
+// regressThreshold the --regress-threshold as a fraction, 0 if not set
+var (
+	baseRun          *baselineRun
+	regressThreshold float64
+)
+
+// newBaselineRun is sum the way --save-baseline saves it
+func newBaselineRun(args Args, sum summary, runID string) baselineRun {
+	return baselineRun{
+		Schema:    schemaVersion,
+		RunID:     runID,
+		Time:      sum.started,
+		Target:    args.target(),
+		Threads:   args.Threads,
+		Successes: sum.ns,
+		Failures:  sum.nf,
+		ReqPerSec: sum.rps,
+		AvgNs:     int64(sum.success.avg),
+		P95Ns:     int64(sum.success.p95),
+		P99Ns:     int64(sum.success.p99),
+		Tags:      tagMap(),
+	}
+}
+
+func writeBaseline(path string, args Args, sum summary, runID string) error {
+	b, err := json.MarshalIndent(newBaselineRun(args, sum, runID), "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(path, append(b, '\n'), 0644); err != nil {
+		return fmt.Errorf("baseline: %s", err)
+	}
+	return nil
+}
+
+func loadBaseline(path string) (*baselineRun, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var run baselineRun
+	if err := json.Unmarshal(b, &run); err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+	if run.Schema != schemaVersion {
+		return nil, fmt.Errorf("%s: schema version %d, want %d", path, run.Schema, schemaVersion)
+	}
+	if run.P99Ns <= 0 {
+		return nil, fmt.Errorf("%s: no p99 to compare with", path)
+	}
+	return &run, nil
+}
+
+// parseThreshold parses a --regress-threshold like 10% or 10 into 0.1
+func parseThreshold(s string) (float64, error) {
+	pct, err := strconv.ParseFloat(strings.TrimSuffix(strings.TrimSpace(s), "%"), 64)
+	if err != nil || pct < 0 {
+		return 0, fmt.Errorf("invalid --regress-threshold %q, want a percentage like 10%%", s)
+	}
+	return pct / 100, nil
+}
+
+// regression is how much worse sum's p99 is than the baseline's, as a
+// fraction; negative if it's better
+func regression(sum summary) float64 {
+	return float64(int64(sum.success.p99)-baseRun.P99Ns) / float64(baseRun.P99Ns)
+}
@@ -0,0 +1,144 @@
+package cosignperf
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"time"
+)
+
+// --binary-output files start with an 8 byte header, the magic "CPRB" then
+// the layout version and the record size as little-endian uint16s, followed
+// by fixed-width little-endian records:
+//
+//	offset  size  field
+//	0       8     time, unix nanoseconds (int64)
+//	8       8     elapsed, nanoseconds (int64)
+//	16      4     worker (uint32)
+//	20      4     iteration, 0 for a setup failure (uint32)
+//	24      2     response code, 0 if there wasn't one (uint16)
+//	26      1     flags: 1 success, 2 connection setup failure
+//	27      1     unused
+//
+// A rotated file gets a header of its own.
+const (
+	binaryMagic   = "CPRB"
+	binaryVersion = 1
+	binaryRecord  = 28
+)
+
+const (
+	binarySuccess = 1 << iota
+	binarySetup
+)
+
+// binaryWriter writes results in the --binary-output layout, which is much
+// cheaper to produce than JSON at very high rates
+type binaryWriter struct {
+	f   *rotatingFile
+	w   *bufio.Writer
+	buf [binaryRecord]byte
+}
+
+func newBinaryWriter(path string, args Args) (*binaryWriter, error) {
+	f, err := createOutput(path, args)
+	if err != nil {
+		return nil, err
+	}
+	b := &binaryWriter{f: f, w: bufio.NewWriterSize(f, 1<<16)}
+	b.begin()
+	return b, nil
+}
+
+// begin writes the header, unless the file is being appended to
+func (b *binaryWriter) begin() {
+	if b.f.size > 0 {
+		return
+	}
+	var h [8]byte
+	copy(h[:], binaryMagic)
+	binary.LittleEndian.PutUint16(h[4:], binaryVersion)
+	binary.LittleEndian.PutUint16(h[6:], binaryRecord)
+	b.w.Write(h[:])
+}
+
+func (b *binaryWriter) write(r result) {
+	code, _ := strconv.ParseUint(r.code, 10, 16)
+	var flags byte
+	if r.success {
+		flags |= binarySuccess
+	}
+	if r.setup != "" {
+		flags |= binarySetup
+	}
+	buf := b.buf[:]
+	binary.LittleEndian.PutUint64(buf[0:], uint64(r.time.UnixNano()))
+	binary.LittleEndian.PutUint64(buf[8:], uint64(r.elapsed))
+	binary.LittleEndian.PutUint32(buf[16:], uint32(r.worker))
+	binary.LittleEndian.PutUint32(buf[20:], uint32(r.iteration))
+	binary.LittleEndian.PutUint16(buf[24:], uint16(code))
+	buf[26], buf[27] = flags, 0
+	b.w.Write(buf)
+	if b.f.due(b.w.Buffered()) {
+		rotateBuffered(b.f, b.w)
+		b.begin()
+	}
+}
+
+func (b *binaryWriter) close() error {
+	if err := b.w.Flush(); err != nil {
+		b.f.Close()
+		return err
+	}
+	return b.f.Close()
+}
+
+// decodeBinary writes the records in a --binary-output file to out as CSV,
+// for --decode-binary
+func decodeBinary(path string, out io.Writer) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	rd := bufio.NewReaderSize(f, 1<<16)
+
+	var h [8]byte
+	if _, err := io.ReadFull(rd, h[:]); err != nil || string(h[:4]) != binaryMagic {
+		return fmt.Errorf("%s: not a --binary-output file", path)
+	}
+	if v := binary.LittleEndian.Uint16(h[4:]); v != binaryVersion {
+		return fmt.Errorf("%s: layout version %d, this cosignperf reads %d", path, v, binaryVersion)
+	}
+	size := int(binary.LittleEndian.Uint16(h[6:]))
+	if size < binaryRecord {
+		return fmt.Errorf("%s: records of %d bytes are too short", path, size)
+	}
+
+	cw := csv.NewWriter(out)
+	cw.Write([]string{"time", "worker", "iteration", "success", "setup_failure", "code", "elapsed_ns"})
+	buf := make([]byte, size)
+	for n := 0; ; n++ {
+		if _, err := io.ReadFull(rd, buf); err == io.EOF {
+			break
+		} else if err != nil {
+			return fmt.Errorf("%s: record %d: %s", path, n, err)
+		}
+		flags := buf[26]
+		cw.Write([]string{
+			time.Unix(0, int64(binary.LittleEndian.Uint64(buf[0:]))).UTC().Format(time.RFC3339Nano),
+			strconv.FormatUint(uint64(binary.LittleEndian.Uint32(buf[16:])), 10),
+			strconv.FormatUint(uint64(binary.LittleEndian.Uint32(buf[20:])), 10),
+			strconv.FormatBool(flags&binarySuccess != 0),
+			strconv.FormatBool(flags&binarySetup != 0),
+			strconv.FormatUint(uint64(binary.LittleEndian.Uint16(buf[24:])), 10),
+			strconv.FormatInt(int64(binary.LittleEndian.Uint64(buf[8:])), 10),
+		})
+	}
+	cw.Flush()
+	return cw.Error()
+}
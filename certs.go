@@ -0,0 +1,117 @@
+package cosignperf
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// loadCertDir loads every client cert/key pair in dir. Each NAME.key is
+// paired with NAME.crt or NAME.pem, and the pairs are returned sorted by NAME
+// so assignment to workers is deterministic between runs, along with the
+// NAMEs.
+func loadCertDir(dir string) ([]tls.Certificate, []string, error) {
+	keys, err := filepath.Glob(filepath.Join(dir, "*.key"))
+	if err != nil {
+		return nil, nil, err
+	}
+	sort.Strings(keys)
+
+	var certs []tls.Certificate
+	var names []string
+	for _, key := range keys {
+		name := strings.TrimSuffix(key, ".key")
+		var cert string
+		for _, ext := range []string{".crt", ".pem"} {
+			if _, err := os.Stat(name + ext); err == nil {
+				cert = name + ext
+				break
+			}
+		}
+		if cert == "" {
+			return nil, nil, fmt.Errorf("%s: no matching .crt or .pem", key)
+		}
+
+		c, err := tls.LoadX509KeyPair(cert, key)
+		if err != nil {
+			return nil, nil, fmt.Errorf("%s: %s", cert, err)
+		}
+		certs = append(certs, c)
+		names = append(names, filepath.Base(name))
+	}
+	if len(certs) == 0 {
+		return nil, nil, fmt.Errorf("%s: no client certs found", dir)
+	}
+	return certs, names, nil
+}
+
+// weightCerts repeats certs in proportion to a --cert-weights list like
+// alice=8,bob=1, interleaved, so that rotating through the result per
+// connection or per thread gives each identity its share. Certs that aren't
+// listed have a weight of 1.
+func weightCerts(certs []tls.Certificate, names []string, list string) ([]tls.Certificate, error) {
+	weights := make([]int, len(certs))
+	for i := range weights {
+		weights[i] = 1
+	}
+	for _, f := range strings.Split(list, ",") {
+		name, w, ok := strings.Cut(strings.TrimSpace(f), "=")
+		weight, err := strconv.Atoi(w)
+		if !ok || err != nil || weight <= 0 {
+			return nil, fmt.Errorf("invalid --cert-weights %q, want NAME=WEIGHT pairs with whole number weights", f)
+		}
+		i := sort.SearchStrings(names, name)
+		if i == len(names) || names[i] != name {
+			return nil, fmt.Errorf("--cert-weights: no cert named %s in --cert-dir", name)
+		}
+		weights[i] = weight
+	}
+
+	order, err := interleave(weights)
+	if err != nil {
+		return nil, fmt.Errorf("--cert-weights: %s", err)
+	}
+	weighted := make([]tls.Certificate, len(order))
+	for n, i := range order {
+		weighted[n] = certs[i]
+	}
+	return weighted, nil
+}
+
+// serverInfo holds what we learn about the server from the first successful
+// handshake of a run. Fields are only read back once all workers are done.
+type serverInfo struct {
+	once     sync.Once
+	expiring bool
+}
+
+func (s *serverInfo) inspect(args Args, cs tls.ConnectionState) {
+	if args.CertExpiry > 0 && len(cs.PeerCertificates) > 0 {
+		cert := cs.PeerCertificates[0]
+		if left := time.Until(cert.NotAfter); left < args.CertExpiry {
+			s.expiring = true
+			log.Printf("warning: server cert %q expires %s (in %s)\n",
+				cert.Subject.CommonName, cert.NotAfter.Format(time.RFC3339), left.Round(time.Second))
+		}
+	}
+	if args.PrintChain {
+		printChain(cs.PeerCertificates)
+	}
+}
+
+// printChain prints the certs the server presented, leaf first
+func printChain(chain []*x509.Certificate) {
+	fmt.Fprintf(os.Stderr, "Server certificate chain:\n")
+	for i, cert := range chain {
+		fmt.Fprintf(os.Stderr, "%d subject: %s\n  issuer: %s\n  valid: %s to %s\n",
+			i, cert.Subject, cert.Issuer, cert.NotBefore.Format(time.RFC3339), cert.NotAfter.Format(time.RFC3339))
+	}
+}
@@ -0,0 +1,57 @@
+package cosignperf
+
+import (
+	"bufio"
+	"crypto/tls"
+	"github.com/cobaugh/cosignperf/pkg/cosign"
+	"sync"
+	"time"
+)
+
+// cleanupWait is how long the server gets to answer --cleanup-command or
+// --keepalive-command, long
+// enough for a busy cosignd but not one that's stuck
+const cleanupWait = 5 * time.Second
+
+// sideStats sends a command on the side of the measured ones and counts how
+// often the server didn't acknowledge it: --cleanup-command on each
+// connection before it's closed, so state like a LOGIN is released rather
+// than left to time out, and --keepalive-command while it's idle. Neither
+// is part of the results.
+type sideStats struct {
+	cmd    *command
+	mu     sync.Mutex
+	sent   int
+	failed int // no reply in time, or not one of the command's success codes
+}
+
+// send issues the command on conn and waits until deadline at the
+// latest for its reply
+func (s *sideStats) send(conn *tls.Conn, rd *bufio.Reader, maxLine int, deadline time.Time) {
+	ok := writeAll(conn, []byte(s.cmd.render(commandData{})+"\r\n")) == nil
+	if ok {
+		conn.SetReadDeadline(deadline)
+		message, err := cosign.ReadLine(rd, maxLine)
+		conn.SetReadDeadline(time.Time{})
+		ok = err == nil && classify(*s.cmd, message).success
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sent++
+	if !ok {
+		s.failed++
+	}
+}
+
+// cleanupBy is the deadline for the reply to the cleanup command, cut short
+// if the run is being drained
+func cleanupBy(r request) time.Time {
+	deadline := time.Now().Add(cleanupWait)
+	if stopped(r) {
+		if by := r.drain.quitBy(); by.Before(deadline) {
+			deadline = by
+		}
+	}
+	return deadline
+}
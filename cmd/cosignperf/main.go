@@ -0,0 +1,9 @@
+// Command cosignperf sends commands to cosignd in parallel and reports on
+// how it held up. See the README for its options.
+package main
+
+import "github.com/cobaugh/cosignperf"
+
+func main() {
+	cosignperf.Main()
+}
@@ -1,226 +1,2735 @@
-package main
+// Package cosignperf is the cosignperf command, which cmd/cosignperf runs:
+// its options, the cosignd sessions and the reports on them. The protocol
+// is in pkg/cosign and the pacing and statistics in pkg/loadgen.
+package cosignperf
 
 import (
-	"bufio"
+	crand "crypto/rand"
 	"crypto/tls"
+	"encoding/base64"
+	"encoding/hex"
 	"fmt"
 	"github.com/alexflint/go-arg"
+	"github.com/cobaugh/cosignperf/pkg/loadgen"
 	"github.com/montanaflynn/stats"
+	"io"
 	"log"
+	"math/rand"
 	"net"
 	"os"
+	"reflect"
+	"regexp"
+	"runtime"
+	"runtime/pprof"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"text/tabwriter"
+	"text/template"
 	"time"
 )
 
 type Args struct {
-	KeyFile       string `arg:"-k,required"`
-	CertFile      string `arg:"-c,required"`
-	Iterations    int    `arg:"-i,required,help:# of commands to issue per thread"`
-	Threads       int    `arg:"-t,required,help:# of threads/clients to create"`
-	Hostname      string `arg:"-H,required"`
-	Port          int    `arg:"-P,required"`
-	Command       string `arg:"-C,required:cosign command to issue"`
-	SslSkipVerify bool   `arg:"help:Disable SSL verification when doing STARTTLS"`
-	Quiet         bool   `arg:"-q,help:Suppress output and only provide summary"`
+	KeyFile       string        `arg:"-k"`
+	CertFile      string        `arg:"-c"`
+	Iterations    int           `arg:"-i,help:# of commands to issue per thread"`
+	Duration      time.Duration `arg:"-d,help:Keep issuing commands for this long instead of a set number (eg. 10m)"`
+	Threads       int           `arg:"-t,help:# of threads/clients to create"`
+	Hostname      string        `arg:"-H,help:Server to connect to as host or host:port; give several separated by commas to compare them"`
+	HostStrategy  string        `arg:"--host-strategy,help:With several -H hosts: round-robin spreads the threads across them and all runs the whole load against each in turn"`
+	HostWeights   string        `arg:"--host-weights,help:Comma-separated HOST=WEIGHT pairs giving some -H hosts proportionally more of the threads than others"`
+	Port          []int         `arg:"-P,separate,help:Port to connect to; repeat to spread the threads across several round-robin"`
+	Command       string        `arg:"-C,help:cosign command to issue"`
+	CommandHex    string        `arg:"--command-hex,help:Command to send as hex-encoded raw bytes with no CRLF added (overrides --command)"`
+	CommandB64    string        `arg:"--command-base64,help:Like --command-hex but base64-encoded"`
+	Tag           []string      `arg:"--tag,separate,help:key=value to attach to every machine-readable output; repeat for more"`
+	SslSkipVerify bool          `arg:"help:Disable SSL verification when doing STARTTLS"`
+	RequireTLS    string        `arg:"--require-tls-version,help:Count commands on connections that negotiated a lower TLS version (1.0 or 1.1 or 1.2 or 1.3) as WEAKTLS failures"`
+	KeyLog        string        `arg:"--keylog,help:Append TLS session keys to this file in NSS key log format for decrypting packet captures (default $SSLKEYLOGFILE)"`
+	CAFile        string        `arg:"--ca-file,help:PEM file of CA certs to verify the server against in place of the system ones"`
+	TLSMin        string        `arg:"--tls-min-version,help:Lowest TLS version to offer: 1.0 or 1.1 or 1.2 or 1.3"`
+	TLSMax        string        `arg:"--tls-max-version,help:Highest TLS version to offer: 1.0 or 1.1 or 1.2 or 1.3"`
+	Ciphers       string        `arg:"--ciphers,help:Comma-separated TLS 1.2 cipher suites to offer like TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256"`
+	SessionResume bool          `arg:"--session-resumption,help:Keep a session cache so reconnects resume their TLS session and report how many did"`
+	Curves        string        `arg:"--curves,help:Comma-separated key exchange curves to offer in order of preference like X25519 or P-256 and report which were negotiated"`
+	Renegotiation string        `arg:"help:Whether to go along with the server renegotiating TLS 1.2: never or once or freely"`
+	Quiet         bool          `arg:"-q,help:Suppress output and only provide summary"`
+	Verbose       bool          `arg:"-v,help:Log every request as it completes"`
+	ReportEvery   time.Duration `arg:"--report-interval,help:Log a progress line of requests done and connections open and the req/s and failures and percentiles since the last line this often while running"`
+	RampProfile   string        `arg:"--ramp-profile,help:File of 'offset rate' lines to vary the --rate over the run; the rate is interpolated between points"`
+	Replay        string        `arg:"help:Replay the timing of the requests in this --raw-output file with --model open (one command per recorded request)"`
+	ReplaySpeed   float64       `arg:"--replay-speed,help:With --replay scale the recorded timeline by this factor (2 = twice as fast)"`
+	Rate          float64       `arg:"-r,help:Limit aggregate command rate across all threads to this many req/s (0 = unlimited)"`
+	RateBurst     int           `arg:"--rate-burst,help:Let up to this many commands of --rate build up while the threads are busy and send them once they're free like a token bucket (1 = drop the ones missed)"`
+	RateDist      string        `arg:"--rate-distribution,help:Give each thread its own rate drawn from uniform or exponential or bimodal averaging its share of --rate"`
+	FindMaxQps    bool          `arg:"--find-max-qps,help:Search for the highest --rate that keeps p99 under --target-p99"`
+	TargetP99     time.Duration `arg:"--target-p99,help:p99 latency SLA used by --find-max-qps"`
+	SweepThreads  string        `arg:"--sweep-threads,help:Comma-separated list of thread counts to do a run at each of and print a table comparing them; or START:END:+STEP/LENGTH eg. 10:500:+25/30s to step from START to END threads with each step lasting LENGTH"`
+	SweepCSV      string        `arg:"--sweep-csv,help:Also write the --sweep-threads table to this CSV file"`
+	TLSCompare    bool          `arg:"--tls-compare,help:Do a run with TLS 1.2 and 1.3 each with and without session resumption and print a table comparing them"`
+	ByteBudget    int64         `arg:"--byte-budget,help:Stop once this many bytes have been sent and received in total (TLS overhead included)"`
+	TargetOK      int64         `arg:"--target-successes,help:Stop once at least this many commands have succeeded however many failed on the way (warmup not included)"`
+	MaxErrors     int64         `arg:"--max-errors,help:Abort the run once more than this many commands have failed and report on what was done (warmup not included)"`
+	TotalRequests int64         `arg:"--total-requests,help:Stop once this many commands have been issued across all threads"`
+	Profile       string        `arg:"help:Traffic profile for each thread: steady or burst"`
+	BurstSize     int           `arg:"--burst-size,help:# of commands sent back to back per burst with --profile burst"`
+	BurstGap      time.Duration `arg:"--burst-gap,help:Idle time between bursts with --profile burst"`
+	CertDir       string        `arg:"--cert-dir,help:Directory of client cert/key pairs (NAME.crt or NAME.pem with NAME.key) to rotate through per connection"`
+	CertPerWorker bool          `arg:"--cert-per-worker,help:With --cert-dir pin each thread to one cert for the whole run"`
+	CertReuse     bool          `arg:"--allow-cert-reuse,help:Let --cert-per-worker threads share certs round-robin when there are fewer certs than threads"`
+	CertWeights   string        `arg:"--cert-weights,help:Comma-separated NAME=WEIGHT pairs giving some --cert-dir certs proportionally more of the connections (or threads with --cert-per-worker) than others"`
+	FD            int           `arg:"--fd,help:Run over this inherited connected socket instead of dialing; needs --threads 1 (-1 = dial)"`
+	LocalPorts    string        `arg:"--local-port-range,help:Only connect from local ports in this range eg. 40000-40999"`
+	ProxyProtocol string        `arg:"--proxy-protocol,help:Send a PROXY protocol header (v1 or v2) after connecting"`
+	DualStack     bool          `arg:"--dual-stack,help:Dial over IPv4 and IPv6 with Happy Eyeballs and break the results down by the family each connection used"`
+	CertExpiry    time.Duration `arg:"--check-cert-expiry,help:Warn if the server cert expires within this long (checked on the first handshake)"`
+	ExpiryFail    bool          `arg:"--fail-cert-expiry,help:Fail the run if --check-cert-expiry warns"`
+	PrintChain    bool          `arg:"--print-server-chain,help:Print the certificate chain the server presents on the first handshake"`
+	SNI           []string      `arg:"--sni,separate,help:TLS server name to send; repeat to rotate through several per connection"`
+	MaxFailRate   float64       `arg:"--max-fail-rate,help:Fail the run if more than this fraction of commands fail (0-1)"`
+	Service       string        `arg:"help:Cosign service name substituted for ${service} in commands"`
+	Preamble      string        `arg:"help:Command sent once on each connection after the handshake and timed separately from the commands"`
+	Heartbeat     string        `arg:"--heartbeat-command,help:Also send this command every --heartbeat-interval on a connection of its own and report its latency separately"`
+	HbInterval    time.Duration `arg:"--heartbeat-interval,help:How often to send --heartbeat-command"`
+	Sequence      []string      `arg:"--sequence,separate,help:Command to issue in turn on each connection; repeat to build a sequence (overrides --command)"`
+	Script        string        `arg:"--script,help:File of commands to issue in turn on each connection; one per line with %{worker} and %{iter} and %{rand32} substituted (overrides --command)"`
+	ScenarioCSV   string        `arg:"--scenario-csv,help:CSV file of command/weight/expected_codes/timeout/payload_file rows describing the mix of commands to send (overrides --command)"`
+	Scenarios     string        `arg:"help:File of 'name threads rate command' lines to run several client types at once in place of --threads and --rate and --command"`
+	Stagger       bool          `arg:"--stagger-commands,help:Start each thread at a different point in the --sequence so threads don't send the same commands in lockstep"`
+	RawOutput     string        `arg:"--raw-output,help:Write every result as newline-delimited JSON to this file"`
+	LatencyFile   string        `arg:"--latency-file,help:Write every result's worker and iteration and time and latency and outcome to this CSV file"`
+	OutputFormat  string        `arg:"--output-format,help:Summary format: text or json (a single JSON document) or csv (a header and one row) on stdout in place of the text and RESULT line"`
+	VegetaOutput  string        `arg:"--vegeta-output,help:Write every result in vegeta's JSON result format to this file for vegeta report/plot"`
+	BinaryOutput  string        `arg:"--binary-output,help:Write every result to this file as a fixed-width binary record which is much cheaper than --raw-output for very large runs"`
+	DecodeBinary  string        `arg:"--decode-binary,help:Instead of a run print the records in this --binary-output file as CSV"`
+	RawOutputGzip bool          `arg:"--raw-output-gzip,help:gzip the --raw-output file (implied by a .gz extension)"`
+	RotateSize    int64         `arg:"--rotate-size,help:Start a new --raw-output/--phase-trace/--latency-file/--error-log/--vegeta-output/--binary-output file once one reaches this many bytes (the old one gets a timestamp in its name)"`
+	RotateEvery   time.Duration `arg:"--rotate-interval,help:Start new per-request output files every interval eg. 1h (lined up with the clock)"`
+	RotateKeep    int           `arg:"--rotate-keep,help:Delete all but this many of the newest rotated files of each output (0 = keep them all)"`
+	PromTextfile  string        `arg:"--prometheus-textfile,help:Write Prometheus metrics for the run to this file"`
+	Pushgateway   string        `arg:"help:Push Prometheus metrics for the run to the Pushgateway at this URL"`
+	PromListen    string        `arg:"--prometheus-listen,help:Serve live Prometheus metrics at /metrics on this address eg. :9464 while running"`
+	TimelineCSV   string        `arg:"--timeline-csv,help:Write completed/rps/p50/p95/p99/failures for each --timeline-bucket of the run to this CSV file"`
+	TimelineWidth time.Duration `arg:"--timeline-bucket,help:Width of each --timeline-csv row"`
+	SaveBaseline  string        `arg:"--save-baseline,help:Save the run's p99 and other headline numbers to this file to compare later runs with"`
+	Baseline      string        `arg:"help:Compare the run's p99 with the one in this --save-baseline file"`
+	RegressThresh string        `arg:"--regress-threshold,help:Fail the run if its p99 is more than this much worse than the --baseline one eg. 10%"`
+	OnComplete    string        `arg:"--on-complete,help:Shell command to run after the summary with the run's JSON summary on stdin and in COSIGNPERF_SUMMARY"`
+	GrafanaFile   string        `arg:"--grafana-snapshot,help:Write the run's time range and results to this file in the form of a Grafana annotation to post to /api/annotations"`
+	PromExemplars bool          `arg:"--prometheus-exemplars,help:Use OpenMetrics format and attach request exemplars to histogram buckets"`
+	Pipeline      int           `arg:"help:Write this many commands back to back before reading their responses"`
+	CheckOrder    bool          `arg:"--check-order,help:Fail successful responses that don't echo back their command's {{.RequestID}} as OUTOFORDER"`
+	Multiplex     bool          `arg:"help:With --pipeline match responses to commands by the {{.RequestID}} echoed back instead of by order for servers that answer out of order"`
+	ConnCommands  int           `arg:"--commands-per-connection,help:Reconnect after this many commands on a connection (0 = never)"`
+	ReconnEvery   int           `arg:"--reconnect-every,help:Same as --commands-per-connection: tear down and re-establish the TLS session every N commands (0 = never)"`
+	ConnMode      string        `arg:"--conn-mode,help:persistent keeps each thread's connection for the whole run and per-request sets up a new one for every command and both is --ab-split"`
+	Latency       string        `arg:"--latency-window,help:What command latency covers: command (from when it was due to its whole response) or wire (from just before it's written to the first byte of its response)"`
+	Model         string        `arg:"help:Scheduling model: closed (each thread waits for its last command) or open (commands sent at --rate regardless)"`
+	ErrorLog      string        `arg:"--error-log,help:Write every failure in full to this file"`
+	PhaseTrace    string        `arg:"--phase-trace,help:Write per-request connect/starttls/handshake/command timings as CSV to this file"`
+	StrictEnv     bool          `arg:"--strict-env,help:Fail if a command references an unset environment variable"`
+	ApdexT        time.Duration `arg:"--apdex-threshold,help:Report the Apdex score for this target latency T counting failures and commands over 4T as frustrated"`
+	RespSizes     bool          `arg:"--response-sizes,help:Report the distribution of response sizes in bytes"`
+	Jitter        bool          `arg:"help:Report each thread's jitter as the mean change in latency between its consecutive successful commands"`
+	TopSlow       int           `arg:"--top-slow,help:List the N slowest requests with their thread and iteration and command and code at the end"`
+	MaxErrorKeys  int           `arg:"--max-error-keys,help:Count failures as OTHER once this many distinct errors have been seen to bound memory (0 = no limit)"`
+	SortErrors    string        `arg:"--sort-errors,help:Order of the error report: count (most frequent first) or alpha"`
+	Unit          string        `arg:"help:Print latencies as plain numbers in ns or us or ms or s instead of mixed units"`
+	PctMethod     string        `arg:"--percentile-method,help:Percentile definition: linear (interpolated) or nearest-rank"`
+	Combined      bool          `arg:"--combined-latency,help:Also report latency over successes and failures together as a client sees it"`
+	Bootstrap     int           `arg:"help:Resample successful latencies this many times to report confidence intervals for percentiles"`
+	AbSplit       bool          `arg:"--ab-split,help:Run half the threads reusing their connection and half reconnecting per command and compare them"`
+	BackoffCodes  []string      `arg:"--backoff-codes,help:Response codes (eg. 530) after which a thread backs off exponentially before its next command"`
+	BackoffStart  time.Duration `arg:"--backoff-initial,help:First backoff delay"`
+	BackoffMax    time.Duration `arg:"--backoff-max,help:Longest backoff delay"`
+	SetupTimeline bool          `arg:"--setup-timeline,help:Print connect/starttls/handshake failures for each second of the run"`
+	Prewarm       bool          `arg:"help:Connect every thread and finish its handshake before the clock starts so only commands on warm connections are timed"`
+	CheckLeaks    bool          `arg:"--check-leaks,help:After the run check that every goroutine it started has exited and print the stacks of any that haven't"`
+	PrintConfig   bool          `arg:"--print-config,help:Print every setting with defaults filled in to stderr before the run"`
+	ReportRuntime bool          `arg:"--report-runtime,help:Print Go runtime memory/GC stats and peak goroutines after the run"`
+	TCPInfo       bool          `arg:"--tcp-info,help:Read TCP_INFO from each connection as it closes and report retransmits and RTT (Linux only)"`
+	MaxProcs      int           `arg:"--max-procs,help:Use at most this many CPUs like GOMAXPROCS (0 = all)"`
+	SlowCommand   time.Duration `arg:"--command-timeout,help:Count commands slower than this as SLOW failures"`
+	SynSpread     time.Duration `arg:"--syn-spread,help:Space the threads' first connections this far apart at startup so a burst of SYNs doesn't trip an IDS"`
+	SlowStart     int           `arg:"--slow-start,help:Limit the number of TLS handshakes in progress at once (0 = unlimited)"`
+	ExpectRE      string        `arg:"--expect-response,help:Regular expression successful response lines must also match or count as RESPONSEMISMATCH failures"`
+	Expect        []string      `arg:"--expect,separate,help:Response codes counting as success for a command verb eg. LOGIN=231 (separate several codes with commas)"`
+	StrictCodes   bool          `arg:"--strict-codes,help:Only count the codes that mean a command did what it was asked as success (231 or 232 for CHECK and 2xx otherwise) for verbs without --expect"`
+	Principal     string        `arg:"--expect-principal,help:Successful CHECK responses must name this principal or count as PRINCIPALMISMATCH failures"`
+	Factors       []string      `arg:"--expect-factor,separate,help:Successful CHECK responses must list this factor or count as FACTORMISSING failures; repeat for several"`
+	Branch        []string      `arg:"--branch,separate,help:VERB:CODE=COMMAND[@WEIGHT] sends COMMAND next whenever VERB gets CODE eg. CHECK:533=REKEY; several for one VERB:CODE are picked by weight"`
+	STARTTLSOK    []string      `arg:"--starttls-ok-codes,help:Response codes to STARTTLS that mean go ahead with the handshake (default 220)"`
+	HandshakeTO   time.Duration `arg:"--handshake-timeout,help:How long to give the TLS handshake and the banner after it before failing with HANDSHAKETIMEOUT (0 = forever)"`
+	GreetingTO    time.Duration `arg:"--greeting-timeout,help:How long to wait for the whole 220 greeting after connecting before failing with GREETINGTIMEOUT (0 = forever)"`
+	ConnectTO     time.Duration `arg:"--connect-timeout,help:How long to wait for a TCP connection before failing with CONNTIMEOUT (0 = forever)"`
+	ReadTO        time.Duration `arg:"--read-timeout,help:How long to wait for the response to STARTTLS or a command before failing with TIMEOUT (0 = forever)"`
+	WriteTO       time.Duration `arg:"--write-timeout,help:How long a write of STARTTLS or a command can block before failing with TIMEOUT (0 = forever)"`
+	Retries       int           `arg:"help:Retry a command that times out or a connection that fails on a fresh connection up to this many times before counting it as a failure"`
+	RetryBackoff  time.Duration `arg:"--retry-backoff,help:Wait this long before the first --retries retry and twice as long before each one after it (0 = retry straight away)"`
+	MaxLine       int           `arg:"--max-line,help:Longest line accepted from the server in bytes before giving up with PROTOVIOLATION"`
+	Syslog        bool          `arg:"help:Log the run summary to syslog"`
+	Sqlite        string        `arg:"help:Add the run summary and tags to a runs table in this SQLite database"`
+	SqliteReqs    bool          `arg:"--sqlite-requests,help:With --sqlite also write every request to a requests table"`
+	SyslogEvents  bool          `arg:"--syslog-events,help:With --syslog also log every request"`
+	SyslogFacil   string        `arg:"--syslog-facility,help:syslog facility eg. daemon or local0"`
+	SyslogTag     string        `arg:"--syslog-tag,help:syslog tag"`
+	SampleSize    int           `arg:"--sample-size,help:Keep a uniform random sample of at most this many latencies per category and compute stats over it to bound memory (0 = keep all)"`
+	WarmupDur     time.Duration `arg:"--warmup-duration,help:Leave results that finish within this long of the start out of the stats"`
+	Warmup        int           `arg:"--warmup,help:Leave each thread's first N commands out of the stats (they still count towards --iterations)"`
+	ThinkTime     time.Duration `arg:"--think-time,help:Pause this long after each command on a thread before sending the next like a real client would"`
+	ThinkJitter   time.Duration `arg:"--think-jitter,help:Vary each --think-time pause at random by up to this much either way"`
+	Cooldown      time.Duration `arg:"--cooldown,help:Leave results that finish within this long of the end out of the stats"`
+	DrainTimeout  time.Duration `arg:"--drain-timeout,help:On an interrupt give connections this long to finish their command and have QUIT answered before closing them anyway"`
+	Cleanup       string        `arg:"--cleanup-command,help:Command like LOGOUT to send on each connection before QUIT so server-side session state is released rather than left to time out"`
+	Keepalive     string        `arg:"--keepalive-command,help:Command like NOOP to send on a connection that's been idle for --keepalive-interval between commands without counting it as a request"`
+	KeepaliveInt  time.Duration `arg:"--keepalive-interval,help:How long a connection can sit idle before --keepalive-command is sent"`
+	IdleQuit      time.Duration `arg:"--idle-before-quit,help:Sit idle this long on each connection after its last command before sending QUIT and report how often the server closed it first"`
+	CloseMode     string        `arg:"--close-mode,help:How to end connections: graceful (QUIT then FIN) or reset (RST without QUIT)"`
+	QuitPolicy    string        `arg:"--quit-policy,help:When to send QUIT: once (when closing each connection) or per-command (after every command and wait for the reply then reconnect) or never"`
+	MeasureSkew   bool          `arg:"--measure-skew,help:Send TIME instead of --command and report how far the server clock is from ours"`
+	MaxSkew       time.Duration `arg:"--max-skew,help:With --measure-skew fail the run if the median clock offset is bigger than this"`
+	Unbuffered    bool          `arg:"--unbuffered-results,help:Make threads wait for the collector to take each result to check it isn't a bottleneck"`
+	RequireAll    bool          `arg:"--require-all-workers,help:Fail the run if any thread produced no results at all"`
+	Smoke         bool          `arg:"help:Quick health check: a small load (2 threads x 5 commands by default) that fails on any error and just prints UP or DOWN"`
+	Interval      time.Duration `arg:"help:Run as a probe: repeat the run every interval until killed with fresh stats each time"`
+	Agent         string        `arg:"--agent,help:Instead of a run listen on this address (127.0.0.1 if just :port) for runs from a --coordinator and send their results back"`
+	AgentSecret   string        `arg:"--agent-secret-file,help:File with the secret shared by --agent and --coordinator that runs are signed with"`
+	Coordinator   string        `arg:"--coordinator,help:Comma-separated --agent addresses to do the run from at once instead of here and merge into one summary"`
+	MockServer    string        `arg:"--mock-server,help:Instead of a run act as a minimal cosignd listening on this address eg. localhost:6663 to try cosignperf against"`
+	MockResponse  []string      `arg:"--mock-response,separate,help:VERB=CODE TEXT for the --mock-server to answer VERB with"`
+	MockLatency   time.Duration `arg:"--mock-latency,help:How long the --mock-server waits before answering each command"`
+	ReconnJitter  time.Duration `arg:"--reconnect-jitter,help:Wait a random time up to this long before each reconnect so threads don't handshake in lockstep (0 = off)"`
+	Precheck      bool          `arg:"help:Before the run make one connection and set up a session on it and warn if that fails"`
+	PrecheckAbort bool          `arg:"--abort-on-precheck-fail,help:Fail straight away if --precheck fails instead of carrying on (implies --precheck)"`
+	WaitReady     time.Duration `arg:"--wait-for-ready,help:Retry the --precheck connection with backoff for up to this long before starting and fail if the server still isn't ready"`
+	VerifyCert    bool          `arg:"--verify-cert-accepted,help:Before the run do one handshake and stop straight away if the server rejects the client cert"`
+	AcceptBurst   int           `arg:"--accept-burst,help:Before the run open this many TCP connections at once and report how long the server took to accept them"`
+	EventLoop     int           `arg:"--event-loop,help:Experimental: drive the --threads connections from this many goroutines taking turns instead of one goroutine each (0 = off)"`
 }
 
-type durations []time.Duration
+// durations is a sample of latencies, kept with sampleSize
+type durations = loadgen.Durations
+
+// percentile is the method used for all reported percentiles, set by
+// --percentile-method
+var percentile = stats.Percentile
+
+// unit is what latencies are printed in, set by --unit; empty means Go's
+// usual duration format
+var unit string
+
+// exporter has the metrics served by --prometheus-listen, fed by every run
+var exporter *promWriter
+
+// structured is set by --output-format json or csv, when the summary is
+// printed in that format on stdout and there's no RESULT line
+var structured bool
+
+var units = map[string]time.Duration{"ns": time.Nanosecond, "us": time.Microsecond, "ms": time.Millisecond, "s": time.Second}
+
+// fmtd formats a latency for the summary in --unit
+func fmtd(d time.Duration) string {
+	if unit == "" {
+		return d.String()
+	}
+	if unit == "ns" {
+		return strconv.FormatInt(int64(d), 10)
+	}
+	return strconv.FormatFloat(float64(d)/float64(units[unit]), 'f', 3, 64)
+}
+
+// fmtStats formats the avg, max, min, 99pct and 95pct of d, or says there's
+// nothing to go on rather than printing zeros for an empty set
+func fmtStats(d durations) string {
+	return newLatencies(d).String()
+}
+
+// sampleSize caps the latencies kept per category, set by --sample-size
+var sampleSize int
+
+// maxErrorKeys caps the distinct errors kept, set by --max-error-keys
+var maxErrorKeys int
 
 type request struct {
-	tlsconfig *tls.Config
-	args      Args
+	tlsconfig  *tls.Config
+	args       Args
+	commands   []command
+	preamble   *command // sent once on each connection before commands
+	certs      []tls.Certificate
+	limiter    <-chan time.Time
+	budget     *int64
+	jobs       <-chan time.Time
+	ramp       []rampPoint     // --ramp-profile schedule in place of --rate
+	replay     []time.Duration // --replay send times in place of --rate
+	conns      *int64
+	closed     *int64    // connections closed so far
+	bytes      *int64    // bytes sent and received so far, with --byte-budget
+	deadline   time.Time // when --duration is up, zero if it isn't set
+	successes  *int64    // successful results collected so far, for --target-successes
+	failures   *int64    // failed results collected so far, for --max-errors
+	resumed    *int64    // handshakes that resumed a TLS session
+	handshake  chan struct{}
+	group      string
+	backoff    *time.Duration
+	branched   *int   // branch commands this worker has sent, which don't advance the sequence
+	retry      *retry // the iteration this worker last retried, with --retries
+	offset     int    // where this worker starts in commands, with --stagger-commands
+	runID      string
+	ids        *int64
+	server     *serverInfo
+	minTLS     uint16         // --require-tls-version, 0 if any will do
+	expectRE   *regexp.Regexp // --expect-response
+	scenarios  []scenario     // --scenarios, each run by its own threads
+	heartbeat  *command       // --heartbeat-command
+	tcp        *tcpStats
+	curves     *curveStats     // with --curves
+	negotiated *tlsStats       // version and cipher suite negotiated
+	prewarm    *sync.WaitGroup // workers still to connect, with --prewarm
+	started    chan struct{}   // closed once they all have
+	idle       *idleStats
+	cleanup    *sideStats      // --cleanup-command
+	keepalive  *sideStats      // --keepalive-command
+	stopping   <-chan struct{} // closed on an interrupt
+	drain      *drainStats
+	startup    time.Time // when the workers were started, for --syn-spread
+}
+
+// command is a single cosign command and the response codes that count as
+// success for it
+type command struct {
+	text     string
+	expect   map[string]bool
+	tmpl     *template.Template  // set when text uses {{...}} fields
+	script   string              // the --script line it came from, as written
+	raw      bool                // text is sent verbatim, without a CRLF
+	timeout  time.Duration       // --command-timeout for just this command, from --scenario-csv
+	payload  *payload            // values for {{.Payload}}, from --scenario-csv
+	branches map[string][]branch // --branch commands by response code
+}
+
+// branch is a command sent in response to a code, picked with a
+// probability proportional to weight among the branches for that code
+type branch struct {
+	cmd    *command
+	weight float64
+}
+
+// next picks the command to send after a response with code, or nil to carry
+// on with the sequence
+func (c command) next(code string) *command {
+	bs := c.branches[code]
+	if len(bs) == 0 {
+		return nil
+	}
+	var total float64
+	for _, b := range bs {
+		total += b.weight
+	}
+	n := rand.Float64() * total
+	for _, b := range bs {
+		if n -= b.weight; n < 0 {
+			return b.cmd
+		}
+	}
+	return bs[len(bs)-1].cmd
+}
+
+// commandData is what command templates are rendered with
+type commandData struct {
+	RequestID string
+	Worker    int
+	Iteration int
+	runID     string
+	pass      int    // how many times the worker has been through the commands, for Session
+	Payload   string // the next line of the command's payload_file, with --scenario-csv
+}
+
+// render fills in the command template for one request
+func (c command) render(data commandData) string {
+	if c.tmpl == nil {
+		return c.text
+	}
+	if c.payload != nil {
+		data.Payload = c.payload.next()
+	}
+	var b strings.Builder
+	c.tmpl.Execute(&b, data)
+	return b.String()
+}
+
+// response codes treated as success for commands without an --expect entry
+var defaultExpect = []string{"220", "231", "232", "533", "534", "431", "432", "250"}
+
+type result struct {
+	success   bool
+	status    string
+	elapsed   time.Duration
+	sni       string
+	port      int
+	code      string
+	message   string // the text of the response after the code
+	size      int    // bytes in the response, 0 if there wasn't one
+	group     string
+	requestID string
+	command   string // verb of the command, if one was sent
+	script    string // --script line of the command, if one was sent
+	setup     string // phase connection setup failed in, if it did
+	backoff   bool
+	offset    time.Duration // server clock minus ours, with --measure-skew
+	hasOffset bool
+	warmup    bool   // finished within --warmup-duration, so left out of the stats
+	cooldown  bool   // finished within --cooldown of the end, likewise
+	family    string // IPv4 or IPv6 with --dual-stack, if connected
+	host      string
+	retries   int // times it was tried again on a fresh connection, with --retries
+	worker    int
+	iteration int
+	time      time.Time
+	phases    phases
+}
+
+// phases breaks a result's elapsed time down by protocol step. Connection
+// setup is only set on the first result from each connection.
+type phases struct {
+	connect   time.Duration
+	starttls  time.Duration
+	greeting  time.Duration // the part of starttls spent waiting for the 220 greeting
+	handshake time.Duration
+	preamble  time.Duration
+	command   time.Duration
+}
+
+type report struct {
+	s          durations
+	f          durations
+	ns         int // successes seen, which can be more than len(s) with --sample-size
+	nf         int
+	conn       durations // connect+starttls+handshake of each established connection
+	dial       durations // and each of those phases on its own
+	starttls   durations
+	handshake  durations
+	cmd        durations // command round trip alone
+	nconn      int
+	ncmd       int
+	offsets    durations // server clock offsets, with --measure-skew
+	noffset    int
+	pre        durations // --preamble round trips
+	npre       int
+	errors     map[string]int
+	elapsed    time.Duration
+	started    time.Time // start of the measured part of the run
+	sni        map[string]*report
+	ports      map[string]*report
+	hosts      map[string]*report
+	codes      map[string]*report
+	groups     map[string]*report
+	families   map[string]*report
+	scripts    map[string]*report // by --script line
+	backoffs   int
+	timeouts   map[string]int // failures that were timeouts, by which one
+	functional int            // failures that were the server saying no, not anything breaking
+	retried    int            // results that needed --retries, and the retries they took
+	retries    int
+	unsaved    int // of those, ones that failed anyway
+	warmups    int
+	cooldowns  int
+	skipped    int64         // of the commands the run was sized for, ones with no result
+	wall       time.Duration // the whole run, warmup and all
+	closed     int64
+	bytes      int64
+	resumed    int64 // handshakes that resumed a TLS session
+	sizes      sizes // response sizes in bytes
+	nsize      int
+	apdex      apdex     // with --apdex-threshold
+	slowest    *slowest  // with --top-slow
+	jitter     *jitter   // with --jitter
+	timeline   *timeline // with --timeline-csv
+
+	certExpiring bool
+	// --heartbeat-command results, kept apart from the rest
+	heartbeat  *report
+	tcp        *tcpStats
+	curves     *curveStats
+	negotiated *tlsStats
+	idle       *idleStats
+	cleanup    *sideStats
+	keepalive  *sideStats
+	drain      *drainStats
+	rates      []float64
+	// results by worker, including warmup, to spot threads that never got going
+	workers map[int]int
+	// connection setup failures by phase, per second since the start of the run
+	setupTimeline map[int]map[string]int
+	setupFails    map[string]int // connection setup failures by phase
+	// time spent in each phase summed over every result, and the rest of
+	// their latency outside of any phase, for printPhaseShare
+	phaseTotal phases
+	otherTotal time.Duration
+}
+
+// rps is the rate results came in at over the measured part of the run, 0 if
+// it didn't last long enough to tell
+func (r *report) rps() float64 {
+	if r.elapsed <= 0 {
+		return 0
+	}
+	return float64(r.ns+r.nf) / r.elapsed.Seconds()
+}
+
+func newReport() *report {
+	return &report{
+		errors:   make(map[string]int),
+		timeouts: make(map[string]int),
+		sni:      make(map[string]*report),
+		ports:    make(map[string]*report),
+		hosts:    make(map[string]*report),
+		codes:    make(map[string]*report),
+		groups:   make(map[string]*report),
+		families: make(map[string]*report),
+		scripts:  make(map[string]*report),
+
+		setupTimeline: make(map[int]map[string]int),
+		setupFails:    make(map[string]int),
+		workers:       make(map[int]int),
+	}
+}
+
+// addTo adds r to the sub-report for key in m, creating it as needed
+func addTo(m map[string]*report, key string, r result) {
+	if m[key] == nil {
+		m[key] = newReport()
+	}
+	m[key].add(r)
+}
+
+func (rep *report) add(r result) {
+	if r.backoff {
+		rep.backoffs++
+	}
+	if r.retries > 0 {
+		rep.retried++
+		rep.retries += r.retries
+		if !r.success {
+			rep.unsaved++
+		}
+	}
+	if r.success {
+		rep.ns++
+		rep.s = rep.s.Keep(r.elapsed, rep.ns, sampleSize)
+	} else {
+		rep.nf++
+		rep.f = rep.f.Keep(r.elapsed, rep.nf, sampleSize)
+		key := r.status
+		if maxErrorKeys > 0 && rep.errors[key] == 0 && len(rep.errors) >= maxErrorKeys {
+			// too many distinct errors, lump the rest together
+			key = "OTHER"
+		}
+		rep.errors[key]++
+		if kind := timeoutKind(r.status); kind != "" {
+			rep.timeouts[kind]++
+		}
+		if functionalFailure(r.status) {
+			rep.functional++
+		}
+	}
+	if r.hasOffset {
+		rep.noffset++
+		rep.offsets = rep.offsets.Keep(r.offset, rep.noffset, sampleSize)
+	}
+	if r.setup != "" {
+		rep.setupFails[r.setup]++
+	}
+	p := r.phases
+	rep.phaseTotal.connect += p.connect
+	rep.phaseTotal.starttls += p.starttls
+	rep.phaseTotal.handshake += p.handshake
+	rep.phaseTotal.command += p.command
+	if other := r.elapsed - p.connect - p.starttls - p.handshake - p.command; other > 0 {
+		rep.otherTotal += other
+	}
+	if r.setup == "" && r.iteration > 0 {
+		if p := r.phases; p.handshake > 0 {
+			rep.nconn++
+			rep.conn = rep.conn.Keep(p.connect+p.starttls+p.handshake, rep.nconn, sampleSize)
+			rep.dial = rep.dial.Keep(p.connect, rep.nconn, sampleSize)
+			rep.starttls = rep.starttls.Keep(p.starttls, rep.nconn, sampleSize)
+			rep.handshake = rep.handshake.Keep(p.handshake, rep.nconn, sampleSize)
+		}
+		if p := r.phases; p.preamble > 0 {
+			rep.npre++
+			rep.pre = rep.pre.Keep(p.preamble, rep.npre, sampleSize)
+		}
+		rep.ncmd++
+		rep.cmd = rep.cmd.Keep(r.phases.command, rep.ncmd, sampleSize)
+	}
+	if apdexT > 0 {
+		rep.apdex.add(r)
+	}
+	if r.size > 0 {
+		rep.nsize++
+		rep.sizes = rep.sizes.keep(r.size, rep.nsize)
+	}
+}
+
+// ports returns the --port values as a comma separated list
+func (a Args) ports() string {
+	var ps []string
+	for _, p := range a.Port {
+		ps = append(ps, strconv.Itoa(p))
+	}
+	return strings.Join(ps, ",")
+}
+
+// target is the server being tested as host:port, with a list of ports if
+// there are several, or each -H host's if there are several of them
+func (a Args) target() string {
+	hosts := a.hosts()
+	if len(hosts) == 1 && !hasPort(hosts[0]) {
+		return net.JoinHostPort(a.Hostname, a.ports())
+	}
+	for i, h := range hosts {
+		if !hasPort(h) {
+			hosts[i] = net.JoinHostPort(h, a.ports())
+		}
+	}
+	return strings.Join(hosts, ",")
+}
+
+// hosts are the -H hosts, each as given with its port if it has one
+func (a Args) hosts() []string {
+	return strings.Split(a.Hostname, ",")
+}
+
+// hostOrder is the -H hosts' indexes repeated in proportion to
+// --host-weights, for host to hand out to the threads in turn
+var hostOrder []int
+
+// host is the -H host worker w connects to, as given
+func (a Args) host(w int) string {
+	hosts := a.hosts()
+	if len(hostOrder) > 0 && len(hosts) > 1 {
+		n := len(hostOrder)
+		return hosts[hostOrder[((w-1)%n+n)%n]]
+	}
+	n := len(hosts)
+	return hosts[((w-1)%n+n)%n]
+}
+
+// addr is the host and port worker w connects to, the port being the one
+// given with its -H host or otherwise from -P
+func (a Args) addr(w int) (string, int) {
+	return splitHost(a.host(w), a.port(w))
+}
+
+// splitHost splits a -H host given as host:port, or returns it with port if
+// it doesn't have one
+func splitHost(h string, port int) (string, int) {
+	if host, p, err := net.SplitHostPort(h); err == nil {
+		if n, err := strconv.Atoi(p); err == nil {
+			return host, n
+		}
+	}
+	return h, port
+}
+
+// hasPort says whether a -H host was given as host:port
+func hasPort(h string) bool {
+	_, port := splitHost(h, -1)
+	return port >= 0
+}
+
+// weightHosts works out hostOrder from a --host-weights list like
+// cosign1=3,cosign2=1, in the way weightCerts does. Hosts that aren't listed
+// have a weight of 1.
+func weightHosts(hosts []string, list string) ([]int, error) {
+	weights := make([]int, len(hosts))
+	for i := range weights {
+		weights[i] = 1
+	}
+	for _, f := range strings.Split(list, ",") {
+		name, w, ok := strings.Cut(strings.TrimSpace(f), "=")
+		weight, err := strconv.Atoi(w)
+		if !ok || err != nil || weight <= 0 {
+			return nil, fmt.Errorf("invalid --host-weights %q, want HOST=WEIGHT pairs with whole number weights", f)
+		}
+		i := 0
+		for ; i < len(hosts) && hosts[i] != name; i++ {
+		}
+		if i == len(hosts) {
+			return nil, fmt.Errorf("--host-weights: %s isn't one of the -H hosts", name)
+		}
+		weights[i] = weight
+	}
+	order, err := interleave(weights)
+	if err != nil {
+		return nil, fmt.Errorf("--host-weights: %s", err)
+	}
+	return order, nil
+}
+
+// port is the port worker w connects to
+func (a Args) port(w int) int {
+	n := len(a.Port)
+	return a.Port[((w-1)%n+n)%n]
+}
+
+func (Args) Version() string {
+	return os.Args[0] + " cosignperf 0.1"
+}
+
+// defaultArgs are the options as they are before the command line is parsed
+func defaultArgs() Args {
+	var args Args
+	args.SslSkipVerify = false
+	args.Hostname = "localhost"
+	args.HostStrategy = "round-robin"
+	args.Command = "NOOP"
+	args.Profile = "steady"
+	args.Model = "closed"
+	args.PctMethod = "linear"
+	args.BackoffStart = 100 * time.Millisecond
+	args.RetryBackoff = 100 * time.Millisecond
+	args.BackoffMax = 5 * time.Second
+	args.MaxFailRate = 1
+	args.MaxLine = 4096
+	args.GreetingTO = 30 * time.Second
+	args.HandshakeTO = 30 * time.Second
+	args.ConnectTO = 10 * time.Second
+	args.ReadTO = 30 * time.Second
+	args.WriteTO = 10 * time.Second
+	args.FD = -1
+	args.QuitPolicy = "once"
+	args.CloseMode = "graceful"
+	args.Pipeline = 1
+	args.SortErrors = "count"
+	args.HbInterval = time.Second
+	args.KeepaliveInt = 30 * time.Second
+	args.OutputFormat = "text"
+	args.Renegotiation = "never"
+	args.SyslogFacil = "daemon"
+	args.SyslogTag = "cosignperf"
+	args.ReconnJitter = 10 * time.Millisecond
+	args.ReplaySpeed = 1
+	args.TimelineWidth = time.Second
+	args.DrainTimeout = 5 * time.Second
+	args.Latency = "command"
+	return args
+}
+
+// Main runs cosignperf with the command line options in os.Args
+func Main() {
+	args := defaultArgs()
+	p := arg.MustParse(&args)
+	if args.MockServer != "" {
+		log.Fatalf("%s\n", mockServer(args))
+	}
+	if args.Agent != "" {
+		log.Fatalf("%s\n", agentServer(args))
+	}
+	if args.Coordinator != "" {
+		finish(coordinate(args, coordinatorArgs(os.Args[1:])))
+	}
+	if args.DecodeBinary != "" {
+		if err := decodeBinary(args.DecodeBinary, os.Stdout); err != nil {
+			log.Fatalf("%s\n", err)
+		}
+		os.Exit(0)
+	}
+	if len(args.Port) == 0 {
+		p.Fail("--port is required")
+	}
+	given := make(map[string]bool)
+	for _, h := range args.hosts() {
+		if h == "" || given[h] {
+			p.Fail(fmt.Sprintf("invalid -H %q, want a host or a comma-separated list of different hosts", args.Hostname))
+		}
+		given[h] = true
+	}
+	switch args.HostStrategy {
+	case "round-robin":
+	case "all":
+		if args.Duration > 0 || args.TotalRequests > 0 || args.ByteBudget > 0 || args.TargetOK > 0 || args.Model != "closed" || args.EventLoop > 0 || args.Replay != "" || args.Scenarios != "" {
+			p.Fail("--host-strategy all runs --iterations against each host so needs --model closed and can't be used with --duration, --total-requests, --byte-budget, --target-successes, --event-loop, --replay or --scenarios")
+		}
+	default:
+		p.Fail("--host-strategy must be one of round-robin, all")
+	}
+	if len(args.hosts()) > 1 && args.FD >= 0 {
+		p.Fail("--fd is a single connection so can't be used with several -H hosts")
+	}
+	if args.HostWeights != "" {
+		if len(args.hosts()) < 2 || args.HostStrategy != "round-robin" {
+			p.Fail("--host-weights needs several -H hosts and --host-strategy round-robin")
+		}
+		order, err := weightHosts(args.hosts(), args.HostWeights)
+		if err != nil {
+			p.Fail(err.Error())
+		}
+		hostOrder = order
+	}
+	if args.ReconnEvery < 0 || args.ConnCommands < 0 {
+		p.Fail("--reconnect-every and --commands-per-connection must not be negative")
+	}
+	if args.ReconnEvery > 0 {
+		if args.ConnCommands > 0 && args.ConnCommands != args.ReconnEvery {
+			p.Fail("--reconnect-every and --commands-per-connection are the same option, give one")
+		}
+		args.ConnCommands = args.ReconnEvery
+	}
+	switch args.ConnMode {
+	case "":
+	case "persistent":
+		if args.ConnCommands > 0 {
+			p.Fail("--conn-mode persistent never reconnects so can't be used with --commands-per-connection")
+		}
+	case "per-request":
+		if args.ConnCommands > 1 || args.FD >= 0 {
+			p.Fail("--conn-mode per-request reconnects for every command so can't be used with --fd or --commands-per-connection above 1")
+		}
+		args.ConnCommands = 1
+	case "both":
+		if args.ConnCommands > 0 {
+			p.Fail("--conn-mode both runs half the threads each way so can't be used with --commands-per-connection")
+		}
+		args.AbSplit = true
+	default:
+		p.Fail("--conn-mode must be one of persistent, per-request, both")
+	}
+	if args.ScenarioCSV != "" && (len(args.Sequence) > 0 || args.CommandHex != "" || args.CommandB64 != "" || args.Scenarios != "" || args.MeasureSkew) {
+		p.Fail("--scenario-csv can't be used with --sequence, --command-hex, --command-base64, --scenarios or --measure-skew")
+	}
+	if args.Script != "" && (len(args.Sequence) > 0 || args.ScenarioCSV != "" || args.CommandHex != "" || args.CommandB64 != "" || args.Scenarios != "" || args.MeasureSkew) {
+		p.Fail("--script can't be used with --sequence, --scenario-csv, --command-hex, --command-base64, --scenarios or --measure-skew")
+	}
+	var scenarios []scenario
+	if args.Scenarios != "" {
+		if args.Threads > 0 || args.Rate > 0 || args.Model != "closed" || args.AbSplit || args.EventLoop > 0 || args.RateDist != "" || args.FindMaxQps || args.FD >= 0 {
+			p.Fail("--scenarios sets the threads and rates itself and needs --model closed, so can't be used with --threads, --rate, --ab-split, --event-loop, --rate-distribution, --find-max-qps or --fd")
+		}
+		var err error
+		if scenarios, err = loadScenarios(args.Scenarios, args); err != nil {
+			p.Fail(err.Error())
+		}
+		for _, s := range scenarios {
+			args.Threads += s.threads
+		}
+	}
+	var sweep []int
+	if args.SweepThreads != "" {
+		if args.Threads > 0 || args.Scenarios != "" || args.FindMaxQps || args.Interval > 0 || args.FD >= 0 || args.AbSplit {
+			p.Fail("--sweep-threads sets the threads itself so can't be used with --threads, --scenarios, --find-max-qps, --interval, --fd or --ab-split")
+		}
+		var err error
+		var step time.Duration
+		if sweep, step, err = parseSweep(args.SweepThreads); err != nil {
+			p.Fail(err.Error())
+		}
+		if step > 0 {
+			if args.Duration > 0 || args.Iterations > 0 || args.TotalRequests > 0 {
+				p.Fail("a --sweep-threads step length is each run's --duration so can't be used with --duration, --iterations or --total-requests")
+			}
+			args.Duration = step
+		}
+		// check everything that depends on the thread count against the most
+		for _, n := range sweep {
+			if n > args.Threads {
+				args.Threads = n
+			}
+		}
+	} else if args.SweepCSV != "" {
+		p.Fail("--sweep-csv needs --sweep-threads")
+	}
+	if args.TLSCompare {
+		if args.SweepThreads != "" || args.FindMaxQps || args.Interval > 0 || args.FD >= 0 || args.AbSplit || args.RequireTLS != "" ||
+			args.TLSMax != "" || args.SessionResume {
+			p.Fail("--tls-compare does its own runs so can't be used with --sweep-threads, --find-max-qps, --interval, --fd, --ab-split, --require-tls-version, --tls-max-version or --session-resumption")
+		}
+		if args.ConnCommands == 0 {
+			log.Printf("warning: without --commands-per-connection each thread only handshakes once so resumption has little to show\n")
+		}
+	}
+	if args.Smoke {
+		// only fill in what wasn't given on the command line
+		if args.Threads == 0 {
+			args.Threads = 2
+		}
+		if args.Iterations == 0 && args.TotalRequests == 0 && args.Duration == 0 {
+			args.Iterations = 5
+		}
+		if args.SlowCommand == 0 {
+			args.SlowCommand = 2 * time.Second
+		}
+		if args.MaxFailRate == 1 {
+			args.MaxFailRate = 0
+		}
+		// so a host that doesn't answer is DOWN in seconds, not minutes
+		if args.ConnectTO == 10*time.Second {
+			args.ConnectTO = 3 * time.Second
+		}
+		if args.GreetingTO == 30*time.Second {
+			args.GreetingTO = 5 * time.Second
+		}
+		if args.HandshakeTO == 30*time.Second {
+			args.HandshakeTO = 5 * time.Second
+		}
+		if args.ReadTO == 30*time.Second {
+			args.ReadTO = 5 * time.Second
+		}
+		args.Quiet = true
+	}
+	if args.Threads <= 0 {
+		p.Fail("--threads is required")
+	}
+	if args.Iterations <= 0 && args.TotalRequests <= 0 && args.ByteBudget <= 0 && args.TargetOK <= 0 && args.Replay == "" && args.Duration <= 0 {
+		p.Fail("one of --iterations, --duration, --total-requests, --byte-budget, --target-successes or --replay is required")
+	}
+	if args.Duration < 0 {
+		p.Fail("--duration must not be negative")
+	}
+	if args.Duration > 0 && args.Iterations > 0 {
+		p.Fail("--duration and --iterations can't be used together")
+	}
+	switch args.Profile {
+	case "steady":
+	case "burst":
+		if args.BurstSize <= 0 {
+			p.Fail("--profile burst requires --burst-size")
+		}
+	default:
+		p.Fail("--profile must be one of steady, burst")
+	}
+	switch args.PctMethod {
+	case "linear":
+		percentile = stats.Percentile
+	case "nearest-rank":
+		percentile = stats.PercentileNearestRank
+	default:
+		p.Fail("--percentile-method must be one of linear, nearest-rank")
+	}
+	var replay []time.Duration
+	if args.Replay != "" {
+		if args.Model != "open" || args.Rate > 0 || args.RampProfile != "" || args.FindMaxQps || args.Interval > 0 {
+			p.Fail("--replay needs --model open and can't be used with --rate, --ramp-profile, --find-max-qps or --interval")
+		}
+		if args.ReplaySpeed <= 0 {
+			p.Fail("--replay-speed must be positive")
+		}
+		var err error
+		if replay, err = loadReplay(args.Replay); err != nil {
+			p.Fail(err.Error())
+		}
+		// the trace sets how many commands there are
+		args.Iterations, args.TotalRequests = 0, int64(len(replay))
+	}
+	switch args.Model {
+	case "closed":
+	case "open":
+		if args.Rate <= 0 && !args.FindMaxQps && args.RampProfile == "" && args.Replay == "" {
+			p.Fail("--model open requires --rate, --ramp-profile or --replay")
+		}
+		if args.Iterations <= 0 && args.TotalRequests <= 0 && args.Duration <= 0 {
+			p.Fail("--model open requires --iterations, --duration or --total-requests")
+		}
+	default:
+		p.Fail("--model must be one of closed, open")
+	}
+	if args.Latency != "command" && args.Latency != "wire" {
+		p.Fail("--latency-window must be one of command, wire")
+	}
+	switch args.ProxyProtocol {
+	case "", "v1", "v2":
+	default:
+		p.Fail("--proxy-protocol must be one of v1, v2")
+	}
+	if args.AbSplit && (args.Model != "closed" || args.Threads < 2) {
+		p.Fail("--ab-split needs --model closed and at least 2 threads")
+	}
+	if args.FD >= 0 && (args.Threads != 1 || args.Model != "closed" || args.ConnCommands > 0 || args.FindMaxQps || args.Interval > 0) {
+		p.Fail("--fd is a single connection: it needs --threads 1 and --model closed and can't be used with --commands-per-connection, --find-max-qps or --interval")
+	}
+	if args.DualStack && args.FD >= 0 {
+		p.Fail("--dual-stack can't be used with --fd")
+	}
+	if args.Pipeline < 1 {
+		p.Fail("--pipeline must be at least 1")
+	}
+	if args.Pipeline > 1 && (args.Model != "closed" || len(args.Branch) > 0 || args.QuitPolicy == "per-command") {
+		p.Fail("--pipeline needs --model closed and can't be used with --branch or --quit-policy per-command")
+	}
+	if args.AcceptBurst < 0 {
+		p.Fail("--accept-burst must not be negative")
+	}
+	if args.EventLoop < 0 {
+		p.Fail("--event-loop must not be negative")
+	}
+	if args.EventLoop > 0 && (args.Model != "closed" || args.Pipeline > 1 || len(args.Branch) > 0 || args.ConnCommands > 0 || args.AbSplit ||
+		args.FD >= 0 || args.QuitPolicy == "per-command" || len(args.BackoffCodes) > 0 || args.Profile != "steady" || args.ThinkTime > 0) {
+		p.Fail("--event-loop needs --model closed and can't be used with --pipeline, --branch, --commands-per-connection, --ab-split, --fd, --quit-policy per-command, --backoff-codes, --profile burst or --think-time")
+	}
+	if args.Warmup < 0 || args.ThinkTime < 0 || args.ThinkJitter < 0 {
+		p.Fail("--warmup, --think-time and --think-jitter must not be negative")
+	}
+	if args.Warmup > 0 && args.Iterations > 0 && args.Warmup >= args.Iterations {
+		p.Fail(fmt.Sprintf("--warmup %d leaves nothing of --iterations %d to measure", args.Warmup, args.Iterations))
+	}
+	if args.ThinkJitter > 0 && args.ThinkTime == 0 {
+		p.Fail("--think-jitter needs --think-time")
+	}
+	if args.Multiplex && (args.Pipeline < 2 || args.CheckOrder) {
+		p.Fail("--multiplex needs --pipeline 2 or more and can't be used with --check-order")
+	}
+	switch args.RateDist {
+	case "":
+	case "uniform", "exponential", "bimodal":
+		if args.Rate <= 0 || args.Model != "closed" || args.EventLoop > 0 || args.FindMaxQps {
+			p.Fail("--rate-distribution needs --rate and --model closed and can't be used with --event-loop or --find-max-qps")
+		}
+	default:
+		p.Fail("--rate-distribution must be one of uniform, exponential, bimodal")
+	}
+	if args.RateBurst < 0 {
+		p.Fail("--rate-burst must not be negative")
+	}
+	if args.RateBurst > 1 && (args.Rate <= 0 || args.RateDist != "") {
+		p.Fail("--rate-burst needs --rate and can't be used with --rate-distribution")
+	}
+	for _, code := range args.STARTTLSOK {
+		if n, err := strconv.Atoi(code); err != nil || n < 100 || n > 999 {
+			p.Fail(fmt.Sprintf("invalid --starttls-ok-codes %q, want three digit codes like 220", code))
+		}
+	}
+	if args.TimelineCSV != "" && (args.TimelineWidth <= 0 || args.Interval > 0 || args.FindMaxQps || args.SweepThreads != "") {
+		p.Fail("--timeline-csv needs a positive --timeline-bucket and can't be used with --interval, --find-max-qps or --sweep-threads")
+	}
+	if args.LocalPorts != "" {
+		if args.FD >= 0 {
+			p.Fail("--local-port-range can't be used with --fd")
+		}
+		var err error
+		if localPorts, err = parsePortRange(args.LocalPorts); err != nil {
+			p.Fail(err.Error())
+		}
+	}
+	if args.PrecheckAbort {
+		args.Precheck = true
+	}
+	if args.WaitReady < 0 {
+		p.Fail("--wait-for-ready must not be negative")
+	}
+	if (args.Precheck || args.VerifyCert || args.WaitReady > 0) && args.FD >= 0 {
+		p.Fail("--precheck, --wait-for-ready and --verify-cert-accepted can't be used with --fd, there's only the one connection")
+	}
+	if args.RotateSize < 0 || args.RotateEvery < 0 || args.RotateKeep < 0 {
+		p.Fail("--rotate-size, --rotate-interval and --rotate-keep must not be negative")
+	}
+	if args.RotateKeep > 0 && args.RotateSize == 0 && args.RotateEvery == 0 {
+		p.Fail("--rotate-keep needs --rotate-size or --rotate-interval")
+	}
+	if args.Baseline != "" {
+		var err error
+		if baseRun, err = loadBaseline(args.Baseline); err != nil {
+			p.Fail(err.Error())
+		}
+	}
+	if args.RegressThresh != "" {
+		if args.Baseline == "" {
+			p.Fail("--regress-threshold needs --baseline")
+		}
+		var err error
+		if regressThreshold, err = parseThreshold(args.RegressThresh); err != nil {
+			p.Fail(err.Error())
+		}
+	}
+	if args.SynSpread < 0 {
+		p.Fail("--syn-spread must not be negative")
+	}
+	if args.GreetingTO < 0 {
+		p.Fail("--greeting-timeout must not be negative")
+	}
+	if args.HandshakeTO < 0 {
+		p.Fail("--handshake-timeout must not be negative")
+	}
+	if args.IdleQuit < 0 || args.IdleQuit > 0 && (args.EventLoop > 0 || args.QuitPolicy == "per-command") {
+		p.Fail("--idle-before-quit must not be negative and can't be used with --event-loop or --quit-policy per-command")
+	}
+	if args.Prewarm && (args.Model != "closed" || args.EventLoop > 0) {
+		p.Fail("--prewarm needs --model closed and can't be used with --event-loop")
+	}
+	if args.RequireAll && args.Model != "closed" {
+		p.Fail("--require-all-workers needs --model closed")
+	}
+	renegotiation, ok := map[string]tls.RenegotiationSupport{
+		"never":  tls.RenegotiateNever,
+		"once":   tls.RenegotiateOnceAsClient,
+		"freely": tls.RenegotiateFreelyAsClient,
+	}[args.Renegotiation]
+	if !ok {
+		p.Fail("--renegotiation must be one of never, once, freely")
+	}
+	minTLS, ok := tlsVersions[args.RequireTLS]
+	if !ok && args.RequireTLS != "" {
+		p.Fail("--require-tls-version must be one of 1.0, 1.1, 1.2, 1.3")
+	}
+	tlsMin, ok := tlsVersions[args.TLSMin]
+	if !ok && args.TLSMin != "" {
+		p.Fail("--tls-min-version must be one of 1.0, 1.1, 1.2, 1.3")
+	}
+	tlsMax, ok := tlsVersions[args.TLSMax]
+	if !ok && args.TLSMax != "" {
+		p.Fail("--tls-max-version must be one of 1.0, 1.1, 1.2, 1.3")
+	}
+	if tlsMin > 0 && tlsMax > 0 && tlsMin > tlsMax {
+		p.Fail("--tls-min-version can't be above --tls-max-version")
+	}
+	switch args.SortErrors {
+	case "count", "alpha":
+	default:
+		p.Fail("--sort-errors must be one of count, alpha")
+	}
+	switch args.CloseMode {
+	case "graceful", "reset":
+	default:
+		p.Fail("--close-mode must be one of graceful, reset")
+	}
+	switch args.QuitPolicy {
+	case "once", "never":
+	case "per-command":
+		if args.ConnCommands > 1 || args.FD >= 0 {
+			p.Fail("--quit-policy per-command reconnects after every command")
+		}
+		args.ConnCommands = 1
+	default:
+		p.Fail("--quit-policy must be one of once, per-command, never")
+	}
+	if args.MaxProcs < 0 {
+		p.Fail("--max-procs must not be negative")
+	}
+	if args.MaxProcs > 0 {
+		runtime.GOMAXPROCS(args.MaxProcs)
+	}
+	if args.Heartbeat != "" && (args.HbInterval <= 0 || args.FD >= 0) {
+		p.Fail("--heartbeat-command needs a positive --heartbeat-interval and can't be used with --fd")
+	}
+	if args.Keepalive != "" && (args.KeepaliveInt <= 0 || args.Pipeline > 1 || args.EventLoop > 0) {
+		p.Fail("--keepalive-command needs a positive --keepalive-interval and can't be used with --pipeline or --event-loop")
+	}
+	if args.ConnectTO < 0 || args.ReadTO < 0 || args.WriteTO < 0 {
+		p.Fail("--connect-timeout, --read-timeout and --write-timeout must not be negative")
+	}
+	if args.Retries < 0 || args.RetryBackoff < 0 {
+		p.Fail("--retries and --retry-backoff must not be negative")
+	}
+	if args.Retries > 0 && (args.Model != "closed" || args.EventLoop > 0 || args.FD >= 0) {
+		p.Fail("--retries needs --model closed and can't be used with --event-loop or --fd")
+	}
+	if args.ReportEvery < 0 {
+		p.Fail("--report-interval must not be negative")
+	}
+	if args.TopSlow < 0 {
+		p.Fail("--top-slow must not be negative")
+	}
+	if args.ApdexT < 0 {
+		p.Fail("--apdex-threshold must not be negative")
+	}
+	apdexT = args.ApdexT
+	if args.SampleSize < 0 {
+		p.Fail("--sample-size must not be negative")
+	}
+	sampleSize = args.SampleSize
+	if args.MaxErrorKeys < 0 {
+		p.Fail("--max-error-keys must not be negative")
+	}
+	if args.MaxErrors < 0 {
+		p.Fail("--max-errors must not be negative")
+	}
+	maxErrorKeys = args.MaxErrorKeys
+	if _, ok := units[args.Unit]; !ok && args.Unit != "" {
+		p.Fail("--unit must be one of ns, us, ms, s")
+	}
+	unit = args.Unit
+	switch args.OutputFormat {
+	case "text":
+	case "json", "csv":
+		if args.Smoke || len(sweep) > 0 || args.TLSCompare || args.FindMaxQps || args.Interval > 0 {
+			p.Fail("--output-format json and csv summarize a single run so can't be used with --smoke, --sweep-threads, --tls-compare, --find-max-qps or --interval")
+		}
+		structured = true
+		args.Quiet = true
+	default:
+		p.Fail("--output-format must be one of text, json, csv")
+	}
+	if t, err := parseTags(args.Tag); err != nil {
+		p.Fail(err.Error())
+	} else {
+		tags = t
+	}
+	if args.MaxLine <= 0 {
+		p.Fail("--max-line must be positive")
+	}
+
+	// load our key and cert, or a whole directory of them
+	var certs []tls.Certificate
+	var err error
+	switch {
+	case args.CertDir != "":
+		var names []string
+		if certs, names, err = loadCertDir(args.CertDir); err == nil && args.CertWeights != "" {
+			certs, err = weightCerts(certs, names, args.CertWeights)
+		}
+	case args.CertFile != "" && args.KeyFile != "":
+		var clientcert tls.Certificate
+		clientcert, err = tls.LoadX509KeyPair(args.CertFile, args.KeyFile)
+		certs = []tls.Certificate{clientcert}
+	default:
+		p.Fail("--keyfile and --certfile, or --cert-dir, are required")
+	}
+	if err != nil {
+		log.Fatalf("%s\n", err)
+	}
+	if args.CertWeights != "" && args.CertDir == "" {
+		p.Fail("--cert-weights needs --cert-dir")
+	}
+	// weighted certs are meant to be shared
+	if args.CertPerWorker && args.CertWeights == "" && len(certs) < args.Threads {
+		if !args.CertReuse {
+			p.Fail(fmt.Sprintf("--cert-per-worker needs a cert for each of %d threads but %s has %d (see --allow-cert-reuse)",
+				args.Threads, args.CertDir, len(certs)))
+		}
+		log.Printf("warning: only %d certs for %d threads, some threads will share an identity\n", len(certs), args.Threads)
+	}
+
+	// create tls config
+	serverName, _ := args.addr(1)
+	tlsconfig := &tls.Config{
+		InsecureSkipVerify: args.SslSkipVerify,
+		ServerName:         serverName,
+		Certificates:       certs[:1],
+		Renegotiation:      renegotiation,
+		MinVersion:         tlsMin,
+		MaxVersion:         tlsMax,
+	}
+	if args.CAFile != "" {
+		if tlsconfig.RootCAs, err = loadCAFile(args.CAFile); err != nil {
+			p.Fail(err.Error())
+		}
+		if args.SslSkipVerify {
+			log.Printf("warning: --sslskipverify means --ca-file isn't used\n")
+		}
+	}
+	if args.Ciphers != "" {
+		if tlsconfig.CipherSuites, err = parseCiphers(args.Ciphers); err != nil {
+			p.Fail(err.Error())
+		}
+		if tlsMax == 0 || tlsMax == tls.VersionTLS13 {
+			log.Printf("warning: --ciphers only applies to TLS 1.2 and below, add --tls-max-version 1.2 to keep TLS 1.3 from being negotiated\n")
+		}
+	}
+	if args.SessionResume {
+		tlsconfig.ClientSessionCache = tls.NewLRUClientSessionCache(0)
+	}
+	if args.Curves != "" {
+		if tlsconfig.CurvePreferences, err = parseCurves(args.Curves); err != nil {
+			p.Fail(err.Error())
+		}
+	}
+	// write the session keys out for decrypting captures, eg. in Wireshark
+	if args.KeyLog == "" {
+		args.KeyLog = os.Getenv("SSLKEYLOGFILE")
+	}
+	if args.KeyLog != "" {
+		f, err := os.OpenFile(args.KeyLog, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+		if err != nil {
+			p.Fail(err.Error())
+		}
+		tlsconfig.KeyLogWriter = f
+		log.Printf("warning: writing TLS session keys to %s\n", args.KeyLog)
+	}
+
+	commands, preamble, err := parseCommands(args)
+	if err != nil {
+		p.Fail(err.Error())
+	}
+	// checked on the commands as loaded, since they can come from --script
+	// or --scenario-csv as well as --command and --sequence
+	if args.CheckOrder || args.Multiplex {
+		ok := sendsRequestID(commands)
+		for _, s := range scenarios {
+			ok = ok || sendsRequestID(s.commands)
+		}
+		if !ok {
+			p.Fail("--check-order and --multiplex need a command with {{.RequestID}} in it for the server to echo back")
+		}
+	}
+	base := request{tlsconfig: tlsconfig, args: args, commands: commands, preamble: preamble, certs: certs, runID: newRunID(), server: &serverInfo{}, replay: replay, minTLS: minTLS, scenarios: scenarios}
+	if args.PrintConfig {
+		printConfig(args)
+	}
+	if args.ExpectRE != "" {
+		if base.expectRE, err = regexp.Compile(args.ExpectRE); err != nil {
+			p.Fail(fmt.Sprintf("invalid --expect-response: %s", err))
+		}
+	}
+	if args.Heartbeat != "" {
+		expect, err := parseExpect(args)
+		if err == nil {
+			base.heartbeat, err = newCommand(args.Heartbeat, args, expect)
+		}
+		if err != nil {
+			p.Fail(err.Error())
+		}
+	}
+	if args.Cleanup != "" {
+		expect, err := parseExpect(args)
+		if err == nil {
+			var c *command
+			if c, err = newCommand(args.Cleanup, args, expect); err == nil {
+				base.cleanup = &sideStats{cmd: c}
+			}
+		}
+		if err != nil {
+			p.Fail(err.Error())
+		}
+	}
+	if args.Keepalive != "" {
+		expect, err := parseExpect(args)
+		if err == nil {
+			var c *command
+			if c, err = newCommand(args.Keepalive, args, expect); err == nil {
+				base.keepalive = &sideStats{cmd: c}
+			}
+		}
+		if err != nil {
+			p.Fail(err.Error())
+		}
+	}
+	if args.RampProfile != "" {
+		if args.Rate > 0 || args.FindMaxQps {
+			p.Fail("--ramp-profile can't be used with --rate or --find-max-qps")
+		}
+		if base.ramp, err = loadRamp(args.RampProfile); err != nil {
+			p.Fail(err.Error())
+		}
+	}
+
+	if args.Precheck || args.VerifyCert || args.WaitReady > 0 {
+		var setup, status string
+		if args.WaitReady > 0 {
+			setup, status = waitReady(base, args.WaitReady)
+		} else {
+			setup, status = precheck(base)
+		}
+		why := setup + ": " + status
+		switch {
+		case args.VerifyCert && certRejected(setup, status):
+			fmt.Printf("client cert rejected by server, not starting the run: %s\n", status)
+			finish("client_cert_rejected")
+		case setup == "" && (args.Precheck || args.WaitReady > 0):
+			host, port := args.addr(1)
+			log.Printf("precheck: set up a session on %s\n", net.JoinHostPort(host, strconv.Itoa(port)))
+		case setup == "":
+		case args.WaitReady > 0:
+			fmt.Printf("NOT READY after %s, not starting the run: %s\n", args.WaitReady, why)
+			finish("server_not_ready")
+		case !args.Precheck:
+		case args.PrecheckAbort:
+			fmt.Printf("PRECHECK failed, not starting the run: %s\n", why)
+			finish("precheck_failed")
+		default:
+			log.Printf("warning: precheck failed, carrying on anyway: %s\n", why)
+		}
+	}
+
+	if args.DualStack {
+		for _, h := range args.hosts() {
+			host, _ := splitHost(h, 0)
+			checkDualStack(host)
+		}
+	}
+
+	sl, err := openSyslog(args, base.runID)
+	if err != nil {
+		p.Fail(err.Error())
+	}
+	db, err := openSqlite(args, base.runID)
+	if err != nil {
+		p.Fail(err.Error())
+	}
+	if args.PromListen != "" {
+		if exporter, err = servePrometheus(args.PromListen, args.PromExemplars); err != nil {
+			p.Fail(err.Error())
+		}
+	}
+
+	if args.Interval > 0 {
+		if args.FindMaxQps {
+			p.Fail("--interval can't be used with --find-max-qps")
+		}
+		probeLoop(p, base, sl, db)
+	}
+
+	if args.TLSCompare {
+		sinks := openSinks(p, args, base.runID, sl, db)
+		reason := compareTLS(base, sinks...)
+		closeSinks(sinks)
+		finish(reason)
+	}
+
+	if len(sweep) > 0 {
+		sinks := openSinks(p, args, base.runID, sl, db)
+		reason := sweepThreads(base, sweep, args.SweepCSV, sinks...)
+		closeSinks(sinks)
+		finish(reason)
+	}
+
+	if args.FindMaxQps {
+		if args.TargetP99 <= 0 {
+			p.Fail("--find-max-qps requires --target-p99")
+		}
+		sinks := openSinks(p, args, base.runID, sl, db)
+		rate := findMaxQps(base, sinks...)
+		closeSinks(sinks)
+		if rate == 0 {
+			finish("no_sustainable_rate")
+		}
+		finish("")
+	}
+
+	var peak <-chan int
+	stop := make(chan struct{})
+	if args.ReportRuntime {
+		peak = peakGoroutines(stop)
+	}
+
+	// on its own before the run so the two don't skew each other
+	var accept acceptStats
+	if args.AcceptBurst > 0 {
+		accept = acceptBurst(args, args.AcceptBurst)
+	}
+
+	base.drain = newDrain()
+	base.stopping = onInterrupt(base.drain, args.DrainTimeout)
+
+	baseline := runtime.NumGoroutine()
+	sinks := openSinks(p, args, base.runID, sl, db)
+	rep := run(base, sinks...)
+	closeSinks(sinks)
+	close(stop)
+	var leaked int
+	if args.CheckLeaks {
+		leaked = checkLeaks(baseline)
+	}
+	s, f := rep.s, rep.f
+	sum := summarize(rep)
+
+	if structured {
+		reason := verdict(args, rep, sum)
+		print := printJSONSummary
+		if args.OutputFormat == "csv" {
+			print = printCSVSummary
+		}
+		if err := print(args, sum, base.runID, reason); err != nil {
+			log.Printf("%s\n", err)
+		}
+		saveSummary(args, rep, sum, base.runID, reason, sl, db)
+		finish(reason)
+	}
+
+	if args.Smoke {
+		reason := verdict(args, rep, sum)
+		if reason == "" {
+			fmt.Printf("UP %s: %d/%d commands succeeded, avg: %s\n",
+				args.target(), rep.ns, rep.ns+rep.nf, fmtd(sum.success.avg))
+		} else {
+			fmt.Printf("DOWN %s: %d/%d commands succeeded\n",
+				args.target(), rep.ns, rep.ns+rep.nf)
+			for _, e := range sortErrors(rep.errors, args.SortErrors) {
+				fmt.Printf("%d\t%s\n", rep.errors[e], strings.TrimSpace(e))
+			}
+			if rep.ns == 0 && args.FD < 0 {
+				diagnose(args, tlsconfig)
+			}
+		}
+		if args.OnComplete != "" {
+			if err := onComplete(args.OnComplete, args, sum, base.runID, reason); err != nil {
+				log.Printf("%s\n", err)
+			}
+		}
+		finish(reason)
+	}
+
+	var error_report string
+	for _, e := range sortErrors(rep.errors, args.SortErrors) {
+		error_report += fmt.Sprintf("%d\t%s\n", rep.errors[e], e)
+	}
+
+	var partial string
+	if sum.partial {
+		partial = "PARTIAL: interrupted, only the results in by then are counted\n"
+	}
+	fmt.Printf("\n===========\n"+
+		"%s"+
+		"Total elapsed time: %s\n"+
+		"Average req/s: %.2f\n"+
+		"Threads: %d, Commands/thread: %d, SUCCESS/FAIL: %d/%d\n"+
+		"SUCCESS: %s\n"+
+		"FAIL: %s\n"+
+		"Errors:\n%s",
+		partial,
+		sum.elapsed,
+		sum.rps,
+		args.Threads, args.Iterations, sum.ns, sum.nf,
+		sum.success,
+		sum.fail,
+		error_report,
+	)
+	if rep.skipped > 0 {
+		fmt.Printf("SKIPPED: %d commands never attempted, not counted as failures\n", rep.skipped)
+	}
+	printRates(rep)
+	printPhaseShare(rep)
+	if args.Combined {
+		all := loadgen.Combined(s, rep.ns, f, rep.nf)
+		if len(all) == 0 {
+			fmt.Printf("ALL: no samples\n")
+		} else {
+			fmt.Printf("ALL: avg: %s, max: %s, min: %s, 99pct: %s, 95pct: %s, 50pct: %s\n",
+				fmtd(all.Stat(stats.Mean)), fmtd(all.Stat(stats.Max)), fmtd(all.Stat(stats.Min)), fmtd(all.Percentile(percentile, 99)), fmtd(all.Percentile(percentile, 95)), fmtd(all.Percentile(percentile, 50)))
+		}
+	}
+
+	if unit != "" {
+		fmt.Printf("Latencies in %s\n", unit)
+	}
+	if idle := idleWorkers(args, rep); len(idle) > 0 {
+		fmt.Printf("Threads with no results: %v\n", idle)
+	}
+	for _, name := range args.SNI {
+		printBreakdown("SNI", name, rep.sni[name])
+	}
+	if len(args.Port) > 1 {
+		for _, port := range args.Port {
+			printBreakdown("PORT", strconv.Itoa(port), rep.ports[strconv.Itoa(port)])
+		}
+	}
+	if hosts := args.hosts(); len(hosts) > 1 {
+		for _, host := range hosts {
+			printBreakdown("HOST", host, rep.hosts[host])
+			if hr := rep.hosts[host]; hr != nil {
+				for _, e := range sortErrors(hr.errors, args.SortErrors) {
+					fmt.Printf("  %d\t%s\n", hr.errors[e], strings.TrimSpace(e))
+				}
+			}
+		}
+	}
+	if len(args.BackoffCodes) > 0 {
+		fmt.Printf("Backoffs: %d\n", rep.backoffs)
+	}
+	if len(rep.timeouts) > 0 {
+		printTimeouts(rep)
+	}
+	if rep.nf > 0 {
+		fmt.Printf("Failures: %d functional (answered but not as expected), %d transport\n", rep.functional, rep.nf-rep.functional)
+	}
+	if args.Retries > 0 {
+		fmt.Printf("Retries: %d results needed %d retries, %d failed anyway\n", rep.retried, rep.retries, rep.unsaved)
+	}
+	if args.CloseMode == "reset" {
+		fmt.Printf("Connections reset: %d\n", rep.closed)
+	}
+	if args.ByteBudget > 0 {
+		fmt.Printf("Bytes sent and received: %d of %d budget\n", rep.bytes, args.ByteBudget)
+	}
+	if args.TargetOK > 0 {
+		fmt.Printf("Target successes: %d of %d\n", rep.ns, args.TargetOK)
+	}
+	if args.Duration > 0 {
+		fmt.Printf("Duration: ran for %s of %s\n", rep.wall.Round(time.Millisecond), args.Duration)
+	}
+	if args.Rate > 0 && !args.FindMaxQps {
+		fmt.Printf("Rate: achieved %.2f req/s of %.2f requested\n", sum.rps, args.Rate)
+	}
+	if args.MaxErrors > 0 && int64(rep.nf) > args.MaxErrors {
+		fmt.Printf("Max errors: aborted after %d failures, more than --max-errors %d\n", rep.nf, args.MaxErrors)
+	}
+	if len(rep.rates) > 0 {
+		sorted := append([]float64{}, rep.rates...)
+		sort.Float64s(sorted)
+		fmt.Printf("Thread rates (%s): min: %.2f/s, median: %.2f/s, max: %.2f/s\n",
+			args.RateDist, sorted[0], sorted[len(sorted)/2], sorted[len(sorted)-1])
+	}
+	if args.Prewarm {
+		fmt.Printf("Prewarm: connections were all set up before timing started, so this is warm connection throughput\n")
+	}
+	if args.WarmupDur > 0 || args.Warmup > 0 {
+		var within []string
+		if args.Warmup > 0 {
+			within = append(within, fmt.Sprintf("each thread's first %d commands", args.Warmup))
+		}
+		if args.WarmupDur > 0 {
+			within = append(within, fmt.Sprintf("the first %s", args.WarmupDur))
+		}
+		fmt.Printf("Warmup: %d results in %s excluded\n", rep.warmups, strings.Join(within, " or "))
+	}
+	if args.ThinkTime > 0 {
+		fmt.Printf("Think time: %s after each command, give or take %s, not counted in the latencies\n", args.ThinkTime, args.ThinkJitter)
+	}
+	if args.Cooldown > 0 {
+		fmt.Printf("Cooldown: %d results in the last %s excluded\n", rep.cooldowns, args.Cooldown)
+	}
+	for _, sc := range base.scenarios {
+		printBreakdown("SCENARIO", sc.name, rep.groups[sc.name])
+	}
+	seen := make(map[string]bool)
+	for _, c := range base.commands {
+		if c.script != "" && !seen[c.script] {
+			seen[c.script] = true
+			printBreakdown("STEP", c.script, rep.scripts[c.script])
+		}
+	}
+	if args.DualStack {
+		for _, family := range []string{"IPv4", "IPv6"} {
+			printBreakdown("FAMILY", family, rep.families[family])
+			printSetup("FAMILY "+family, rep.families[family])
+		}
+	}
+	if args.AbSplit {
+		printBreakdown("GROUP", "reuse", rep.groups["reuse"])
+		printBreakdown("GROUP", "reconnect", rep.groups["reconnect"])
+		printSetup("GROUP reuse", rep.groups["reuse"])
+		printSetup("GROUP reconnect", rep.groups["reconnect"])
+	} else {
+		// the first command on each connection has its setup counted in,
+		// which skews the stats when there are few commands per connection
+		// or it reconnects, so show setup and the commands on their own
+		printSetup("", rep)
+	}
+	if args.Preamble != "" {
+		fmt.Printf("PREAMBLE: count: %d, %s\n", rep.npre, fmtStats(rep.pre))
+	}
+	if hb := rep.heartbeat; hb != nil {
+		all := append(append(durations{}, hb.s...), hb.f...)
+		fmt.Printf("HEARTBEAT (%s every %s): SUCCESS/FAIL: %d/%d, %s\n",
+			args.Heartbeat, args.HbInterval, hb.ns, hb.nf, fmtStats(all))
+	}
+	if args.MeasureSkew {
+		// TIME only has second resolution, so offsets are +/- about half a
+		// second on top of the round trip
+		fmt.Printf("SKEW: samples: %d, median offset: %s, min: %s, max: %s, avg RTT: %s\n",
+			rep.noffset, fmtd(rep.offsets.Stat(stats.Median)), fmtd(rep.offsets.Stat(stats.Min)), fmtd(rep.offsets.Stat(stats.Max)),
+			fmtd(rep.cmd.Stat(stats.Mean)))
+	}
+
+	if args.AcceptBurst > 0 {
+		fmt.Printf("ACCEPT (burst of %d): count: %d, avg: %s, max: %s, min: %s, 99pct: %s, 95pct: %s\n",
+			args.AcceptBurst, len(accept.d),
+			fmtd(accept.d.Stat(stats.Mean)), fmtd(accept.d.Stat(stats.Max)), fmtd(accept.d.Stat(stats.Min)), fmtd(accept.d.Percentile(percentile, 99)), fmtd(accept.d.Percentile(percentile, 95)),
+		)
+		for category, n := range accept.failures {
+			fmt.Printf("ACCEPT %s: %d\n", category, n)
+		}
+	}
+
+	if i := rep.idle; i != nil {
+		fmt.Printf("IDLE (%s before QUIT): connections: %d, closed by the server first: %d, avg: %s, min: %s, max: %s\n",
+			args.IdleQuit, i.n, i.closed, fmtd(i.after.Stat(stats.Mean)), fmtd(i.after.Stat(stats.Min)), fmtd(i.after.Stat(stats.Max)))
+	}
+	if c := rep.cleanup; c != nil {
+		fmt.Printf("CLEANUP (%s): connections: %d, not acknowledged: %d\n", args.Cleanup, c.sent, c.failed)
+	}
+	if k := rep.keepalive; k != nil {
+		fmt.Printf("KEEPALIVE (%s after %s idle): sent: %d, not acknowledged: %d\n", args.Keepalive, args.KeepaliveInt, k.sent, k.failed)
+	}
+	if d := rep.drain; d != nil && d.stopping {
+		fmt.Printf("DRAIN (%s): connections closed cleanly: %d, force-closed: %d\n", args.DrainTimeout, d.clean, d.forced)
+	}
+	if t := rep.negotiated; t != nil && rep.nconn > 0 {
+		fmt.Printf("TLS: %s\n", t)
+	}
+	if args.SessionResume {
+		fmt.Printf("RESUMPTION: %d of %d handshakes resumed\n", rep.resumed, rep.nconn)
+	}
+	if c := rep.curves; c != nil {
+		fmt.Printf("CURVES (offered %s): %s\n", args.Curves, c)
+	}
+	if t := rep.tcp; t != nil {
+		if t.n == 0 {
+			fmt.Printf("TCP: no TCP_INFO available\n")
+		} else {
+			fmt.Printf("TCP: connections: %d, retransmitted segments: %d, connections with retransmits: %d, RTT avg: %s, max: %s, 95pct: %s\n",
+				t.n, t.retrans, t.lossy, fmtd(t.rtt.Stat(stats.Mean)), fmtd(t.rtt.Stat(stats.Max)), fmtd(t.rtt.Percentile(percentile, 95)))
+		}
+	}
+
+	if args.SetupTimeline {
+		printSetupTimeline(rep)
+	}
+
+	if args.Bootstrap > 0 && len(s) > 0 {
+		lo99, hi99 := s.Bootstrap(percentile, 99, args.Bootstrap)
+		lo95, hi95 := s.Bootstrap(percentile, 95, args.Bootstrap)
+		fmt.Printf("SUCCESS 95%% CI (%d resamples): 99pct: %s - %s, 95pct: %s - %s\n",
+			args.Bootstrap, fmtd(lo99), fmtd(hi99), fmtd(lo95), fmtd(hi95))
+	}
+
+	// latency by response code, regardless of whether it counted as success
+	var codes []string
+	for code := range rep.codes {
+		codes = append(codes, code)
+	}
+	sort.Strings(codes)
+	for _, code := range codes {
+		r := rep.codes[code]
+		all := append(append(durations{}, r.s...), r.f...)
+		fmt.Printf("CODE %s: count: %d, avg: %s, max: %s, min: %s, 99pct: %s, 95pct: %s\n",
+			code, r.ns+r.nf,
+			fmtd(all.Stat(stats.Mean)), fmtd(all.Stat(stats.Max)), fmtd(all.Stat(stats.Min)), fmtd(all.Percentile(percentile, 99)), fmtd(all.Percentile(percentile, 95)),
+		)
+	}
+
+	if args.ApdexT > 0 {
+		fmt.Printf("APDEX (T=%s): %s\n", args.ApdexT, rep.apdex)
+	}
+	if args.RespSizes {
+		fmt.Printf("RESPONSE BYTES: count: %d, %s\n", rep.nsize, rep.sizes)
+	}
+	if args.Jitter {
+		fmt.Printf("JITTER (per thread): %s\n", rep.jitter)
+	}
+	if args.TopSlow > 0 {
+		rep.slowest.print()
+	}
+
+	if args.ReportRuntime {
+		var m runtime.MemStats
+		runtime.ReadMemStats(&m)
+		fmt.Printf("Runtime: heap in use: %.2f MiB, total alloc: %.2f MiB, GC cycles: %d, GC pause total: %s, max goroutines: %d, GOMAXPROCS: %d\n",
+			float64(m.HeapInuse)/(1<<20), float64(m.TotalAlloc)/(1<<20), m.NumGC, time.Duration(m.PauseTotalNs), <-peak, runtime.GOMAXPROCS(0),
+		)
+	}
+
+	if args.CheckLeaks {
+		fmt.Printf("Goroutine leaks: %d still running after the run\n", leaked)
+		if leaked > 0 {
+			fmt.Printf("  stacks of all goroutines are on stderr\n")
+		}
+	}
+
+	if rep.ns == 0 && args.FD < 0 {
+		diagnose(args, tlsconfig)
+	}
+
+	if baseRun != nil {
+		fmt.Printf("BASELINE (run %s at %s): 99pct: %s vs %s, %+.1f%%\n",
+			baseRun.RunID, baseRun.Time.Format(time.RFC3339), fmtd(sum.success.p99), fmtd(time.Duration(baseRun.P99Ns)), regression(sum)*100)
+	}
+
+	reason := verdict(args, rep, sum)
+	saveSummary(args, rep, sum, base.runID, reason, sl, db)
+	finish(reason)
 }
 
-type result struct {
-	success bool
-	status  string
-	elapsed time.Duration
+// saveSummary hands the finished run to every output that records its
+// summary, then to --on-complete
+func saveSummary(args Args, rep *report, sum summary, runID, reason string, sl *syslogWriter, db *sqliteWriter) {
+	if args.SaveBaseline != "" && sum.partial {
+		log.Printf("warning: not saving an interrupted run as the --save-baseline\n")
+	} else if args.SaveBaseline != "" {
+		if err := writeBaseline(args.SaveBaseline, args, sum, runID); err != nil {
+			log.Printf("%s\n", err)
+		}
+	}
+	if sl != nil {
+		if err := sl.summary(args, sum, reason); err != nil {
+			log.Printf("%s\n", err)
+		}
+	}
+	if db != nil {
+		if err := db.summary(args, sum, reason); err != nil {
+			log.Printf("%s\n", err)
+		}
+	}
+	if args.GrafanaFile != "" {
+		if err := writeGrafana(args.GrafanaFile, args, sum, runID, reason); err != nil {
+			log.Printf("%s\n", err)
+		}
+	}
+	if args.TimelineCSV != "" {
+		if err := writeTimeline(args.TimelineCSV, rep); err != nil {
+			log.Printf("timeline csv: %s\n", err)
+		}
+	}
+	if args.OnComplete != "" {
+		if err := onComplete(args.OnComplete, args, sum, runID, reason); err != nil {
+			log.Printf("%s\n", err)
+		}
+	}
 }
 
-func (Args) Version() string {
-	return os.Args[0] + " cosignperf 0.1"
+// sortErrors returns the keys of errors in a stable order so reports can be
+// diffed: by count, most frequent first, or alphabetically
+func sortErrors(errors map[string]int, by string) []string {
+	var keys []string
+	for e := range errors {
+		keys = append(keys, e)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if by == "count" && errors[keys[i]] != errors[keys[j]] {
+			return errors[keys[i]] > errors[keys[j]]
+		}
+		return keys[i] < keys[j]
+	})
+	return keys
 }
 
-func main() {
-	var args Args
-	args.SslSkipVerify = false
-	args.Port = 6663
-	args.Hostname = "localhost"
-	args.Command = "NOOP"
-	arg.MustParse(&args)
+// probeLoop does a run every --interval forever, printing a one line summary
+// after each and refreshing the metrics outputs. Each run starts with fresh
+// stats. A run that takes longer than the interval is followed by the next
+// one straight away.
+func probeLoop(p *arg.Parser, base request, sl *syslogWriter, db *sqliteWriter) {
+	args := base.args
+	ticker := time.NewTicker(args.Interval)
+	defer ticker.Stop()
+	for {
+		// new ids each time round so request ids stay unique, and recheck
+		// the server cert
+		base.runID, base.server = newRunID(), &serverInfo{}
+		if sl != nil {
+			sl.runID = base.runID
+		}
+		if db != nil {
+			db.runID = base.runID
+		}
+		sinks := openSinks(p, args, base.runID, sl, db)
+		rep := run(base, sinks...)
+		closeSinks(sinks)
 
-	// load our key and cert
-	clientcert, err := tls.LoadX509KeyPair(args.CertFile, args.KeyFile)
-	if err != nil {
-		log.Fatalf("%s\n", err)
+		sum := summarize(rep)
+		reason := verdict(args, rep, sum)
+		result := "ok"
+		if reason != "" {
+			result = "fail reason=" + reason
+		}
+		fmt.Printf("%s SUCCESS/FAIL: %d/%d, req/s: %.2f, avg: %s, 99pct: %s, 95pct: %s, RESULT %s\n",
+			time.Now().Format(time.RFC3339), sum.ns, sum.nf, sum.rps,
+			fmtd(sum.success.avg), fmtd(sum.success.p99), fmtd(sum.success.p95), result)
+		if sl != nil {
+			if err := sl.summary(args, sum, reason); err != nil {
+				log.Printf("%s\n", err)
+			}
+		}
+		if db != nil {
+			if err := db.summary(args, sum, reason); err != nil {
+				log.Printf("%s\n", err)
+			}
+		}
+		if args.GrafanaFile != "" {
+			if err := writeGrafana(args.GrafanaFile, args, sum, base.runID, reason); err != nil {
+				log.Printf("%s\n", err)
+			}
+		}
+		<-ticker.C
 	}
+}
 
-	// create tls config
-	tlsconfig := &tls.Config{
-		InsecureSkipVerify: args.SslSkipVerify,
-		ServerName:         args.Hostname,
-		Certificates:       []tls.Certificate{clientcert},
+// peakGoroutines samples the number of goroutines until stop is closed, then
+// sends the highest count seen
+func peakGoroutines(stop <-chan struct{}) <-chan int {
+	peak := make(chan int, 1)
+	go func() {
+		highest := runtime.NumGoroutine()
+		ticker := time.NewTicker(100 * time.Millisecond)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if n := runtime.NumGoroutine(); n > highest {
+					highest = n
+				}
+			case <-stop:
+				peak <- highest
+				return
+			}
+		}
+	}()
+	return peak
+}
+
+// printSetupTimeline prints connection setup failures for each second of the
+// run that had any, to show when a server stopped accepting connections
+func printSetupTimeline(rep *report) {
+	var secs []int
+	for sec := range rep.setupTimeline {
+		secs = append(secs, sec)
+	}
+	sort.Ints(secs)
+
+	fmt.Printf("Setup failures per second:\n")
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(w, "second\tconnect\tstarttls\thandshake\n")
+	for _, sec := range secs {
+		n := rep.setupTimeline[sec]
+		fmt.Fprintf(w, "%d\t%d\t%d\t%d\n", sec, n["connect"], n["starttls"], n["handshake"])
+	}
+	w.Flush()
+}
+
+// printRates splits the success rate into connections that got as far as a
+// working TLS session and commands that succeeded once they had one, so
+// not being able to connect isn't mixed up with the server turning commands
+// down. A failed --preamble still had a working session.
+func printRates(rep *report) {
+	lost := rep.setupFails["connect"] + rep.setupFails["starttls"] + rep.setupFails["handshake"]
+	reached := rep.nconn + rep.setupFails["preamble"]
+	commands := rep.ns + rep.nf - lost - rep.setupFails["preamble"]
+	fmt.Printf("CONNECTIONS: %s of %d attempts reached a working TLS session\n", pct(reached, reached+lost), reached+lost)
+	fmt.Printf("COMMANDS: %s of %d commands on working sessions succeeded\n", pct(rep.ns, commands), commands)
+}
+
+// printPhaseShare prints the share of all the time taken by results that
+// went on each phase, to show at a glance whether it's connection setup or
+// the commands themselves that cost the most. other is time outside of any
+// phase, like queueing in the open model.
+func printPhaseShare(rep *report) {
+	t := rep.phaseTotal
+	shares := []struct {
+		name string
+		d    time.Duration
+	}{
+		{"connect", t.connect}, {"starttls", t.starttls}, {"handshake", t.handshake},
+		{"command", t.command}, {"other", rep.otherTotal},
+	}
+	var total time.Duration
+	for _, s := range shares {
+		total += s.d
+	}
+	if total <= 0 {
+		return
+	}
+	var parts []string
+	for _, s := range shares {
+		parts = append(parts, fmt.Sprintf("%s: %.1f%%", s.name, 100*float64(s.d)/float64(total)))
+	}
+	fmt.Printf("TIME BY PHASE: %s\n", strings.Join(parts, ", "))
+}
+
+// pct formats n as a percentage of total, or n/a if there's no total
+func pct(n, total int) string {
+	if total <= 0 {
+		return "n/a"
+	}
+	return fmt.Sprintf("%.2f%%", 100*float64(n)/float64(total))
+}
+
+// printBreakdown prints a one line summary of the sub-report for name
+func printBreakdown(label, name string, r *report) {
+	if r == nil {
+		r = newReport()
 	}
+	fmt.Printf("%s %s: SUCCESS/FAIL: %d/%d, %s\n", label, name, r.ns, r.nf, fmtStats(r.s))
+}
+
+// printTimeouts counts the failures that were timeouts, as a category of
+// their own apart from the server answering with an error, broken down by
+// which timeout ran out
+func printTimeouts(rep *report) {
+	var n int
+	var parts []string
+	for _, kind := range []string{"connect", "greeting", "starttls", "handshake", "read", "write"} {
+		if c := rep.timeouts[kind]; c > 0 {
+			n += c
+			parts = append(parts, fmt.Sprintf("%s: %d", kind, c))
+		}
+	}
+	fmt.Printf("Timeouts: %d of %d failures (%s)\n", n, rep.nf, strings.Join(parts, ", "))
+}
+
+// printSetup prints the distribution of connection setup time and of command
+// time alone, to separate the per-connection overhead from the commands
+func printSetup(label string, r *report) {
+	if r == nil {
+		r = newReport()
+	}
+	if label != "" {
+		label += " "
+	}
+	fmt.Printf("%sSETUP (connect+starttls+handshake): count: %d, %s\n", label, r.nconn, fmtStats(r.conn))
+	if r.nconn > 0 {
+		fmt.Printf("%s  CONNECT: %s\n", label, fmtStats(r.dial))
+		fmt.Printf("%s  STARTTLS: %s\n", label, fmtStats(r.starttls))
+		fmt.Printf("%s  HANDSHAKE: %s\n", label, fmtStats(r.handshake))
+	}
+	fmt.Printf("%sCOMMAND: count: %d, %s\n", label, r.ncmd, fmtStats(r.cmd))
+}
+
+// checkLeaks returns how many goroutines are left over from the run, beyond
+// the baseline number running before it, and writes their stacks to stderr.
+// Some take a moment to notice they've been told to stop, so they get a
+// second to go.
+func checkLeaks(baseline int) int {
+	n := runtime.NumGoroutine()
+	for deadline := time.Now().Add(time.Second); n > baseline && time.Now().Before(deadline); n = runtime.NumGoroutine() {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n <= baseline {
+		return 0
+	}
+	pprof.Lookup("goroutine").WriteTo(os.Stderr, 1)
+	return n - baseline
+}
+
+// printConfig writes out the settings for the run as flags, one per line,
+// after defaults and the adjustments made by other flags
+func printConfig(args Args) {
+	v := reflect.ValueOf(args)
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		name := "--" + strings.ToLower(f.Name)
+		for _, opt := range strings.Split(f.Tag.Get("arg"), ",") {
+			if strings.HasPrefix(opt, "--") {
+				name = opt
+			}
+		}
+		fmt.Fprintf(os.Stderr, "%s %v\n", name, v.Field(i).Interface())
+	}
+}
+
+// newRunID returns a random id that prefixes every request id in this run, so
+// ids from separate runs don't collide in the server logs
+func newRunID() string {
+	b := make([]byte, 4)
+	crand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// idleWorkers lists the threads that didn't produce a single result. With
+// --model open threads are only handed work as needed, so an idle one isn't
+// a problem and none are reported.
+func idleWorkers(args Args, rep *report) []int {
+	if args.Model != "closed" {
+		return nil
+	}
+	var idle []int
+	for w := 1; w <= args.Threads; w++ {
+		if rep.workers[w] == 0 {
+			idle = append(idle, w)
+		}
+	}
+	return idle
+}
+
+// verdict checks a finished run, summed up in sum, against the pass/fail
+// gates, returning why it failed or "" if it passed
+func verdict(args Args, rep *report, sum summary) string {
+	if args.MaxErrors > 0 && int64(rep.nf) > args.MaxErrors {
+		// aborted, so the other gates would be judging a partial run
+		return "max_errors"
+	}
+	if rep.ns == 0 {
+		return "no_successes"
+	}
+	if args.ExpiryFail && rep.certExpiring {
+		return "cert_expiring"
+	}
+	if args.RequireAll && len(idleWorkers(args, rep)) > 0 {
+		return "idle_workers"
+	}
+	if float64(rep.nf)/float64(rep.ns+rep.nf) > args.MaxFailRate {
+		return "fail_rate_exceeded"
+	}
+	if args.MaxSkew > 0 {
+		if off := rep.offsets.Stat(stats.Median); rep.noffset == 0 || off > args.MaxSkew || off < -args.MaxSkew {
+			return "clock_skew"
+		}
+	}
+	if args.RegressThresh != "" && regression(sum) > regressThreshold {
+		return "latency_regression"
+	}
+	return ""
+}
+
+// finish prints the final RESULT line for scripts to grep and exits non-zero
+// if the run failed. It must be the last thing written to stdout. With
+// --output-format json or csv the summary has the result instead.
+func finish(reason string) {
+	if structured {
+		if reason != "" {
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+	if reason != "" {
+		fmt.Printf("RESULT fail reason=%s\n", reason)
+		os.Exit(1)
+	}
+	fmt.Printf("RESULT ok\n")
+	os.Exit(0)
+}
 
+// run does a single benchmark pass with the given args and collects the results
+func run(base request, sinks ...sink) *report {
+	args := base.args
 	requestc := make(chan request, args.Threads)
-	resultc := make(chan result, args.Threads*args.Iterations)
+	expected := int64(args.Threads * args.Iterations)
+	if args.HostStrategy == "all" {
+		expected *= int64(len(args.hosts()))
+	}
+	if args.TotalRequests > 0 && (expected == 0 || args.TotalRequests < expected) {
+		expected = args.TotalRequests
+	}
+	// normally sized so workers never wait on the collector
+	buffered := expected
+	if args.Unbuffered {
+		buffered = 0
+	}
+	resultc := make(chan result, buffered)
+
+	// shared across workers so the total is independent of thread count
+	var budget *int64
+	if args.TotalRequests > 0 {
+		budget = new(int64)
+		*budget = args.TotalRequests
+	}
+
+	// pace commands across all workers
+	var limiter <-chan time.Time
+	var rates []float64 // per thread, with --rate-distribution
+	if args.Rate > 0 && args.RateDist == "" && args.RateBurst > 1 {
+		stop := make(chan struct{})
+		defer close(stop)
+		limiter = loadgen.TokenBucket(args.Rate, args.RateBurst, stop)
+	} else if args.Rate > 0 && args.RateDist == "" {
+		ticker := time.NewTicker(time.Duration(float64(time.Second) / args.Rate))
+		defer ticker.Stop()
+		limiter = ticker.C
+	} else if len(base.ramp) > 0 {
+		stop := make(chan struct{})
+		defer close(stop)
+		limiter = rampLimiter(base.ramp, stop)
+	} else if len(base.replay) > 0 {
+		stop := make(chan struct{})
+		defer close(stop)
+		limiter = replayLimiter(base.replay, args.ReplaySpeed, stop)
+	}
+
+	req := base
+	req.limiter, req.budget, req.conns, req.ids, req.closed = limiter, budget, new(int64), new(int64), new(int64)
+	req.bytes, req.resumed, req.successes, req.failures = new(int64), new(int64), new(int64), new(int64)
+	if args.TCPInfo {
+		req.tcp = &tcpStats{}
+	}
+	if args.Curves != "" {
+		req.curves = &curveStats{n: make(map[tls.CurveID]int)}
+	}
+	req.negotiated = &tlsStats{n: make(map[string]int)}
+	if args.IdleQuit > 0 {
+		req.idle = &idleStats{}
+	}
+	if base.cleanup != nil {
+		req.cleanup = &sideStats{cmd: base.cleanup.cmd}
+	}
+	if base.keepalive != nil {
+		req.keepalive = &sideStats{cmd: base.keepalive.cmd}
+	}
+	if args.Prewarm {
+		req.prewarm, req.started = new(sync.WaitGroup), make(chan struct{})
+		req.prewarm.Add(args.Threads)
+	}
+	if args.SlowStart > 0 {
+		req.handshake = make(chan struct{}, args.SlowStart)
+	}
 
-	// create workers
-	for i := 1; i <= args.Threads; i++ {
-		go worker(i, requestc, resultc)
+	// runs alongside the workers until they're done
+	var hb <-chan *report
+	stopHeartbeat := make(chan struct{})
+	if base.heartbeat != nil {
+		hb = heartbeat(req, *base.heartbeat, stopHeartbeat)
 	}
 
-	// submit jobs
+	// create workers and submit jobs, then close resultc once they have all
+	// returned
+	var wg sync.WaitGroup
 	start := time.Now()
-	for i := 1; i <= args.Threads; i++ {
-		requestc <- request{tlsconfig: tlsconfig, args: args}
+	req.startup = start
+	if args.Duration > 0 {
+		req.deadline = start.Add(args.Duration)
+	}
+	if args.Model == "open" {
+		req.limiter = nil
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			dispatch(req, limiter, expected, &wg, resultc)
+		}()
+	} else if args.EventLoop > 0 {
+		// share the threads' connections out between the loops
+		for l := 1; l <= args.EventLoop && l <= args.Threads; l++ {
+			var ws []int
+			for w := l; w <= args.Threads; w += args.EventLoop {
+				ws = append(ws, w)
+			}
+			wg.Add(1)
+			go func(ws []int) {
+				defer wg.Done()
+				eventLoop(ws, req, resultc)
+			}(ws)
+		}
+	} else {
+		for i := 1; i <= args.Threads; i++ {
+			wg.Add(1)
+			go func(w int) {
+				defer wg.Done()
+				worker(w, requestc, resultc)
+			}(i)
+		}
+		scenarioTicks := make([]<-chan time.Time, len(base.scenarios))
+		for n, s := range base.scenarios {
+			if s.rate > 0 {
+				ticker := time.NewTicker(time.Duration(float64(time.Second) / s.rate))
+				defer ticker.Stop()
+				scenarioTicks[n] = ticker.C
+			}
+		}
+		for i, n, left := 1, 0, 0; i <= args.Threads; i++ {
+			r := req
+			if len(base.scenarios) > 0 {
+				// hand out each scenario's threads in turn
+				if left == 0 {
+					n, left = n+1, base.scenarios[n].threads
+				}
+				left--
+				s := base.scenarios[n-1]
+				r.group, r.commands, r.limiter = s.name, s.commands, scenarioTicks[n-1]
+			}
+			if args.RateDist != "" {
+				// each thread paces itself at its own rate
+				rate := loadgen.ThreadRate(args.RateDist, args.Rate/float64(args.Threads))
+				ticker := time.NewTicker(time.Duration(float64(time.Second) / rate))
+				defer ticker.Stop()
+				r.limiter = ticker.C
+				rates = append(rates, rate)
+			}
+			if args.AbSplit {
+				// half the threads keep their connection, half reconnect for
+				// every command
+				r.group = "reuse"
+				if i > args.Threads/2 {
+					r.group = "reconnect"
+					r.args.ConnCommands = 1
+				}
+			}
+			requestc <- r
+		}
+		close(requestc)
 	}
+	if args.Prewarm {
+		// the measured window starts once every connection is ready
+		req.prewarm.Wait()
+		start = time.Now()
+		close(req.started)
+	}
+	go func() {
+		wg.Wait()
+		close(resultc)
+	}()
 
 	// collect results
-	var s durations
-	var f durations
-	var errors = make(map[string]int)
-	for i := 1; i <= (args.Iterations * args.Threads); i++ {
-		r := <-resultc
+	rep := newReport()
+	if args.TopSlow > 0 {
+		rep.slowest = &slowest{n: args.TopSlow}
+	}
+	if args.Jitter {
+		rep.jitter = newJitter()
+	}
+	if args.TimelineCSV != "" {
+		rep.timeline = &timeline{width: args.TimelineWidth, buckets: make(map[int]*report)}
+	}
+	measured := start.Add(args.WarmupDur)
+	collect := func(r result) {
+		rep.workers[r.worker]++
+		for _, s := range sinks {
+			s.write(r)
+		}
+		if r.warmup {
+			rep.warmups++
+			return
+		}
+		if r.cooldown {
+			rep.cooldowns++
+			return
+		}
+		rep.add(r)
 		if r.success {
-			s = append(s, r.elapsed)
+			atomic.AddInt64(req.successes, 1)
 		} else {
-			f = append(f, r.elapsed)
-			errors[r.status]++
+			atomic.AddInt64(req.failures, 1)
+		}
+		rep.slowest.add(r)
+		rep.jitter.add(r)
+		rep.timeline.add(r, measured)
+		if r.sni != "" {
+			addTo(rep.sni, r.sni, r)
+		}
+		if len(args.Port) > 1 && r.port != 0 {
+			addTo(rep.ports, strconv.Itoa(r.port), r)
+		}
+		if len(args.hosts()) > 1 {
+			addTo(rep.hosts, r.host, r)
 		}
+		if r.family != "" {
+			addTo(rep.families, r.family, r)
+		}
+		if r.script != "" {
+			addTo(rep.scripts, r.script, r)
+		}
+		if r.code != "" {
+			addTo(rep.codes, r.code, r)
+		}
+		if r.group != "" {
+			addTo(rep.groups, r.group, r)
+		}
+		if r.setup != "" {
+			sec := int(r.time.Sub(start) / time.Second)
+			if rep.setupTimeline[sec] == nil {
+				rep.setupTimeline[sec] = make(map[string]int)
+			}
+			rep.setupTimeline[sec][r.setup]++
+		}
+	}
+	// with --cooldown, results are held back until it's clear they didn't
+	// finish in the last stretch of the run, which isn't known until it ends
+	var held []result
+	receive := func(r result) {
+		r.warmup = r.time.Add(r.elapsed).Before(measured) || r.iteration > 0 && r.iteration <= args.Warmup
+		if args.Cooldown <= 0 {
+			collect(r)
+			return
+		}
+		held = append(held, r)
+		cut := time.Now().Add(-args.Cooldown)
+		n := 0
+		for ; n < len(held) && held[n].time.Add(held[n].elapsed).Before(cut); n++ {
+			collect(held[n])
+		}
+		held = held[n:]
+	}
+	var prog *progress
+	var tick <-chan time.Time
+	if args.ReportEvery > 0 {
+		prog = newProgress(start, req.drain)
+		t := time.NewTicker(args.ReportEvery)
+		defer t.Stop()
+		tick = t.C
+	}
+	for done := false; !done; {
+		select {
+		case r, ok := <-resultc:
+			if !ok {
+				done = true
+				break
+			}
+			prog.add(r)
+			receive(r)
+		case now := <-tick:
+			prog.report(now)
+		}
+	}
+	end := time.Now()
+	for _, r := range held {
+		r.cooldown = !r.warmup && !r.time.Add(r.elapsed).Before(end.Add(-args.Cooldown))
+		collect(r)
+	}
+	// a worker gives up on the rest of its commands if it can't get a
+	// connection, so they can fall short
+	if expected > 0 {
+		rep.skipped = expected - int64(rep.ns+rep.nf+rep.warmups+rep.cooldowns)
+	}
+	// rates are over the measured part of the run
+	rep.started, rep.elapsed, rep.wall = measured, end.Sub(measured)-args.Cooldown, end.Sub(start)
+	if rep.elapsed < 0 {
+		rep.elapsed = 0
+	}
+	rep.certExpiring = req.server.expiring
+	rep.closed = *req.closed
+	rep.bytes = *req.bytes
+	rep.resumed = *req.resumed
+	rep.tcp = req.tcp
+	rep.curves = req.curves
+	rep.negotiated = req.negotiated
+	rep.rates = rates
+	rep.idle = req.idle
+	rep.cleanup = req.cleanup
+	rep.keepalive = req.keepalive
+	rep.drain = req.drain
+	close(stopHeartbeat)
+	if hb != nil {
+		rep.heartbeat = <-hb
 	}
-	elapsed := time.Since(start)
 
-	var error_report string
-	for e, i := range errors {
-		error_report += fmt.Sprintf("%d\t%s\n", i, e)
+	return rep
+}
+
+// timeUp says whether the --duration is over
+func timeUp(r request) bool {
+	return !r.deadline.IsZero() && !time.Now().Before(r.deadline)
+}
+
+// tooManyErrors says whether more commands have failed than --max-errors
+// allows, so the run should stop
+func tooManyErrors(r request) bool {
+	return r.args.MaxErrors > 0 && atomic.LoadInt64(r.failures) > r.args.MaxErrors
+}
+
+// dispatch drives the open model: on every tick it hands a command to an idle
+// connection, adding a new one whenever none are free, until expected commands
+// have been scheduled. --threads connections are opened up front.
+func dispatch(req request, ticks <-chan time.Time, expected int64, wg *sync.WaitGroup, resultc chan<- result) {
+	jobs := make(chan time.Time)
+	exited := make(chan struct{}, 1)
+	req.jobs = jobs
+
+	spawned := 0
+	spawn := func() {
+		spawned++
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			work(w, req, resultc)
+			select {
+			case exited <- struct{}{}:
+			default:
+			}
+		}(spawned)
+	}
+	for i := 0; i < req.args.Threads; i++ {
+		spawn()
 	}
 
-	fmt.Printf("\n===========\n"+
-		"Total elapsed time: %s\n"+
-		"Average req/s: %.2f\n"+
-		"Threads: %d, Commands/thread: %d, SUCCESS/FAIL: %d/%d\n"+
-		"SUCCESS: avg: %s, max: %s, min: %s, 99pct: %s, 95pct: %s\n"+
-		"FAIL: avg: %s, max: %s, min: %s, 99pct: %s, 95pct: %s\n"+
-		"Errors:\n%s",
-		elapsed,
-		float64(args.Iterations*args.Threads)/elapsed.Seconds(),
-		args.Threads, args.Iterations, len(s), len(f),
-		s.dstat(stats.Mean), s.dstat(stats.Max), s.dstat(stats.Min), s.dpct(stats.Percentile, 99), s.dpct(stats.Percentile, 95),
-		f.dstat(stats.Mean), f.dstat(stats.Max), f.dstat(stats.Min), f.dpct(stats.Percentile, 99), f.dpct(stats.Percentile, 95),
-		error_report,
-	)
+	// with --duration and no other limit, until the time is up
+	var over <-chan time.Time
+	if !req.deadline.IsZero() {
+		timer := time.NewTimer(time.Until(req.deadline))
+		defer timer.Stop()
+		over = timer.C
+	}
+	for n := int64(0); expected == 0 || n < expected; n++ {
+		var t time.Time
+		select {
+		case t = <-ticks:
+		case <-req.stopping:
+			close(jobs)
+			return
+		case <-over:
+			close(jobs)
+			return
+		}
+		if tooManyErrors(req) {
+			close(jobs)
+			return
+		}
+		select {
+		case jobs <- t:
+			continue
+		default:
+		}
 
+		// nothing idle, so open another connection. If it can't be set up
+		// its failure result stands in for this command.
+		select {
+		case <-exited:
+		default:
+		}
+		spawn()
+		select {
+		case jobs <- t:
+		case <-exited:
+		}
+	}
+	close(jobs)
 }
 
-func (d durations) dstat(f func(stats.Float64Data) (float64, error)) time.Duration {
-	dfloat := make([]float64, len(d))
-	for i, v := range d {
-		dfloat[i] = float64(v)
+// findMaxQps probes increasing rates until one misses the p99 target, then
+// bisects between the last good and first bad rate
+func findMaxQps(base request, sinks ...sink) float64 {
+	args := base.args
+	probe := func(rate float64) bool {
+		base.args.Rate = rate
+		rep := run(base, sinks...)
+		p99 := rep.s.Percentile(percentile, 99)
+		achieved := rep.rps()
+		// a rate we couldn't actually drive doesn't count as sustained
+		ok := rep.ns > 0 && rep.nf == 0 && p99 <= args.TargetP99 && achieved >= rate*0.95
+		log.Printf("probe rate: %.2f, achieved: %.2f, p99: %s, SUCCESS/FAIL: %d/%d, ok: %t",
+			rate, achieved, fmtd(p99), rep.ns, rep.nf, ok)
+		return ok
 	}
 
-	s, err := f(dfloat)
-	if err != nil {
-		return 0
-	} else {
-		return time.Duration(s)
+	good, bad := 0.0, 0.0
+	rate := args.Rate
+	if rate <= 0 {
+		rate = 10
+	}
+	for bad == 0 {
+		if probe(rate) {
+			good = rate
+			rate *= 2
+		} else {
+			bad = rate
+		}
+	}
+	// stop once the window is within 5% of the highest rate tried
+	for i := 0; i < 20 && bad-good > bad*0.05; i++ {
+		rate = (good + bad) / 2
+		if probe(rate) {
+			good = rate
+		} else {
+			bad = rate
+		}
 	}
+
+	fmt.Printf("\n===========\n"+
+		"Target p99: %s\n"+
+		"Threads: %d, Commands/thread: %d\n"+
+		"Max sustainable req/s: %.2f\n",
+		args.TargetP99, args.Threads, args.Iterations, good,
+	)
+	return good
 }
 
-func (d durations) dpct(f func(stats.Float64Data, float64) (float64, error), p float64) time.Duration {
-	dfloat := make([]float64, len(d))
-	for i, v := range d {
-		dfloat[i] = float64(v)
+// expandEnv replaces ${VAR} and $VAR in a command with values from the
+// environment, and ${service} with --service. Unset variables expand to
+// nothing, or are an error with --strict-env.
+func expandEnv(text string, args Args) (string, error) {
+	var missing []string
+	expanded := os.Expand(text, func(name string) string {
+		if name == "service" && args.Service != "" {
+			return args.Service
+		}
+		v, ok := os.LookupEnv(name)
+		if !ok {
+			missing = append(missing, name)
+		}
+		return v
+	})
+	if args.StrictEnv && len(missing) > 0 {
+		return "", fmt.Errorf("command %q references unset environment variables: %s", text, strings.Join(missing, ", "))
 	}
+	return expanded, nil
+}
 
-	s, err := f(dfloat, p)
-	if err != nil {
-		return 0
-	} else {
-		return time.Duration(s)
+// parseExpect parses the --expect response codes by verb
+func parseExpect(args Args) (map[string]map[string]bool, error) {
+	expect := make(map[string]map[string]bool)
+	for _, e := range args.Expect {
+		verb, codes, ok := strings.Cut(e, "=")
+		if !ok || verb == "" || codes == "" {
+			return nil, fmt.Errorf("invalid --expect %q, want COMMAND=code[,code...]", e)
+		}
+		set := make(map[string]bool)
+		for _, c := range strings.Split(codes, ",") {
+			set[strings.TrimSpace(c)] = true
+		}
+		expect[strings.ToUpper(verb)] = set
 	}
+	return expect, nil
 }
 
-func worker(w int, requestc <-chan request, resultc chan<- result) {
-	for r := range requestc {
-		success := false
-		status := "SUCCESS"
+// parseCommands builds the command sequence from --command/--sequence, and
+// the --preamble command if any, and attaches the expected response codes
+// given with --expect
+func parseCommands(args Args) ([]command, *command, error) {
+	expect, err := parseExpect(args)
+	if err != nil {
+		return nil, nil, err
+	}
 
-		start := time.Now()
+	texts := args.Sequence
+	if len(texts) == 0 {
+		texts = []string{args.Command}
+	}
+	if args.MeasureSkew {
+		texts = []string{"TIME"}
+	}
 
-		// connect
-		conn, err := net.Dial("tcp", fmt.Sprintf("%s:%d", r.args.Hostname, r.args.Port))
+	var commands []*command
+	if args.Script != "" {
+		if commands, err = loadScript(args.Script, args, expect); err != nil {
+			return nil, nil, err
+		}
+	} else if args.ScenarioCSV != "" {
+		if commands, err = loadScenarioCSV(args.ScenarioCSV, args, expect); err != nil {
+			return nil, nil, err
+		}
+	} else if args.CommandHex != "" || args.CommandB64 != "" {
+		c, err := newRawCommand(args, expect)
 		if err != nil {
-			status = fmt.Sprintf("NOCONN %s", err)
-			success = false
+			return nil, nil, err
+		}
+		commands = append(commands, c)
+	} else {
+		for _, t := range texts {
+			c, err := newCommand(t, args, expect)
+			if err != nil {
+				return nil, nil, err
+			}
+			commands = append(commands, c)
+		}
+	}
+	n := len(commands)
 
-		} else {
-			message, _ := bufio.NewReader(conn).ReadString('\n')
-			if strings.HasPrefix(message, "220 ") {
-				// ask to STARTTLS
-				conn.Write([]byte("STARTTLS 2\r\n"))
-				message, _ = bufio.NewReader(conn).ReadString('\n')
-				if strings.HasPrefix(message, "220 ") {
-					// create new tls Conn and do tls handshake
-					tlsconn := tls.Client(conn, r.tlsconfig)
-					err = tlsconn.Handshake()
-					message, _ = bufio.NewReader(tlsconn).ReadString('\n') // need to read cosignd's response to the starttls
-					if err == nil {
-						for i := 1; i <= r.args.Iterations; i++ {
-							// send command
-							tlsconn.Write([]byte(r.args.Command + "\r\n"))
-							message, _ = bufio.NewReader(tlsconn).ReadString('\n')
-							resp := strings.SplitN(message, " ", 2)
-							switch resp[0] {
-							case "220", "231", "232", "533", "534", "431", "432", "250":
-								status = fmt.Sprintf("SUCCESS %s", message)
-								success = true
-							default:
-								status = fmt.Sprintf("FAILRESPONSE %s", message)
-								success = false
-							}
-							// more commands to follow, so report our result
-							elapsed := time.Since(start)
-							if !r.args.Quiet {
-								log.Printf("[%d:%d] %s %s", w, i, elapsed, status)
-							}
-							resultc <- result{
-								success: success,
-								status:  status,
-								elapsed: elapsed,
-							}
-							start = time.Now()
-						}
-					} else {
-						status = fmt.Sprintf("HANDSHAKE FAIL %s", err)
-						success = false
-					}
-				} else {
-					status = message
-					success = false
+	// branch commands can branch again, so hook them all up by verb once
+	// they've all been parsed
+	branches := make(map[string]map[string][]branch)
+	for _, b := range args.Branch {
+		on, t, ok := strings.Cut(b, "=")
+		verb, code, ok2 := strings.Cut(on, ":")
+		if !ok || !ok2 || verb == "" || code == "" || t == "" {
+			return nil, nil, fmt.Errorf("invalid --branch %q, want VERB:CODE=COMMAND[@WEIGHT]", b)
+		}
+		// a trailing @ that isn't a number is part of the command
+		weight := 1.0
+		if i := strings.LastIndex(t, "@"); i >= 0 {
+			if w, err := strconv.ParseFloat(t[i+1:], 64); err == nil {
+				if w <= 0 {
+					return nil, nil, fmt.Errorf("invalid --branch %q: weight must be positive", b)
 				}
-			} else {
-				status = fmt.Sprintf("BADRESPONSE %s", message)
-				success = false
+				t, weight = t[:i], w
 			}
 		}
+		c, err := newCommand(t, args, expect)
+		if err != nil {
+			return nil, nil, err
+		}
+		commands = append(commands, c)
+		verb = strings.ToUpper(verb)
+		if branches[verb] == nil {
+			branches[verb] = make(map[string][]branch)
+		}
+		branches[verb][code] = append(branches[verb][code], branch{cmd: c, weight: weight})
+	}
+	for _, c := range commands {
+		c.branches = branches[c.verb()]
+	}
+
+	seq := make([]command, n)
+	for i := range seq {
+		seq[i] = *commands[i]
+	}
 
-		conn.Write([]byte("QUIT\r\n"))
-		conn.Close()
+	var preamble *command
+	if args.Preamble != "" {
+		var err error
+		if preamble, err = newCommand(args.Preamble, args, expect); err != nil {
+			return nil, nil, err
+		}
+	}
+	return seq, preamble, nil
+}
 
-		// FIXME: there has to be a more elegant way to handle errors
-		if !success {
-			elapsed := time.Since(start)
-			if !r.args.Quiet {
-				log.Printf("[%d] %s %s", w, elapsed, status)
-			}
+// newCommand parses a single command, using the codes in expect for its verb
+// or defaultExpect
+func newCommand(t string, args Args, expect map[string]map[string]bool) (*command, error) {
+	expanded, err := expandEnv(t, args)
+	if err != nil {
+		return nil, err
+	}
+	if strings.TrimSpace(expanded) == "" {
+		return nil, fmt.Errorf("command %q is empty", t)
+	}
+	t = expanded
+	c := &command{text: t}
+	c.expect = expectFor(c.verb(), args, expect)
+	if strings.Contains(t, "{{") {
+		// catch bad templates now rather than on every request
+		c.tmpl, err = template.New("command").Option("missingkey=error").Parse(t)
+		if err == nil {
+			err = c.tmpl.Execute(io.Discard, commandData{})
+		}
+		if err != nil {
+			return nil, fmt.Errorf("command %q: %s", t, err)
+		}
+	}
+	return c, nil
+}
 
-			resultc <- result{
-				success: success,
-				status:  status,
-				elapsed: elapsed,
+// sendsRequestID says whether any of commands, or the --branch commands
+// they lead to, sends a {{.RequestID}} for the server to echo back
+func sendsRequestID(commands []command) bool {
+	seen := make(map[*command]bool)
+	var sends func(c *command) bool
+	sends = func(c *command) bool {
+		if seen[c] {
+			return false
+		}
+		seen[c] = true
+		if c.tmpl != nil && strings.Contains(c.text, ".RequestID") {
+			return true
+		}
+		for _, bs := range c.branches {
+			for _, b := range bs {
+				if sends(b.cmd) {
+					return true
+				}
 			}
 		}
+		return false
+	}
+	for i := range commands {
+		if sends(&commands[i]) {
+			return true
+		}
+	}
+	return false
+}
+
+// newRawCommand decodes --command-hex or --command-base64 into a command sent
+// exactly as given
+func newRawCommand(args Args, expect map[string]map[string]bool) (*command, error) {
+	var b []byte
+	var err error
+	switch {
+	case len(args.Sequence) > 0:
+		return nil, fmt.Errorf("--command-hex and --command-base64 can't be used with --sequence")
+	case args.CommandHex != "" && args.CommandB64 != "":
+		return nil, fmt.Errorf("only one of --command-hex and --command-base64 can be given")
+	case args.CommandHex != "":
+		b, err = hex.DecodeString(args.CommandHex)
+	default:
+		b, err = base64.StdEncoding.DecodeString(args.CommandB64)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("decoding raw command: %s", err)
+	}
+	if strings.TrimSpace(string(b)) == "" {
+		return nil, fmt.Errorf("raw command is empty")
+	}
+	c := &command{text: string(b), raw: true}
+	c.expect = expectFor(c.verb(), args, expect)
+	return c, nil
+}
+
+// expectFor returns the --expect codes for verb, or defaultExpect
+func expectFor(verb string, args Args, expect map[string]map[string]bool) map[string]bool {
+	if set, ok := expect[verb]; ok {
+		return set
+	}
+	if args.StrictCodes {
+		return protocolExpect(verb)
+	}
+	set := make(map[string]bool)
+	for _, code := range defaultExpect {
+		set[code] = true
+	}
+	return set
+}
+
+// verb is the upper-cased first word of the command, "" if it has none
+func (c command) verb() string {
+	fields := strings.Fields(c.text)
+	if len(fields) == 0 {
+		return ""
 	}
+	return strings.ToUpper(fields[0])
 }
@@ -0,0 +1,56 @@
+package cosignperf
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseCommands(t *testing.T) {
+	tests := []struct {
+		name  string
+		set   func(*Args)
+		verbs []string
+		err   string // start of the error, if it should fail
+	}{
+		{"default", func(a *Args) {}, []string{"NOOP"}, ""},
+		{"sequence", func(a *Args) { a.Sequence = []string{"noop", "CHECK cosign=x"} }, []string{"NOOP", "CHECK"}, ""},
+		{"empty command", func(a *Args) { a.Command = "" }, nil, "command \"\" is empty"},
+		{"whitespace command", func(a *Args) { a.Command = " \t" }, nil, "command \" \\t\" is empty"},
+		{"empty in sequence", func(a *Args) { a.Sequence = []string{"NOOP", ""} }, nil, "command \"\" is empty"},
+		{"expands to nothing", func(a *Args) { a.Command = "$COSIGNPERF_TEST_UNSET" }, nil, "command \"$COSIGNPERF_TEST_UNSET\" is empty"},
+		{"empty preamble", func(a *Args) { a.Preamble = " " }, nil, "command \" \" is empty"},
+		{"space in hex", func(a *Args) { a.CommandHex = "20" }, nil, "raw command is empty"},
+		{"hex", func(a *Args) { a.CommandHex = "4e4f4f500d0a" }, []string{"NOOP"}, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			args := defaultArgs()
+			tt.set(&args)
+			commands, _, err := parseCommands(args)
+			if tt.err != "" {
+				if err == nil || !strings.HasPrefix(err.Error(), tt.err) {
+					t.Fatalf("got error %v, want %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			var verbs []string
+			for _, c := range commands {
+				verbs = append(verbs, c.verb())
+			}
+			if strings.Join(verbs, " ") != strings.Join(tt.verbs, " ") {
+				t.Errorf("got verbs %q, want %q", verbs, tt.verbs)
+			}
+		})
+	}
+}
+
+func TestVerb(t *testing.T) {
+	for text, want := range map[string]string{"check cosign=x": "CHECK", "  NOOP\r\n": "NOOP", "": "", " \r\n": ""} {
+		if got := (command{text: text}).verb(); got != want {
+			t.Errorf("verb of %q = %q, want %q", text, got, want)
+		}
+	}
+}
@@ -0,0 +1,67 @@
+package cosignperf
+
+import (
+	"crypto/tls"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+var curveNames = map[string]tls.CurveID{
+	"X25519":         tls.X25519,
+	"P256":           tls.CurveP256,
+	"P384":           tls.CurveP384,
+	"P521":           tls.CurveP521,
+	"X25519MLKEM768": tls.X25519MLKEM768,
+}
+
+// parseCurves parses a --curves list like X25519,P-256 into the order of
+// preference for the key exchange
+func parseCurves(list string) ([]tls.CurveID, error) {
+	var curves []tls.CurveID
+	for _, f := range strings.Split(list, ",") {
+		name := strings.ToUpper(strings.NewReplacer("-", "", "_", "").Replace(strings.TrimSpace(f)))
+		id, ok := curveNames[strings.TrimPrefix(name, "CURVE")]
+		if !ok {
+			return nil, fmt.Errorf("unknown curve %q in --curves, want X25519, P-256, P-384, P-521 or X25519MLKEM768", f)
+		}
+		curves = append(curves, id)
+	}
+	return curves, nil
+}
+
+// curveStats counts the key exchange each handshake negotiated, with
+// --curves, since the server has the last word on which is used
+type curveStats struct {
+	mu sync.Mutex
+	n  map[tls.CurveID]int
+}
+
+func (c *curveStats) add(cs tls.ConnectionState) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.n[cs.CurveID]++
+}
+
+// String lists the curves by how many handshakes used each, most first
+func (c *curveStats) String() string {
+	var ids []tls.CurveID
+	for id := range c.n {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return c.n[ids[i]] > c.n[ids[j]] })
+	var parts []string
+	for _, id := range ids {
+		name := id.String()
+		if id == 0 {
+			// a TLS 1.2 resumption, say, has no key exchange of its own
+			name = "none"
+		}
+		parts = append(parts, fmt.Sprintf("%s: %d", name, c.n[id]))
+	}
+	if len(parts) == 0 {
+		return "no handshakes"
+	}
+	return strings.Join(parts, ", ")
+}
@@ -0,0 +1,77 @@
+package cosignperf
+
+import (
+	"bufio"
+	"crypto/tls"
+	"fmt"
+	"github.com/cobaugh/cosignperf/pkg/cosign"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// diagnose walks through connecting to the server one step at a time and
+// prints how far it got, to explain a run where nothing succeeded
+func diagnose(args Args, tlsconfig *tls.Config) {
+	fmt.Printf("Diagnostics (no commands succeeded):\n")
+	for _, h := range args.hosts() {
+		host, port := splitHost(h, args.Port[0])
+		if host != tlsconfig.ServerName && len(args.SNI) == 0 {
+			tlsconfig = tlsconfig.Clone()
+			tlsconfig.ServerName = host
+		}
+		diagnoseHost(args, host, port, tlsconfig)
+	}
+}
+
+func diagnoseHost(args Args, host string, port int, tlsconfig *tls.Config) {
+	const timeout = 5 * time.Second
+	addrs, err := net.LookupHost(host)
+	if err != nil {
+		fmt.Printf("  DNS: %s failed to resolve: %s\n", host, err)
+		return
+	}
+	fmt.Printf("  DNS: %s resolved to %s\n", host, strings.Join(addrs, ", "))
+
+	addr := net.JoinHostPort(host, strconv.Itoa(port))
+	conn, err := dial(addr, timeout)
+	if err != nil {
+		fmt.Printf("  TCP: connect to %s failed: %s\n", addr, err)
+		return
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(timeout))
+	fmt.Printf("  TCP: connected to %s\n", conn.RemoteAddr())
+
+	rd := bufio.NewReader(conn)
+	message, err := cosign.ReadLine(rd, args.MaxLine)
+	if code, _ := cosign.SplitStatus(message); code != "220" {
+		fmt.Printf("  greeting: expected 220, got %q (%v)\n", strings.TrimSpace(message), err)
+		return
+	}
+	conn.Write([]byte("STARTTLS 2\r\n"))
+	message, err = cosign.ReadLine(rd, args.MaxLine)
+	for line := message; err == nil && cosign.Continued(line); message += line {
+		line, err = cosign.ReadLine(rd, args.MaxLine)
+	}
+	if !starttlsOK(args, message) {
+		want := "220"
+		if len(args.STARTTLSOK) > 0 {
+			want = strings.Join(args.STARTTLSOK, " or ")
+		}
+		fmt.Printf("  STARTTLS: expected %s, got %q (%v)\n", want, strings.TrimSpace(message), err)
+		return
+	}
+	fmt.Printf("  STARTTLS: accepted\n")
+
+	tlsconn := tls.Client(conn, tlsconfig)
+	if err := tlsconn.Handshake(); err != nil {
+		fmt.Printf("  TLS: handshake failed (%s): %s\n", handshakeFailure(err), err)
+		return
+	}
+	cs := tlsconn.ConnectionState()
+	fmt.Printf("  TLS: handshake ok, %s %s\n", tls.VersionName(cs.Version), tls.CipherSuiteName(cs.CipherSuite))
+	tlsconn.Write([]byte("QUIT\r\n"))
+	fmt.Printf("  connection setup works, so the failures are in the commands themselves\n")
+}
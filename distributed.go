@@ -0,0 +1,583 @@
+package cosignperf
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// The --coordinator/--agent protocol is JSON lines over TCP. The agent
+// greets with an agentHello, and the coordinator answers with one agentRun,
+// signed with the --agent-secret-file secret over the hello's nonce and the
+// options. The agent does the run with those options and sends back its
+// --raw-output records as they come in, then an agentEnd once the run is
+// over. The coordinator closing its side interrupts the run the way ^C
+// would. Nothing is encrypted.
+type agentHello struct {
+	Nonce string `json:"nonce"`
+}
+
+type agentRun struct {
+	Args []string `json:"args"`
+	MAC  string   `json:"mac"`
+}
+
+// agentEnd is the last line from an agent, after its records
+type agentEnd struct {
+	Done *agentDone `json:"agent_done"`
+}
+
+type agentDone struct {
+	Exit  int    `json:"exit_code"`
+	Error string `json:"error,omitempty"`
+}
+
+// agentOptions are the options an agent takes from a coordinator: what to
+// run against and how much load to make, but nothing that reads or writes
+// files, sends anything anywhere but the servers under test or runs a
+// command. The agent brings its own certs.
+var agentOptions = map[string]bool{
+	"-H": true, "--hostname": true, "--host-strategy": true, "--host-weights": true, "-P": true, "--port": true,
+	"-C": true, "--command": true, "--command-hex": true, "--command-base64": true, "--sequence": true,
+	"--service": true, "--preamble": true, "--heartbeat-command": true, "--heartbeat-interval": true, "--tag": true,
+	"-t": true, "--threads": true, "-i": true, "--iterations": true, "-d": true, "--duration": true,
+	"--total-requests": true, "--target-successes": true, "--byte-budget": true, "--max-errors": true, "--max-fail-rate": true,
+	"-r": true, "--rate": true, "--rate-burst": true, "--rate-distribution": true, "--model": true, "--profile": true,
+	"--burst-size": true, "--burst-gap": true, "--pipeline": true, "--check-order": true, "--multiplex": true,
+	"--commands-per-connection": true, "--reconnect-every": true, "--conn-mode": true, "--latency-window": true,
+	"--stagger-commands": true, "--syn-spread": true, "--slow-start": true, "--reconnect-jitter": true,
+	"--think-time": true, "--think-jitter": true, "--warmup": true, "--warmup-duration": true, "--cooldown": true,
+	"--sample-size": true, "--unbuffered-results": true, "--prewarm": true, "--event-loop": true,
+	"--sslskipverify": true, "--sni": true, "--require-tls-version": true, "--tls-min-version": true, "--tls-max-version": true,
+	"--ciphers": true, "--curves": true, "--session-resumption": true, "--renegotiation": true, "--dual-stack": true,
+	"--connect-timeout": true, "--greeting-timeout": true, "--handshake-timeout": true, "--read-timeout": true,
+	"--write-timeout": true, "--command-timeout": true, "--retries": true, "--retry-backoff": true, "--max-line": true,
+	"--drain-timeout": true, "--expect": true, "--expect-response": true, "--strict-codes": true,
+	"--expect-principal": true, "--expect-factor": true, "--starttls-ok-codes": true, "--branch": true,
+	"--backoff-codes": true, "--backoff-initial": true, "--backoff-max": true, "--quit-policy": true, "--close-mode": true,
+	"--idle-before-quit": true, "--cleanup-command": true, "--keepalive-command": true, "--keepalive-interval": true,
+	"-q": true, "--quiet": true, "-v": true, "--verbose": true,
+}
+
+// checkAgentArgs returns an error for the first option in sent that isn't
+// one of the agentOptions. Anything not starting with - is taken to be an
+// option's value.
+func checkAgentArgs(sent []string) error {
+	for _, a := range sent {
+		if !strings.HasPrefix(a, "-") {
+			continue
+		}
+		name, _, _ := strings.Cut(a, "=")
+		if !agentOptions[name] {
+			return fmt.Errorf("%s can't be sent to an agent, only options about the load and the servers under test can (give certs to the agent itself)", name)
+		}
+	}
+	return nil
+}
+
+// readSecret reads the --agent-secret-file secret
+func readSecret(path string) ([]byte, error) {
+	if path == "" {
+		return nil, fmt.Errorf("--agent and --coordinator need --agent-secret-file")
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("--agent-secret-file: %s", err)
+	}
+	secret := bytes.TrimSpace(b)
+	if len(secret) < 16 {
+		return nil, fmt.Errorf("--agent-secret-file: the secret in %s is shorter than 16 bytes", path)
+	}
+	return secret, nil
+}
+
+// runMAC signs the options of a run for the hello with nonce
+func runMAC(secret []byte, nonce string, args []string) string {
+	m := hmac.New(sha256.New, secret)
+	m.Write([]byte(nonce))
+	for _, a := range args {
+		m.Write([]byte{0})
+		m.Write([]byte(a))
+	}
+	return hex.EncodeToString(m.Sum(nil))
+}
+
+// agentListen is --agent's address, on the loopback interface if it has no
+// host, since anything that can reach the agent can use it to make load
+func agentListen(addr string) (string, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", fmt.Errorf("--agent: %s", err)
+	}
+	if host == "" {
+		host = "127.0.0.1"
+	}
+	return net.JoinHostPort(host, port), nil
+}
+
+// agentServer listens on --agent for --coordinator runs and does them one
+// at a time, each as a cosignperf of its own with the options it was sent
+// and the agent's own certs. It only returns on error.
+func agentServer(args Args) error {
+	secret, err := readSecret(args.AgentSecret)
+	if err != nil {
+		return err
+	}
+	self, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	addr, err := agentListen(args.Agent)
+	if err != nil {
+		return err
+	}
+	// the certs are the agent's, not the coordinator's to pick
+	var own []string
+	for _, o := range []struct{ name, value string }{
+		{"--keyfile", args.KeyFile}, {"--certfile", args.CertFile}, {"--cert-dir", args.CertDir},
+		{"--cert-weights", args.CertWeights}, {"--ca-file", args.CAFile},
+	} {
+		if o.value != "" {
+			own = append(own, o.name, o.value)
+		}
+	}
+	if args.CertPerWorker {
+		own = append(own, "--cert-per-worker")
+	}
+	if args.CertReuse {
+		own = append(own, "--allow-cert-reuse")
+	}
+
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	log.Printf("agent listening on %s\n", l.Addr())
+	if ip := l.Addr().(*net.TCPAddr).IP; !ip.IsLoopback() {
+		log.Printf("warning: the agent can be reached from other hosts, keep --agent-secret-file secret\n")
+	}
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		agentConn(self, secret, own, conn)
+	}
+}
+
+func agentConn(self string, secret []byte, own []string, conn net.Conn) {
+	defer conn.Close()
+	rd := bufio.NewReader(conn)
+	enc := json.NewEncoder(conn)
+	done := func(exit int, err string) {
+		if exit != 0 {
+			log.Printf("agent: run for %s failed: %s\n", conn.RemoteAddr(), err)
+		}
+		enc.Encode(agentEnd{Done: &agentDone{Exit: exit, Error: err}})
+	}
+
+	var nonce [16]byte
+	if _, err := rand.Read(nonce[:]); err != nil {
+		done(1, err.Error())
+		return
+	}
+	hello := agentHello{Nonce: hex.EncodeToString(nonce[:])}
+	if err := enc.Encode(hello); err != nil {
+		return
+	}
+	// a coordinator has a moment to say what to run, so a connection left
+	// open doesn't hold the agent up
+	conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	var run agentRun
+	line, err := rd.ReadBytes('\n')
+	if err == nil {
+		err = json.Unmarshal(line, &run)
+	}
+	conn.SetReadDeadline(time.Time{})
+	if err != nil {
+		done(2, fmt.Sprintf("bad run from the coordinator: %s", err))
+		return
+	}
+	if !hmac.Equal([]byte(run.MAC), []byte(runMAC(secret, hello.Nonce, run.Args))) {
+		done(2, "run not signed with the agent's --agent-secret-file secret")
+		return
+	}
+	if err := checkAgentArgs(run.Args); err != nil {
+		done(2, err.Error())
+		return
+	}
+	log.Printf("agent: run for %s: %s\n", conn.RemoteAddr(), strings.Join(run.Args, " "))
+
+	// the run's results come back on fd 3, its output goes to our stderr
+	// with the last line kept to say why if it fails
+	pr, pw, err := os.Pipe()
+	if err != nil {
+		done(1, err.Error())
+		return
+	}
+	out := &lastLine{}
+	cmd := exec.Command(self, append(append(own, run.Args...), "--raw-output", "/dev/fd/3")...)
+	cmd.Stdout, cmd.Stderr = io.MultiWriter(os.Stderr, out), io.MultiWriter(os.Stderr, out)
+	cmd.ExtraFiles = []*os.File{pw}
+	err = cmd.Start()
+	pw.Close()
+	if err != nil {
+		pr.Close()
+		done(1, err.Error())
+		return
+	}
+
+	// the coordinator hanging up, or being interrupted, stops the run
+	go func() {
+		io.Copy(io.Discard, rd)
+		cmd.Process.Signal(os.Interrupt)
+	}()
+
+	sc := bufio.NewScanner(pr)
+	sc.Buffer(make([]byte, 64*1024), 1<<20)
+	for sc.Scan() {
+		if _, err := conn.Write(append(sc.Bytes(), '\n')); err != nil {
+			cmd.Process.Signal(os.Interrupt)
+			break
+		}
+	}
+	io.Copy(io.Discard, pr)
+	pr.Close()
+
+	var exit *exec.ExitError
+	if err := cmd.Wait(); errors.As(err, &exit) {
+		done(exit.ExitCode(), out.String())
+	} else if err != nil {
+		done(1, err.Error())
+	} else {
+		done(0, "")
+	}
+}
+
+// lastLine keeps the last non-empty line written to it
+type lastLine struct {
+	mu   sync.Mutex
+	line string
+	part string
+}
+
+func (l *lastLine) Write(b []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	lines := strings.Split(l.part+string(b), "\n")
+	l.part = lines[len(lines)-1]
+	for _, s := range lines[:len(lines)-1] {
+		if s = strings.TrimSpace(s); s != "" {
+			l.line = s
+		}
+	}
+	return len(b), nil
+}
+
+func (l *lastLine) String() string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if s := strings.TrimSpace(l.part); s != "" {
+		return s
+	}
+	return l.line
+}
+
+// coordinatorOnly are the options the coordinator uses itself rather than
+// sending to the agents, all of which take a value
+var coordinatorOnly = map[string]bool{"--coordinator": true, "--agent-secret-file": true, "--output-format": true}
+
+// coordinatorArgs are the command line options without the coordinatorOnly
+// ones, to send to the agents
+func coordinatorArgs(argv []string) []string {
+	var sent []string
+	for i := 0; i < len(argv); i++ {
+		name, _, value := strings.Cut(argv[i], "=")
+		switch {
+		case !coordinatorOnly[name]:
+			sent = append(sent, argv[i])
+		case !value:
+			i++
+		}
+	}
+	return sent
+}
+
+// agentResult is a result from one of the agents
+type agentResult struct {
+	agent string
+	r     result
+}
+
+// coordinate sends the run in sent to each of the --coordinator agents at
+// once, merges the results they send back into one report and prints its
+// summary, returning the reason the run failed if it did. Each agent's
+// threads are numbered after the ones before so they stay apart.
+func coordinate(args Args, sent []string) string {
+	agents := strings.Split(args.Coordinator, ",")
+	if args.RawOutput != "" || args.RotateSize > 0 || args.RotateEvery > 0 || args.Agent != "" || args.OnComplete != "" {
+		log.Fatalf("--coordinator can't be used with --raw-output, --rotate-size, --rotate-interval, --agent or --on-complete, the agents use --raw-output to send their results back\n")
+	}
+	if args.SweepThreads != "" || args.TLSCompare || args.FindMaxQps || args.Interval > 0 {
+		log.Fatalf("--coordinator merges a single run so can't be used with --sweep-threads, --tls-compare, --find-max-qps or --interval\n")
+	}
+	secret, err := readSecret(args.AgentSecret)
+	if err != nil {
+		log.Fatalf("%s\n", err)
+	}
+	// the agents would turn these down anyway, but better to say so now
+	// than once per agent
+	if err := checkAgentArgs(sent); err != nil {
+		log.Fatalf("--coordinator: %s\n", err)
+	}
+	structured = args.OutputFormat == "json" || args.OutputFormat == "csv"
+
+	var conns []*net.TCPConn
+	for _, a := range agents {
+		conn, err := net.DialTimeout("tcp", a, args.ConnectTO)
+		if err != nil {
+			log.Fatalf("--coordinator: %s\n", err)
+		}
+		conns = append(conns, conn.(*net.TCPConn))
+	}
+
+	// ^C stops the agents' runs, but their results still come back
+	var interrupted bool
+	var mu sync.Mutex
+	sigc := make(chan os.Signal, 1)
+	signal.Notify(sigc, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-sigc
+		mu.Lock()
+		interrupted = true
+		mu.Unlock()
+		log.Printf("interrupted, stopping the agents' runs\n")
+		for _, c := range conns {
+			c.CloseWrite()
+		}
+	}()
+
+	resultc := make(chan agentResult, 1024)
+	failed := make([]string, len(agents))
+	var wg sync.WaitGroup
+	for i, conn := range conns {
+		wg.Add(1)
+		go func(i int, conn *net.TCPConn) {
+			defer wg.Done()
+			defer conn.Close()
+			sc := bufio.NewScanner(conn)
+			sc.Buffer(make([]byte, 64*1024), 1<<20)
+			var hello agentHello
+			if !sc.Scan() {
+				failed[i] = fmt.Sprintf("no hello from the agent: %v", sc.Err())
+				return
+			}
+			if err := json.Unmarshal(sc.Bytes(), &hello); err != nil || hello.Nonce == "" {
+				failed[i] = fmt.Sprintf("bad hello from the agent: %q", sc.Text())
+				return
+			}
+			b, _ := json.Marshal(agentRun{Args: sent, MAC: runMAC(secret, hello.Nonce, sent)})
+			if _, err := conn.Write(append(b, '\n')); err != nil {
+				failed[i] = err.Error()
+				return
+			}
+			failed[i] = readAgent(agents[i], i*args.Threads, sc, resultc)
+		}(i, conn)
+	}
+	go func() {
+		wg.Wait()
+		close(resultc)
+	}()
+
+	rep := newReport()
+	byAgent := make(map[string]*report)
+	var first, last time.Time
+	for ar := range resultc {
+		r := ar.r
+		rep.workers[r.worker]++
+		if r.warmup {
+			rep.warmups++
+			continue
+		}
+		if r.cooldown {
+			rep.cooldowns++
+			continue
+		}
+		rep.add(r)
+		addTo(byAgent, ar.agent, r)
+		if len(args.Port) > 1 && r.port != 0 {
+			addTo(rep.ports, strconv.Itoa(r.port), r)
+		}
+		if len(args.hosts()) > 1 {
+			addTo(rep.hosts, r.host, r)
+		}
+		if r.family != "" {
+			addTo(rep.families, r.family, r)
+		}
+		if first.IsZero() || r.time.Before(first) {
+			first = r.time
+		}
+		if end := r.time.Add(r.elapsed); end.After(last) {
+			last = end
+		}
+	}
+	rep.started, rep.elapsed = first, last.Sub(first)
+
+	var reason string
+	for i, f := range failed {
+		if f != "" {
+			log.Printf("agent %s: %s\n", agents[i], f)
+			reason = "agent_failed"
+		}
+	}
+	if rep.ns == 0 {
+		reason = "no_successes"
+	} else if reason == "" && float64(rep.nf)/float64(rep.ns+rep.nf) > args.MaxFailRate {
+		reason = "fail_rate_exceeded"
+	}
+
+	sum := summarize(rep)
+	mu.Lock()
+	sum.partial = interrupted
+	mu.Unlock()
+	// the summary counts every agent's threads
+	args.Threads *= len(agents)
+	switch args.OutputFormat {
+	case "json":
+		err = printJSONSummary(args, sum, newRunID(), reason)
+	case "csv":
+		err = printCSVSummary(args, sum, newRunID(), reason)
+	default:
+		printCoordinated(args, agents, rep, byAgent, sum)
+	}
+	if err != nil {
+		log.Printf("%s\n", err)
+	}
+	return reason
+}
+
+// readAgent reads an agent's results into resultc, with its workers
+// numbered from offset, returning why it failed or "" if it didn't
+func readAgent(agent string, offset int, sc *bufio.Scanner, resultc chan<- agentResult) string {
+	for sc.Scan() {
+		var end agentEnd
+		if err := json.Unmarshal(sc.Bytes(), &end); err != nil {
+			return fmt.Sprintf("bad line from the agent: %s", err)
+		}
+		if d := end.Done; d != nil {
+			if d.Exit != 0 {
+				return fmt.Sprintf("run exited %d: %s", d.Exit, d.Error)
+			}
+			return ""
+		}
+		var l rawRecord
+		if err := json.Unmarshal(sc.Bytes(), &l); err != nil {
+			return fmt.Sprintf("bad record from the agent: %s", err)
+		}
+		var p phases
+		if ph := l.Phases; ph != nil {
+			p = phases{time.Duration(ph.Connect), time.Duration(ph.Starttls), time.Duration(ph.Greeting),
+				time.Duration(ph.Handshake), time.Duration(ph.Preamble), time.Duration(ph.Command)}
+		}
+		resultc <- agentResult{agent, result{
+			success:   l.Success,
+			status:    l.Status,
+			code:      l.Code,
+			message:   l.Message,
+			size:      l.Size,
+			elapsed:   time.Duration(l.ElapsedNs),
+			sni:       l.SNI,
+			requestID: l.RequestID,
+			warmup:    l.Warmup,
+			cooldown:  l.Cooldown,
+			retries:   l.Retries,
+			worker:    offset + l.Worker,
+			iteration: l.Iteration,
+			time:      l.Time,
+			host:      l.Host,
+			port:      l.Port,
+			family:    l.Family,
+			setup:     l.Setup,
+			phases:    p,
+		}}
+	}
+	if err := sc.Err(); err != nil {
+		return err.Error()
+	}
+	return "connection closed before the run was over"
+}
+
+// printCoordinated prints the text summary of a --coordinator run, with a
+// line for each agent
+func printCoordinated(args Args, agents []string, rep *report, byAgent map[string]*report, sum summary) {
+	var errorReport string
+	for _, e := range sortErrors(rep.errors, args.SortErrors) {
+		errorReport += fmt.Sprintf("%d\t%s\n", rep.errors[e], e)
+	}
+	var partial string
+	if sum.partial {
+		partial = "PARTIAL: interrupted, only the results in by then are counted\n"
+	}
+	fmt.Printf("\n===========\n"+
+		"%s"+
+		"Total elapsed time: %s\n"+
+		"Average req/s: %.2f\n"+
+		"Agents: %d, Threads: %d, Commands/thread: %d, SUCCESS/FAIL: %d/%d\n"+
+		"SUCCESS: %s\n"+
+		"FAIL: %s\n"+
+		"Errors:\n%s",
+		partial,
+		sum.elapsed,
+		sum.rps,
+		len(agents), args.Threads, args.Iterations, sum.ns, sum.nf,
+		sum.success,
+		sum.fail,
+		errorReport,
+	)
+	printPhaseShare(rep)
+	for _, a := range agents {
+		printBreakdown("AGENT", a, byAgent[a])
+	}
+	if len(args.Port) > 1 {
+		for _, port := range args.Port {
+			printBreakdown("PORT", strconv.Itoa(port), rep.ports[strconv.Itoa(port)])
+		}
+	}
+	if hosts := args.hosts(); len(hosts) > 1 {
+		for _, host := range hosts {
+			printBreakdown("HOST", host, rep.hosts[host])
+			if hr := rep.hosts[host]; hr != nil {
+				for _, e := range sortErrors(hr.errors, args.SortErrors) {
+					fmt.Printf("  %d\t%s\n", hr.errors[e], strings.TrimSpace(e))
+				}
+			}
+		}
+	}
+	if len(rep.timeouts) > 0 {
+		printTimeouts(rep)
+	}
+	if args.DualStack {
+		for _, family := range []string{"IPv4", "IPv6"} {
+			printBreakdown("FAMILY", family, rep.families[family])
+			printSetup("FAMILY "+family, rep.families[family])
+		}
+	}
+	printSetup("", rep)
+}
@@ -0,0 +1,96 @@
+package cosignperf
+
+import (
+	"bufio"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCoordinatorArgs(t *testing.T) {
+	argv := []string{"--coordinator", "a:7000,b:7000", "-t", "4", "--agent-secret-file=secret",
+		"--output-format", "json", "-H", "cosign.example.edu", "--coordinator=c:7000"}
+	want := []string{"-t", "4", "-H", "cosign.example.edu"}
+	if got := coordinatorArgs(argv); !reflect.DeepEqual(got, want) {
+		t.Errorf("coordinatorArgs(%q) = %q, want %q", argv, got, want)
+	}
+}
+
+func TestCheckAgentArgs(t *testing.T) {
+	tests := []struct {
+		sent []string
+		ok   bool
+	}{
+		{[]string{"-H", "cosign.example.edu", "-t", "4", "--rate=100", "--sslskipverify", "-C", "NOOP"}, true},
+		{[]string{"--latency-file", "/tmp/x.csv"}, false},
+		{[]string{"-t", "4", "--error-log=/tmp/x"}, false},
+		{[]string{"--script", "/etc/passwd"}, false},
+		{[]string{"-k", "key.pem"}, false},
+		{[]string{"--pushgateway", "http://169.254.169.254/"}, false},
+		{[]string{"--on-complete", "rm -rf /"}, false},
+		// values that look like options are still checked
+		{[]string{"-C", "-x"}, false},
+	}
+	for _, tt := range tests {
+		if err := checkAgentArgs(tt.sent); (err == nil) != tt.ok {
+			t.Errorf("checkAgentArgs(%q) = %v, want ok %t", tt.sent, err, tt.ok)
+		}
+	}
+}
+
+// TestReadAgent checks results come back from an agent's --raw-output
+// with everything the summary breaks them down by
+func TestReadAgent(t *testing.T) {
+	sent := result{
+		success: false, status: "CONNREFUSED", elapsed: 3 * time.Millisecond, worker: 1, iteration: 0,
+		time: time.Now().UTC().Round(0), host: "cosign2.example.edu", port: 6663, family: "IPv6", setup: "connect",
+		phases: phases{connect: time.Millisecond, starttls: 2 * time.Millisecond, greeting: time.Millisecond},
+	}
+	path := filepath.Join(t.TempDir(), "raw.ndjson")
+	w, err := newRawWriter(path, false, defaultArgs())
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.write(sent)
+	if err := w.close(); err != nil {
+		t.Fatal(err)
+	}
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lines := string(raw) + `{"agent_done":{"exit_code":0}}` + "\n"
+	resultc := make(chan agentResult, 2)
+	if failed := readAgent("agent", 4, bufio.NewScanner(strings.NewReader(lines)), resultc); failed != "" {
+		t.Fatalf("readAgent failed: %s", failed)
+	}
+	close(resultc)
+	var got []result
+	for ar := range resultc {
+		got = append(got, ar.r)
+	}
+	want := sent
+	want.worker += 4
+	if !reflect.DeepEqual(got, []result{want}) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+}
+
+func TestRunMAC(t *testing.T) {
+	secret := []byte("0123456789abcdef")
+	mac := runMAC(secret, "nonce", []string{"-t", "4"})
+	for _, other := range []string{
+		runMAC(secret, "other nonce", []string{"-t", "4"}),
+		runMAC(secret, "nonce", []string{"-t", "5"}),
+		runMAC(secret, "nonce", []string{"-t4"}),
+		runMAC([]byte("fedcba9876543210"), "nonce", []string{"-t", "4"}),
+	} {
+		if other == mac {
+			t.Errorf("runMAC gave the same MAC for a different run")
+		}
+	}
+}
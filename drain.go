@@ -0,0 +1,145 @@
+package cosignperf
+
+import (
+	"log"
+	"net"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// drainStats keeps track of the open connections so that on an interrupt
+// they can be given --drain-timeout to finish their command and say QUIT,
+// and counts how many manage it
+type drainStats struct {
+	mu       sync.Mutex
+	conns    map[net.Conn]bool // true once force-closed
+	stopping bool
+	forcing  bool
+	deadline time.Time
+	clean    int
+	forced   int
+}
+
+func newDrain() *drainStats {
+	return &drainStats{conns: make(map[net.Conn]bool)}
+}
+
+// onInterrupt returns a channel that's closed on SIGINT or SIGTERM, telling
+// workers to stop once their command in flight is answered. Connections
+// still open after grace, or a second interrupt, have their deadlines set
+// to now so whatever they're waiting on fails and they close.
+func onInterrupt(d *drainStats, grace time.Duration) <-chan struct{} {
+	stopping := make(chan struct{})
+	sigc := make(chan os.Signal, 2)
+	signal.Notify(sigc, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-sigc
+		log.Printf("interrupted, draining connections for up to %s (interrupt again to stop now)\n", grace)
+		d.mu.Lock()
+		d.stopping, d.deadline = true, time.Now().Add(grace)
+		d.mu.Unlock()
+		close(stopping)
+		select {
+		case <-time.After(grace):
+		case <-sigc:
+		}
+		d.force()
+	}()
+	return stopping
+}
+
+// stopped says whether the run has been interrupted
+func stopped(r request) bool {
+	select {
+	case <-r.stopping:
+		return true
+	default:
+		return false
+	}
+}
+
+// track adds a newly opened connection
+func (d *drainStats) track(conn net.Conn) {
+	if d == nil {
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.conns[conn] = d.forcing
+	if d.forcing {
+		conn.SetDeadline(time.Now())
+		d.forced++
+	}
+}
+
+// done removes a connection as it's closed, counting it as drained if the
+// run was interrupted and it closed without being forced
+func (d *drainStats) done(conn net.Conn) {
+	if d == nil {
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.stopping && !d.conns[conn] {
+		d.clean++
+	}
+	delete(d.conns, conn)
+}
+
+// open is how many connections are open right now, 0 if they aren't being
+// tracked
+func (d *drainStats) open() int {
+	if d == nil {
+		return 0
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return len(d.conns)
+}
+
+// quitBy is how long to wait for the answer to QUIT while draining
+func (d *drainStats) quitBy() time.Time {
+	if d == nil {
+		return time.Now().Add(cleanupWait)
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.forcing {
+		return time.Now()
+	}
+	return d.deadline
+}
+
+// setDeadline sets a connection's deadline with set, except once it's been
+// forced to close, when it stays in the past
+func (d *drainStats) setDeadline(set func(time.Time) error, t time.Time) {
+	if d == nil {
+		set(t)
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.forcing {
+		t = time.Now()
+	}
+	set(t)
+}
+
+func (d *drainStats) force() {
+	if d == nil {
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.forcing = true
+	for conn, forced := range d.conns {
+		if !forced {
+			conn.SetDeadline(time.Now())
+			d.conns[conn] = true
+			d.forced++
+		}
+	}
+}
@@ -0,0 +1,167 @@
+package cosignperf
+
+import (
+	"bufio"
+	"crypto/tls"
+	"fmt"
+	"github.com/cobaugh/cosignperf/pkg/cosign"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// loopConn is one of the connections an eventLoop is driving
+type loopConn struct {
+	w       int
+	i       int
+	conn    net.Conn
+	tlsconn *tls.Conn
+	rd      *bufio.Reader
+	emit    func(result)
+	start   time.Time
+	ph      phases
+	sent    *pending
+	done    bool
+}
+
+// eventLoop runs the connections for workers ws from a single goroutine, for
+// --event-loop. It sets them all up, then goes round in rounds: it writes the
+// next command on every live connection and then reads the responses in turn.
+// A connection whose response arrives while an earlier one in the round is
+// still being read has that wait counted in its latency, so with a slow
+// server the results are worse than the goroutine per connection model would
+// give.
+func eventLoop(ws []int, r request, resultc chan<- result) {
+	conns := make([]*loopConn, len(ws))
+	for n, w := range ws {
+		conns[n] = &loopConn{w: w, i: 1}
+		synWait(r, w)
+		conns[n].connect(r, resultc)
+	}
+
+	for {
+		live := 0
+		for _, lc := range conns {
+			if lc.done {
+				continue
+			}
+			if lc.conn == nil {
+				// the last connection broke, carry on on a new one unless
+				// the run's been interrupted
+				if stopped(r) {
+					lc.done = true
+					continue
+				}
+				if lc.connect(r, resultc); lc.done {
+					continue
+				}
+			}
+			if stopped(r) || r.args.Iterations > 0 && lc.i > r.args.Iterations ||
+				r.budget != nil && atomic.AddInt64(r.budget, -1) < 0 ||
+				r.args.ByteBudget > 0 && atomic.LoadInt64(r.bytes) >= r.args.ByteBudget ||
+				r.args.TargetOK > 0 && atomic.LoadInt64(r.successes) >= r.args.TargetOK || tooManyErrors(r) || timeUp(r) {
+				lc.close(r)
+				lc.done = true
+				continue
+			}
+			if lc.start.IsZero() {
+				lc.start = time.Now()
+			}
+			if r.limiter != nil {
+				// don't count time spent waiting on the limiter
+				wait := time.Now()
+				<-r.limiter
+				lc.start = lc.start.Add(time.Since(wait))
+			}
+
+			n := lc.i - 1 + stagger(r, lc.w)
+			cmd := r.commands[n%len(r.commands)]
+			id := fmt.Sprintf("%s-%d", r.runID, atomic.AddInt64(r.ids, 1))
+			line := cmd.render(commandData{RequestID: id, Worker: lc.w, Iteration: lc.i, runID: r.runID, pass: n / len(r.commands)})
+			if !cmd.raw {
+				line += "\r\n"
+			}
+			sent := time.Now()
+			bound(r, lc.conn.SetWriteDeadline, r.args.WriteTO)
+			err := writeAll(lc.tlsconn, []byte(line))
+			bound(r, lc.conn.SetWriteDeadline, 0)
+			if err != nil {
+				lc.emit(result{status: writeFailure(r, err), elapsed: time.Since(lc.start), iteration: lc.i, requestID: id, script: cmd.script, time: lc.start, phases: lc.ph})
+				lc.broken(r)
+				continue
+			}
+			lc.sent = &pending{cmd: cmd, i: lc.i, id: id, start: lc.start, sent: sent, token: token(r, line, id)}
+			live++
+		}
+		if live == 0 {
+			return
+		}
+
+		for _, lc := range conns {
+			c := lc.sent
+			if c == nil {
+				continue
+			}
+			lc.sent = nil
+			bound(r, lc.conn.SetReadDeadline, r.args.ReadTO)
+			c.first = firstByte(r, lc.rd)
+			message, err := cosign.ReadLine(lc.rd, r.args.MaxLine)
+			bound(r, lc.conn.SetReadDeadline, 0)
+			lc.ph.command = time.Since(c.sent)
+			if err != nil {
+				lc.emit(result{status: lostConnection(r, err), elapsed: time.Since(c.start), iteration: c.i, requestID: c.id, time: c.start, phases: lc.ph})
+				lc.broken(r)
+				continue
+			}
+			lc.emit(respond(r, *c, message, lc.ph, lc.tlsconn.ConnectionState().Version))
+			lc.ph = phases{}
+			lc.start = time.Time{}
+			lc.i++
+		}
+	}
+}
+
+// connect opens a connection and sets up the session on it. If that fails
+// the connection is done, as a worker would stop.
+func (lc *loopConn) connect(r request, resultc chan<- result) {
+	conn, tlsconfig, emit, start := open(lc.w, r, resultc)
+	if conn == nil {
+		lc.done = true
+		return
+	}
+	ph := phases{connect: time.Since(start)}
+	tlsconn, rd, setup, status := establish(conn, tlsconfig, r, &start, &ph)
+	if setup != "" {
+		if setup == "starttls" && r.args.QuitPolicy != "never" && r.args.CloseMode != "reset" {
+			conn.Write([]byte("QUIT\r\n"))
+		}
+		emit(result{status: status, elapsed: time.Since(start), time: start, phases: ph, setup: setup})
+		hangUp(conn, r)
+		lc.done = true
+		return
+	}
+	lc.conn, lc.tlsconn, lc.rd, lc.emit, lc.start, lc.ph = conn, tlsconn, rd, emit, start, ph
+}
+
+// close says goodbye and hangs up
+func (lc *loopConn) close(r request) {
+	if lc.conn == nil {
+		return
+	}
+	if r.cleanup != nil {
+		r.cleanup.send(lc.tlsconn, lc.rd, r.args.MaxLine, cleanupBy(r))
+	}
+	if r.args.QuitPolicy != "never" && r.args.CloseMode != "reset" {
+		lc.tlsconn.Write([]byte("QUIT\r\n"))
+	}
+	hangUp(lc.conn, r)
+	lc.conn = nil
+}
+
+// broken drops a connection that can't be used any more, to be replaced on
+// the next round
+func (lc *loopConn) broken(r request) {
+	lc.close(r)
+	lc.i++
+	lc.start, lc.ph = time.Time{}, phases{}
+}
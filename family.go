@@ -0,0 +1,42 @@
+package cosignperf
+
+import (
+	"log"
+	"net"
+)
+
+// addrFamily says whether addr is IPv4 or IPv6, for --dual-stack
+func addrFamily(addr net.Addr) string {
+	tcp, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return ""
+	}
+	if tcp.IP.To4() != nil {
+		return "IPv4"
+	}
+	return "IPv6"
+}
+
+// checkDualStack warns if host doesn't resolve to addresses of both
+// families, since then --dual-stack has nothing to compare
+func checkDualStack(host string) {
+	ips, err := net.LookupIP(host)
+	if err != nil {
+		log.Printf("warning: --dual-stack: %s\n", err)
+		return
+	}
+	var v4, v6 bool
+	for _, ip := range ips {
+		if ip.To4() != nil {
+			v4 = true
+		} else {
+			v6 = true
+		}
+	}
+	switch {
+	case !v6:
+		log.Printf("warning: --dual-stack: %s only has IPv4 addresses\n", host)
+	case !v4:
+		log.Printf("warning: --dual-stack: %s only has IPv6 addresses\n", host)
+	}
+}
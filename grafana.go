@@ -0,0 +1,47 @@
+package cosignperf
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+)
+
+// grafanaAnnotation is a region annotation as taken by Grafana's
+// /api/annotations, so a run can be overlaid on the server's dashboards
+type grafanaAnnotation struct {
+	Time    int64    `json:"time"`
+	TimeEnd int64    `json:"timeEnd"`
+	Tags    []string `json:"tags"`
+	Text    string   `json:"text"`
+}
+
+// writeGrafana writes the run as an annotation to path, covering the
+// measured part of the run and summarising its results. It can be posted to
+// Grafana as is, eg. with curl -d @file. reason is the verdict, empty if the
+// run passed.
+func writeGrafana(path string, args Args, sum summary, runID, reason string) error {
+	result := "ok"
+	if reason != "" {
+		result = "fail " + reason
+	}
+	a := grafanaAnnotation{
+		Time:    sum.started.UnixMilli(),
+		TimeEnd: sum.started.Add(sum.elapsed).UnixMilli(),
+		Tags:    []string{"cosignperf", "run_id:" + runID},
+		Text: fmt.Sprintf("cosignperf %s: %d threads, SUCCESS/FAIL: %d/%d, req/s: %.2f, avg: %s, 95pct: %s, 99pct: %s, RESULT %s",
+			args.target(), args.Threads, sum.ns, sum.nf, sum.rps,
+			sum.success.avg, sum.success.p95, sum.success.p99, result),
+	}
+	for _, t := range tags {
+		a.Tags = append(a.Tags, t.key+":"+t.value)
+	}
+
+	b, err := json.MarshalIndent(a, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(path, append(b, '\n'), 0644); err != nil {
+		return fmt.Errorf("grafana: %s", err)
+	}
+	return nil
+}
@@ -0,0 +1,50 @@
+package cosignperf
+
+import (
+	"time"
+)
+
+// heartbeat sends cmd every --heartbeat-interval on a connection of its own
+// until stop is closed, to show how responsive the server stays to a trivial
+// command while it's under load. Its results are kept out of the run's stats
+// and sinks; the report of them is sent once the last one is in.
+func heartbeat(r request, cmd command, stop <-chan struct{}) <-chan *report {
+	jobs := make(chan time.Time)
+	r.commands, r.preamble, r.jobs = []command{cmd}, nil, jobs
+	r.limiter, r.budget, r.group, r.prewarm = nil, nil, "", nil
+
+	go func() {
+		defer close(jobs)
+		ticker := time.NewTicker(r.args.HbInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case t := <-ticker.C:
+				select {
+				case jobs <- t:
+				case <-stop:
+					return
+				}
+			case <-stop:
+				return
+			}
+		}
+	}()
+
+	resultc := make(chan result)
+	go func() {
+		// worker 0 so they stand out in the log
+		work(0, r, resultc)
+		close(resultc)
+	}()
+
+	out := make(chan *report, 1)
+	go func() {
+		rep := newReport()
+		for res := range resultc {
+			rep.add(res)
+		}
+		out <- rep
+	}()
+	return out
+}
@@ -0,0 +1,55 @@
+package cosignperf
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// runSummary is the JSON handed to the --on-complete command: the same
+// headline numbers as --save-baseline, plus the verdict, error counts and
+// whether the run was cut short by an interrupt
+type runSummary struct {
+	baselineRun
+	Result  string         `json:"result"`
+	Reason  string         `json:"reason,omitempty"`
+	Partial bool           `json:"partial,omitempty"`
+	Errors  map[string]int `json:"errors,omitempty"`
+}
+
+func newRunSummary(args Args, sum summary, runID, reason string) runSummary {
+	s := runSummary{baselineRun: newBaselineRun(args, sum, runID), Result: "ok", Reason: reason, Partial: sum.partial}
+	if reason != "" {
+		s.Result = "fail"
+	}
+	if len(sum.errors) > 0 {
+		s.Errors = make(map[string]int)
+		for e, n := range sum.errors {
+			s.Errors[strings.TrimSpace(e)] += n
+		}
+	}
+	return s
+}
+
+// onComplete runs the --on-complete shell command once the summary has been
+// printed, with the run's JSON summary on its stdin and in
+// COSIGNPERF_SUMMARY, and the verdict in COSIGNPERF_RESULT. Its output goes
+// to ours. A failing hook is reported but doesn't change the verdict.
+func onComplete(command string, args Args, sum summary, runID, reason string) error {
+	s := newRunSummary(args, sum, runID, reason)
+	b, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+
+	cmd := exec.Command("/bin/sh", "-c", command)
+	cmd.Stdin = strings.NewReader(string(b) + "\n")
+	cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
+	cmd.Env = append(os.Environ(), "COSIGNPERF_SUMMARY="+string(b), "COSIGNPERF_RESULT="+s.Result)
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("--on-complete: %s", err)
+	}
+	return nil
+}
@@ -0,0 +1,41 @@
+package cosignperf
+
+import (
+	"bufio"
+	"crypto/tls"
+	"errors"
+	"os"
+	"sync"
+	"time"
+)
+
+// idleStats counts how connections fared sitting idle for --idle-before-quit
+// after their last command, to see how the server treats idle connections
+type idleStats struct {
+	mu     sync.Mutex
+	n      int       // connections left idle
+	closed int       // closed by the server before we sent QUIT
+	after  durations // how long each of those took to be closed
+}
+
+// wait sits idle on conn for d, returning whether the server closed the
+// connection in that time. Anything the server sends meanwhile is ignored.
+func (s *idleStats) wait(conn *tls.Conn, rd *bufio.Reader, d time.Duration) bool {
+	start := time.Now()
+	conn.SetReadDeadline(start.Add(d))
+	defer conn.SetReadDeadline(time.Time{})
+	var err error
+	for err == nil {
+		_, err = rd.ReadString('\n')
+	}
+	closed := !errors.Is(err, os.ErrDeadlineExceeded)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.n++
+	if closed {
+		s.closed++
+		s.after = s.after.Keep(time.Since(start), s.closed, sampleSize)
+	}
+	return closed
+}
@@ -0,0 +1,58 @@
+package cosignperf
+
+import (
+	"fmt"
+	"sort"
+	"time"
+)
+
+// jitter measures how consistent each thread's latency is, for --jitter, as
+// the mean absolute difference between the latencies of its consecutive
+// successful commands. A thread whose jitter stands out from the rest is
+// usually stuck behind something on its connection.
+type jitter struct {
+	last map[int]time.Duration
+	sum  map[int]time.Duration
+	n    map[int]int
+}
+
+func newJitter() *jitter {
+	return &jitter{last: make(map[int]time.Duration), sum: make(map[int]time.Duration), n: make(map[int]int)}
+}
+
+func (j *jitter) add(r result) {
+	if j == nil || !r.success {
+		return
+	}
+	// the command's own latency, without the setup counted in the first
+	// on each connection
+	lat := r.elapsed - r.phases.connect - r.phases.starttls - r.phases.handshake
+	if last, ok := j.last[r.worker]; ok {
+		d := lat - last
+		if d < 0 {
+			d = -d
+		}
+		j.sum[r.worker] += d
+		j.n[r.worker]++
+	}
+	j.last[r.worker] = lat
+}
+
+// String sums up the spread of jitter across the threads, naming the worst
+func (j *jitter) String() string {
+	var d durations
+	worst, max := 0, time.Duration(-1)
+	for w, n := range j.n {
+		v := j.sum[w] / time.Duration(n)
+		d = append(d, v)
+		if v > max || v == max && w < worst {
+			worst, max = w, v
+		}
+	}
+	if len(d) == 0 {
+		return "no thread had two successful commands"
+	}
+	sort.Slice(d, func(a, b int) bool { return d[a] < d[b] })
+	return fmt.Sprintf("threads: %d, min: %s, median: %s, 95pct: %s, max: %s (thread %d)",
+		len(d), fmtd(d[0]), fmtd(d[len(d)/2]), fmtd(d.Percentile(percentile, 95)), fmtd(max), worst)
+}
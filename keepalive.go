@@ -0,0 +1,55 @@
+package cosignperf
+
+import (
+	"bufio"
+	"crypto/tls"
+	"math/rand"
+	"time"
+)
+
+// idle waits on a connection with nothing in flight for ready to deliver,
+// sending --keepalive-command whenever it's been idle for
+// --keepalive-interval so the server doesn't give up on the session during
+// a long gap. It returns what ready delivered. The keepalive's round trip
+// is off the clock the same as the rest of the wait.
+func idle(r request, conn *tls.Conn, rd *bufio.Reader, ready <-chan time.Time) (time.Time, bool) {
+	if r.keepalive == nil {
+		t, ok := <-ready
+		return t, ok
+	}
+	timer := time.NewTimer(r.args.KeepaliveInt)
+	defer timer.Stop()
+	for {
+		select {
+		case t, ok := <-ready:
+			return t, ok
+		case <-timer.C:
+			r.keepalive.send(conn, rd, r.args.MaxLine, time.Now().Add(cleanupWait))
+			timer.Reset(r.args.KeepaliveInt)
+		}
+	}
+}
+
+// pause sleeps for d the way idle waits
+func pause(r request, conn *tls.Conn, rd *bufio.Reader, d time.Duration) {
+	if r.keepalive == nil {
+		time.Sleep(d)
+		return
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	idle(r, conn, rd, t.C)
+}
+
+// thinkTime is how long to pause after a command for --think-time, spread
+// evenly over --think-jitter either side of it
+func thinkTime(args Args) time.Duration {
+	d := args.ThinkTime
+	if args.ThinkJitter > 0 {
+		d += time.Duration(rand.Int63n(int64(2*args.ThinkJitter)+1)) - args.ThinkJitter
+	}
+	if d < 0 {
+		return 0
+	}
+	return d
+}
@@ -0,0 +1,64 @@
+package cosignperf
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// localPorts is the --local-port-range to dial from, nil to let the kernel
+// pick
+var localPorts *portRange
+
+var errPortsExhausted = errors.New("no free port in --local-port-range")
+
+type portRange struct {
+	lo, hi int
+	next   int64
+}
+
+// parsePortRange parses a --local-port-range like 40000-40999
+func parsePortRange(s string) (*portRange, error) {
+	lo, hi, ok := strings.Cut(s, "-")
+	l, lerr := strconv.Atoi(lo)
+	h, herr := strconv.Atoi(hi)
+	if !ok || lerr != nil || herr != nil || l < 1 || h > 65535 || l > h {
+		return nil, fmt.Errorf("invalid --local-port-range %q, want LOW-HIGH like 40000-40999", s)
+	}
+	return &portRange{lo: l, hi: h}, nil
+}
+
+func (pr *portRange) String() string {
+	return fmt.Sprintf("%d-%d", pr.lo, pr.hi)
+}
+
+// dial connects to addr over TCP, from a port in --local-port-range if one
+// was given. Ports are handed out round-robin, and ones already in use are
+// skipped; if every port in the range is, it gives up with
+// errPortsExhausted.
+func dial(addr string, timeout time.Duration) (net.Conn, error) {
+	if localPorts == nil {
+		return net.DialTimeout("tcp", addr, timeout)
+	}
+	pr := localPorts
+	size := pr.hi - pr.lo + 1
+	for tries := 0; tries < size; tries++ {
+		port := pr.lo + int((atomic.AddInt64(&pr.next, 1)-1)%int64(size))
+		d := net.Dialer{
+			Timeout:   timeout,
+			LocalAddr: &net.TCPAddr{Port: port},
+			Control:   reuseAddr,
+		}
+		conn, err := d.Dial("tcp", addr)
+		if errors.Is(err, syscall.EADDRINUSE) || errors.Is(err, syscall.EADDRNOTAVAIL) {
+			continue
+		}
+		return conn, err
+	}
+	return nil, fmt.Errorf("%w %s", errPortsExhausted, pr)
+}
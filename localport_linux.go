@@ -0,0 +1,18 @@
+package cosignperf
+
+import (
+	"syscall"
+)
+
+// reuseAddr sets SO_REUSEADDR so a --local-port-range port can be dialed
+// from again while an earlier connection from it is in TIME_WAIT
+func reuseAddr(network, address string, c syscall.RawConn) error {
+	var serr error
+	err := c.Control(func(fd uintptr) {
+		serr = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_REUSEADDR, 1)
+	})
+	if err != nil {
+		return err
+	}
+	return serr
+}
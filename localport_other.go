@@ -0,0 +1,12 @@
+//go:build !linux
+
+package cosignperf
+
+import (
+	"syscall"
+)
+
+// ports in TIME_WAIT are only skipped over, not reused, off Linux
+func reuseAddr(network, address string, c syscall.RawConn) error {
+	return nil
+}
@@ -0,0 +1,135 @@
+package cosignperf
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	crand "crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"log"
+	"math/big"
+	"net"
+	"strings"
+	"time"
+)
+
+// mockResponses are what the --mock-server answers to each verb unless told
+// otherwise with --mock-response. TIME gets the current time.
+var mockResponses = map[string]string{
+	"NOOP":  "250 Cosign v3 NOOP",
+	"CHECK": "533 user not logged in",
+	"QUIT":  "221 Service closing connection",
+}
+
+// mockServer runs a minimal cosignd on --mock-server so cosignperf can be
+// tried out without a real one. It only returns on error.
+func mockServer(args Args) error {
+	l, err := net.Listen("tcp", args.MockServer)
+	if err != nil {
+		return err
+	}
+	log.Printf("mock cosignd listening on %s\n", l.Addr())
+	return serveMock(l, args)
+}
+
+// serveMock is the mock cosignd on l, for mockServer and the tests. It does
+// the greeting, STARTTLS and the handshake with a throwaway certificate,
+// then answers every command from mockResponses after waiting
+// --mock-latency, until l is closed.
+func serveMock(l net.Listener, args Args) error {
+	responses := make(map[string]string)
+	for verb, response := range mockResponses {
+		responses[verb] = response
+	}
+	for _, m := range args.MockResponse {
+		verb, response, ok := strings.Cut(m, "=")
+		if !ok || verb == "" || len(response) < 3 {
+			return fmt.Errorf("invalid --mock-response %q, want VERB=CODE [TEXT]", m)
+		}
+		responses[strings.ToUpper(verb)] = response
+	}
+
+	cert, err := selfSigned()
+	if err != nil {
+		return err
+	}
+	tlsconfig := &tls.Config{Certificates: []tls.Certificate{cert}, ClientAuth: tls.RequestClientCert}
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go mockConn(conn, tlsconfig, responses, args.MockLatency)
+	}
+}
+
+func mockConn(conn net.Conn, tlsconfig *tls.Config, responses map[string]string, latency time.Duration) {
+	defer conn.Close()
+	fmt.Fprintf(conn, "220 2 Collaborative Web Single Sign-On\r\n")
+	rd := bufio.NewReader(conn)
+	line, err := rd.ReadString('\n')
+	if err != nil || !strings.HasPrefix(strings.ToUpper(line), "STARTTLS") {
+		return
+	}
+	fmt.Fprintf(conn, "220 Ready to start TLS\r\n")
+	tlsconn := tls.Server(conn, tlsconfig)
+	if err := tlsconn.Handshake(); err != nil {
+		return
+	}
+	fmt.Fprintf(tlsconn, "220 2 Collaborative Web Single Sign-On [COSIGNv3 FACTORS=5 REKEY]\r\n")
+
+	rd = bufio.NewReader(tlsconn)
+	for {
+		line, err := rd.ReadString('\n')
+		if err != nil {
+			return
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		time.Sleep(latency)
+		verb := strings.ToUpper(fields[0])
+		response, ok := responses[verb]
+		switch {
+		case ok:
+		case verb == "TIME":
+			response = fmt.Sprintf("250 %d", time.Now().Unix())
+		case verb == "ECHO":
+			// handy for --check-order
+			response = "250 " + strings.Join(fields[1:], " ")
+		default:
+			response = "510 unknown command"
+		}
+		fmt.Fprintf(tlsconn, "%s\r\n", response)
+		if verb == "QUIT" {
+			return
+		}
+	}
+}
+
+// selfSigned makes a certificate for the mock server to present
+func selfSigned() (tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), crand.Reader)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "cosignperf mock"},
+		DNSNames:     []string{"localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(24 * time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(crand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, nil
+}
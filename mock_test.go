@@ -0,0 +1,44 @@
+package cosignperf
+
+import (
+	"net"
+	"testing"
+)
+
+// TestMockRun does a whole run against the mock cosignd and checks the
+// report's counts and codes
+func TestMockRun(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	mock := defaultArgs()
+	mock.MockResponse = []string{"CHECK=231 1.2.3.4 alice EXAMPLE.EDU"}
+	go serveMock(l, mock)
+
+	args := defaultArgs()
+	args.Threads, args.Iterations = 2, 6
+	args.Sequence = []string{"NOOP", "CHECK cosign-test=abc", "BOGUS"}
+	args.StrictCodes = true
+	var rs results
+	rep := run(testRequest(t, args, l.Addr().(*net.TCPAddr).Port), &rs)
+
+	if len(rs) != 12 {
+		t.Fatalf("got %d results, want 12", len(rs))
+	}
+	if rep.ns != 8 || rep.nf != 4 {
+		t.Errorf("got SUCCESS/FAIL %d/%d, want 8/4", rep.ns, rep.nf)
+	}
+	for code, want := range map[string]int{"250": 4, "231": 4, "510": 4} {
+		if got := rep.codes[code]; got == nil || got.ns+got.nf != want {
+			t.Errorf("code %s: got %+v, want %d results", code, got, want)
+		}
+	}
+	if len(rep.codes) != 3 {
+		t.Errorf("got codes %v, want just 250, 231 and 510", rep.codes)
+	}
+	if rep.nconn != 2 {
+		t.Errorf("got %d connections, want one per thread", rep.nconn)
+	}
+}
@@ -0,0 +1,121 @@
+package cosign
+
+import (
+	"bufio"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+// MaxLine is the longest response line a Conn will read
+const MaxLine = 64 * 1024
+
+// Conn is a connection to cosignd that has done STARTTLS, for sending
+// commands one at a time
+type Conn struct {
+	tls *tls.Conn
+	rd  *bufio.Reader
+}
+
+// Dial connects to cosignd at addr, reads its greeting, does STARTTLS with
+// config and reads the banner after the handshake. Each step has timeout,
+// if it isn't 0.
+func Dial(addr string, config *tls.Config, timeout time.Duration) (*Conn, error) {
+	conn, err := net.DialTimeout("tcp", addr, timeout)
+	if err != nil {
+		return nil, err
+	}
+	c, err := starttls(conn, config, timeout)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+func starttls(conn net.Conn, config *tls.Config, timeout time.Duration) (*Conn, error) {
+	deadline := func() {
+		if timeout > 0 {
+			conn.SetDeadline(time.Now().Add(timeout))
+		}
+	}
+	deadline()
+	rd := bufio.NewReader(conn)
+	code, text, err := readResponse(rd)
+	if err != nil {
+		return nil, fmt.Errorf("greeting: %s", err)
+	}
+	if code != "220" {
+		return nil, fmt.Errorf("greeting: expected 220, got %q", code+" "+text)
+	}
+
+	deadline()
+	if _, err := conn.Write([]byte("STARTTLS 2\r\n")); err != nil {
+		return nil, fmt.Errorf("starttls: %s", err)
+	}
+	code, text, err = readResponse(rd)
+	if err != nil {
+		return nil, fmt.Errorf("starttls: %s", err)
+	}
+	if code != "220" {
+		return nil, fmt.Errorf("starttls: expected 220, got %q", code+" "+text)
+	}
+
+	deadline()
+	t := tls.Client(conn, config)
+	if err := t.Handshake(); err != nil {
+		return nil, fmt.Errorf("handshake: %s", err)
+	}
+	rd = bufio.NewReader(t)
+	if _, err := ReadLine(rd, MaxLine); err != nil {
+		return nil, fmt.Errorf("banner: %s", err)
+	}
+	conn.SetDeadline(time.Time{})
+	return &Conn{tls: t, rd: rd}, nil
+}
+
+// readResponse reads a response, returning the code from its last line and
+// the text of every line, without the codes, joined by newlines
+func readResponse(rd *bufio.Reader) (code, text string, err error) {
+	var texts []string
+	for {
+		line, err := ReadLine(rd, MaxLine)
+		if err != nil {
+			return "", "", err
+		}
+		if !Continued(line) {
+			code, rest := SplitStatus(line)
+			return code, strings.Join(append(texts, rest), "\n"), nil
+		}
+		texts = append(texts, strings.TrimRight(line[4:], "\r\n"))
+	}
+}
+
+// Do sends command and returns the response's status code and its text,
+// the lines of a multi-line response joined by newlines
+func (c *Conn) Do(command string) (code, line string, err error) {
+	if _, err := c.tls.Write([]byte(command + "\r\n")); err != nil {
+		return "", "", err
+	}
+	return readResponse(c.rd)
+}
+
+// ConnectionState is the TLS state of the connection
+func (c *Conn) ConnectionState() tls.ConnectionState {
+	return c.tls.ConnectionState()
+}
+
+// SetDeadline sets the deadline for the commands that follow
+func (c *Conn) SetDeadline(t time.Time) error {
+	return c.tls.SetDeadline(t)
+}
+
+// Close says QUIT and closes the connection, waiting no more than a second
+// for the server to answer
+func (c *Conn) Close() error {
+	c.tls.SetDeadline(time.Now().Add(time.Second))
+	c.Do("QUIT")
+	return c.tls.Close()
+}
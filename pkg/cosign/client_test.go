@@ -0,0 +1,185 @@
+package cosign
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"math/big"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeServer is a cosignd that answers with the given greeting and STARTTLS
+// response, then answers each command from responses, "510 unknown
+// command" if it isn't there
+type fakeServer struct {
+	greeting  string
+	starttls  string
+	responses map[string]string
+}
+
+func (f fakeServer) start(t *testing.T) string {
+	t.Helper()
+	cert := testCert(t)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go f.serve(conn, &tls.Config{Certificates: []tls.Certificate{cert}})
+		}
+	}()
+	return l.Addr().String()
+}
+
+func (f fakeServer) serve(conn net.Conn, config *tls.Config) {
+	defer conn.Close()
+	fmt.Fprint(conn, f.greeting)
+	rd := bufio.NewReader(conn)
+	if line, err := rd.ReadString('\n'); err != nil || !strings.HasPrefix(line, "STARTTLS") {
+		return
+	}
+	fmt.Fprint(conn, f.starttls)
+	t := tls.Server(conn, config)
+	if err := t.Handshake(); err != nil {
+		return
+	}
+	fmt.Fprint(t, "220 2 Collaborative Web Single Sign-On [COSIGNv3]\r\n")
+	rd = bufio.NewReader(t)
+	for {
+		line, err := rd.ReadString('\n')
+		if err != nil {
+			return
+		}
+		verb := strings.TrimSpace(line)
+		response, ok := f.responses[verb]
+		if !ok {
+			response = "510 unknown command\r\n"
+		}
+		fmt.Fprint(t, response)
+		if verb == "QUIT" {
+			return
+		}
+	}
+}
+
+func testCert(t *testing.T) tls.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "cosign test"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+var responses = map[string]string{
+	"NOOP":  "250 Cosign v3 NOOP\r\n",
+	"MULTI": "250-first\r\n250-second\r\n250 last\r\n",
+	"QUIT":  "221 Service closing connection\r\n",
+}
+
+func TestDialDo(t *testing.T) {
+	tests := []struct {
+		name     string
+		starttls string
+	}{
+		{"single line STARTTLS", "220 Ready to start TLS\r\n"},
+		{"multi-line STARTTLS", "220-Ready\r\n220 go ahead\r\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			addr := fakeServer{"220 2 Collaborative Web Single Sign-On\r\n", tt.starttls, responses}.start(t)
+			c, err := Dial(addr, &tls.Config{InsecureSkipVerify: true}, 5*time.Second)
+			if err != nil {
+				t.Fatalf("Dial: %s", err)
+			}
+			defer c.Close()
+			if !c.ConnectionState().HandshakeComplete {
+				t.Errorf("handshake not complete")
+			}
+
+			for _, do := range []struct{ command, code, line string }{
+				{"NOOP", "250", "Cosign v3 NOOP"},
+				{"MULTI", "250", "first\nsecond\nlast"},
+				{"BOGUS", "510", "unknown command"},
+			} {
+				code, line, err := c.Do(do.command)
+				if err != nil {
+					t.Fatalf("Do(%q): %s", do.command, err)
+				}
+				if code != do.code || line != do.line {
+					t.Errorf("Do(%q) = %q, %q, want %q, %q", do.command, code, line, do.code, do.line)
+				}
+			}
+		})
+	}
+}
+
+func TestDialRejects(t *testing.T) {
+	tests := []struct {
+		name, greeting, starttls, want string
+	}{
+		{"greeting", "421 busy\r\n", "", "greeting: expected 220"},
+		{"starttls", "220 hello\r\n", "502 no TLS here\r\n", "starttls: expected 220"},
+		{"multi-line starttls refused", "220 hello\r\n", "502-no\r\n502 TLS here\r\n", "starttls: expected 220"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			addr := fakeServer{tt.greeting, tt.starttls, responses}.start(t)
+			c, err := Dial(addr, &tls.Config{InsecureSkipVerify: true}, 5*time.Second)
+			if err == nil {
+				c.Close()
+				t.Fatalf("Dial succeeded, want an error")
+			}
+			if !strings.HasPrefix(err.Error(), tt.want) {
+				t.Errorf("got %q, want it to start %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestDialTimeout(t *testing.T) {
+	// accepts but never greets
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		conn, err := l.Accept()
+		if err == nil {
+			defer conn.Close()
+			time.Sleep(2 * time.Second)
+		}
+	}()
+	start := time.Now()
+	if _, err := Dial(l.Addr().String(), &tls.Config{InsecureSkipVerify: true}, 100*time.Millisecond); err == nil {
+		t.Fatalf("Dial succeeded against a server that never greets")
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("Dial took %s, want it to give up after the 100ms timeout", d)
+	}
+}
@@ -0,0 +1,68 @@
+// Package cosign speaks the client side of the cosignd protocol: reading
+// and parsing responses, and a minimal client that does STARTTLS and sends
+// commands, for tools like health checks that want to talk to cosignd
+// without the rest of cosignperf.
+package cosign
+
+import (
+	"bufio"
+	"errors"
+	"strings"
+)
+
+// ErrLineTooLong is returned by ReadLine for a line longer than it was
+// allowed to buffer
+var ErrLineTooLong = errors.New("line too long")
+
+// ReadLine reads up to and including the next newline like
+// bufio.Reader.ReadString, but gives up with ErrLineTooLong rather than
+// buffering more than max bytes from a server that never sends one
+func ReadLine(rd *bufio.Reader, max int) (string, error) {
+	var line []byte
+	for {
+		frag, err := rd.ReadSlice('\n')
+		if len(line)+len(frag) > max {
+			return "", ErrLineTooLong
+		}
+		line = append(line, frag...)
+		if err != bufio.ErrBufferFull {
+			return string(line), err
+		}
+	}
+}
+
+// Continued says whether line is one of the NNN-... lines of a multi-line
+// response, with more to follow
+func Continued(line string) bool {
+	return len(line) > 3 && line[3] == '-'
+}
+
+// SplitStatus splits a response line into its status code and the rest of
+// the message. Not every cosignd is strict about the format, so leading
+// whitespace, a tab rather than a space after the code and a bare code with
+// no message are all accepted.
+func SplitStatus(message string) (code, line string) {
+	s := strings.TrimLeft(strings.TrimRight(message, "\r\n"), " \t")
+	if i := strings.IndexAny(s, " \t"); i >= 0 {
+		return s[:i], strings.TrimLeft(s[i+1:], " \t")
+	}
+	return s, ""
+}
+
+// CheckReply is the payload of a successful CHECK response,
+// "231 ip principal realm [factor...]", the realm being the first factor
+type CheckReply struct {
+	IP        string
+	Principal string
+	Factors   []string
+}
+
+// ParseCheck parses the payload of a successful CHECK response, line being
+// the response without its code
+func ParseCheck(line string) (CheckReply, bool) {
+	f := strings.Fields(line)
+	if len(f) < 3 {
+		return CheckReply{}, false
+	}
+	return CheckReply{IP: f[0], Principal: f[1], Factors: f[2:]}, true
+}
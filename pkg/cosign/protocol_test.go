@@ -0,0 +1,112 @@
+package cosign
+
+import (
+	"bufio"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestSplitStatus(t *testing.T) {
+	tests := []struct {
+		message, code, line string
+	}{
+		{"250 Cosign v3 NOOP\r\n", "250", "Cosign v3 NOOP"},
+		{"231 1.2.3.4 alice EXAMPLE.EDU\n", "231", "1.2.3.4 alice EXAMPLE.EDU"},
+		{"  220 ready\r\n", "220", "ready"},
+		{"220\tready", "220", "ready"},
+		{"250  two spaces", "250", "two spaces"},
+		{"221\r\n", "221", ""},
+		{"", "", ""},
+	}
+	for _, tt := range tests {
+		code, line := SplitStatus(tt.message)
+		if code != tt.code || line != tt.line {
+			t.Errorf("SplitStatus(%q) = %q, %q, want %q, %q", tt.message, code, line, tt.code, tt.line)
+		}
+	}
+}
+
+func TestContinued(t *testing.T) {
+	tests := []struct {
+		line string
+		want bool
+	}{
+		{"220-Ready\r\n", true},
+		{"220 go ahead\r\n", false},
+		{"220\r\n", false},
+		{"220-", true},
+		{"22-", false},
+		{"", false},
+	}
+	for _, tt := range tests {
+		if got := Continued(tt.line); got != tt.want {
+			t.Errorf("Continued(%q) = %t, want %t", tt.line, got, tt.want)
+		}
+	}
+}
+
+func TestReadLine(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		max   int
+		want  []string
+		err   error
+	}{
+		{"lines", "250 one\r\n250 two\r\n", 100, []string{"250 one\r\n", "250 two\r\n"}, nil},
+		{"exactly max", "250 ok\r\n", 8, []string{"250 ok\r\n"}, nil},
+		{"too long", "250 " + strings.Repeat("x", 100) + "\r\n", 50, nil, ErrLineTooLong},
+		// longer than the reader's buffer, so read in fragments
+		{"fragments", strings.Repeat("y", 40) + "\n", 100, []string{strings.Repeat("y", 40) + "\n"}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rd := bufio.NewReaderSize(strings.NewReader(tt.input), 16)
+			var got []string
+			for {
+				line, err := ReadLine(rd, tt.max)
+				if err != nil {
+					if tt.err != nil && err != tt.err {
+						t.Fatalf("got error %v, want %v", err, tt.err)
+					}
+					if tt.err == nil && line != "" {
+						t.Fatalf("got %q with error %v", line, err)
+					}
+					break
+				}
+				got = append(got, line)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestReadLineUnterminated(t *testing.T) {
+	rd := bufio.NewReader(strings.NewReader("250 no newline"))
+	line, err := ReadLine(rd, 100)
+	if line != "250 no newline" || err == nil {
+		t.Errorf("got %q, %v, want the partial line and EOF", line, err)
+	}
+}
+
+func TestParseCheck(t *testing.T) {
+	tests := []struct {
+		line string
+		want CheckReply
+		ok   bool
+	}{
+		{"1.2.3.4 alice EXAMPLE.EDU", CheckReply{"1.2.3.4", "alice", []string{"EXAMPLE.EDU"}}, true},
+		{"1.2.3.4 alice EXAMPLE.EDU otp", CheckReply{"1.2.3.4", "alice", []string{"EXAMPLE.EDU", "otp"}}, true},
+		{"1.2.3.4 alice", CheckReply{}, false},
+		{"", CheckReply{}, false},
+	}
+	for _, tt := range tests {
+		got, ok := ParseCheck(tt.line)
+		if ok != tt.ok || !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("ParseCheck(%q) = %+v, %t, want %+v, %t", tt.line, got, ok, tt.want, tt.ok)
+		}
+	}
+}
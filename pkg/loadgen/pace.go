@@ -0,0 +1,51 @@
+package loadgen
+
+import (
+	"math"
+	"math/rand"
+	"time"
+)
+
+// TokenBucket paces at rate a second like a time.Ticker, but holds on to up
+// to burst ticks nobody was waiting for, so workers that fall behind catch
+// up on the rate instead of it being lost. It stops when stop is closed.
+func TokenBucket(rate float64, burst int, stop <-chan struct{}) <-chan time.Time {
+	tokens := make(chan time.Time, burst)
+	go func() {
+		ticker := time.NewTicker(time.Duration(float64(time.Second) / rate))
+		defer ticker.Stop()
+		for {
+			select {
+			case t := <-ticker.C:
+				select {
+				case tokens <- t:
+				default:
+					// the bucket is full
+				}
+			case <-stop:
+				return
+			}
+		}
+	}()
+	return tokens
+}
+
+// ThreadRate draws a worker's rate from dist, with the given mean, for
+// workers that each pace themselves. uniform is between half and one and a
+// half times the mean; exponential is exponentially distributed; anything
+// else is bimodal, with a fifth of workers at three times the mean and the
+// rest at half.
+func ThreadRate(dist string, mean float64) float64 {
+	switch dist {
+	case "uniform":
+		return mean * (0.5 + rand.Float64())
+	case "exponential":
+		// not so slow that a worker never gets going
+		return math.Max(rand.ExpFloat64()*mean, mean/100)
+	default:
+		if rand.Float64() < 0.2 {
+			return mean * 3
+		}
+		return mean / 2
+	}
+}
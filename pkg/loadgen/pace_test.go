@@ -0,0 +1,34 @@
+package loadgen
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTokenBucket(t *testing.T) {
+	stop := make(chan struct{})
+	defer close(stop)
+	tokens := TokenBucket(1000, 5, stop)
+	// nobody takes the ticks for a while, so it fills up to the burst
+	time.Sleep(50 * time.Millisecond)
+	if n := len(tokens); n != 5 {
+		t.Errorf("holding %d ticks, want the burst of 5", n)
+	}
+}
+
+func TestThreadRate(t *testing.T) {
+	for _, dist := range []string{"uniform", "exponential", "bimodal"} {
+		var sum float64
+		const n = 10000
+		for i := 0; i < n; i++ {
+			r := ThreadRate(dist, 10)
+			if r <= 0 {
+				t.Fatalf("%s gave rate %f", dist, r)
+			}
+			sum += r
+		}
+		if mean := sum / n; mean < 9 || mean > 11 {
+			t.Errorf("%s rates have mean %.2f, want about 10", dist, mean)
+		}
+	}
+}
@@ -0,0 +1,109 @@
+package loadgen
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Config is how Run puts load on: Workers goroutines each calling the Func
+// Iterations times, or until Duration is up or the context is done,
+// whichever comes first
+type Config struct {
+	Workers    int
+	Iterations int           // calls per worker, 0 for no limit
+	Duration   time.Duration // 0 for no limit
+	Rate       float64       // calls a second across all the workers, 0 for as fast as they go
+	Burst      int           // ticks of the Rate held for workers that fall behind, as for TokenBucket
+	SampleSize int           // latencies kept of successes and of failures, 0 for all of them
+}
+
+// Func does worker w's iteration i, both counted from 1, returning why it
+// failed or nil if it didn't. ctx is done once the run is over.
+type Func func(ctx context.Context, w, i int) error
+
+// Report is what a Run did
+type Report struct {
+	Successes Durations // latencies of the calls that succeeded
+	Failures  Durations // and those that failed
+	NS        int       // calls that succeeded, which is more than len(Successes) once over the SampleSize
+	NF        int
+	Errors    map[string]int // failures by error
+	Elapsed   time.Duration
+}
+
+// RPS is the calls made a second
+func (r *Report) RPS() float64 {
+	if r.Elapsed <= 0 {
+		return 0
+	}
+	return float64(r.NS+r.NF) / r.Elapsed.Seconds()
+}
+
+// Run calls do from cfg.Workers goroutines at once as cfg says, timing each
+// call, and returns what they added up to once they're done. A call that
+// fails after the run is over is taken to have been cut short by it, and
+// isn't counted.
+func Run(ctx context.Context, cfg Config, do Func) *Report {
+	if cfg.Duration > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, cfg.Duration)
+		defer cancel()
+	}
+	var pace <-chan time.Time
+	if cfg.Rate > 0 {
+		stop := make(chan struct{})
+		defer close(stop)
+		pace = TokenBucket(cfg.Rate, max(cfg.Burst, 1), stop)
+	}
+
+	type call struct {
+		elapsed time.Duration
+		err     error
+	}
+	callc := make(chan call, cfg.Workers)
+	var wg sync.WaitGroup
+	start := time.Now()
+	for w := 1; w <= cfg.Workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 1; cfg.Iterations == 0 || i <= cfg.Iterations; i++ {
+				if pace != nil {
+					select {
+					case <-pace:
+					case <-ctx.Done():
+						return
+					}
+				}
+				if ctx.Err() != nil {
+					return
+				}
+				t := time.Now()
+				err := do(ctx, w, i)
+				if err != nil && ctx.Err() != nil {
+					return
+				}
+				callc <- call{time.Since(t), err}
+			}
+		}(w)
+	}
+	go func() {
+		wg.Wait()
+		close(callc)
+	}()
+
+	rep := &Report{Errors: make(map[string]int)}
+	for c := range callc {
+		if c.err == nil {
+			rep.NS++
+			rep.Successes = rep.Successes.Keep(c.elapsed, rep.NS, cfg.SampleSize)
+		} else {
+			rep.NF++
+			rep.Failures = rep.Failures.Keep(c.elapsed, rep.NF, cfg.SampleSize)
+			rep.Errors[c.err.Error()]++
+		}
+	}
+	rep.Elapsed = time.Since(start)
+	return rep
+}
@@ -0,0 +1,77 @@
+package loadgen
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRun(t *testing.T) {
+	var mu sync.Mutex
+	seen := make(map[[2]int]bool)
+	rep := Run(context.Background(), Config{Workers: 3, Iterations: 4}, func(ctx context.Context, w, i int) error {
+		mu.Lock()
+		seen[[2]int{w, i}] = true
+		mu.Unlock()
+		if i == 4 {
+			return errors.New("fourth")
+		}
+		return nil
+	})
+	if rep.NS != 9 || rep.NF != 3 || len(rep.Successes) != 9 || len(rep.Failures) != 3 {
+		t.Errorf("got %d/%d successes/failures with %d/%d kept, want 9/3", rep.NS, rep.NF, len(rep.Successes), len(rep.Failures))
+	}
+	if rep.Errors["fourth"] != 3 {
+		t.Errorf("got errors %v, want fourth 3 times", rep.Errors)
+	}
+	for w := 1; w <= 3; w++ {
+		for i := 1; i <= 4; i++ {
+			if !seen[[2]int{w, i}] {
+				t.Errorf("worker %d never did iteration %d", w, i)
+			}
+		}
+	}
+}
+
+func TestRunRate(t *testing.T) {
+	rep := Run(context.Background(), Config{Workers: 4, Iterations: 5, Rate: 100}, func(ctx context.Context, w, i int) error {
+		return nil
+	})
+	// 20 calls at 100 a second takes about 200ms however many workers
+	if rep.NS != 20 || rep.Elapsed < 150*time.Millisecond {
+		t.Errorf("%d calls in %s, want 20 taking about 200ms", rep.NS, rep.Elapsed)
+	}
+}
+
+func TestRunDuration(t *testing.T) {
+	rep := Run(context.Background(), Config{Workers: 2, Duration: 100 * time.Millisecond, SampleSize: 10}, func(ctx context.Context, w, i int) error {
+		select {
+		case <-time.After(5 * time.Millisecond):
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	})
+	if rep.Elapsed > time.Second {
+		t.Errorf("took %s, want it to stop after 100ms", rep.Elapsed)
+	}
+	// the calls cut short at the end aren't counted as failures
+	if rep.NF != 0 || rep.NS < 10 || len(rep.Successes) != 10 {
+		t.Errorf("got %d/%d successes/failures with %d kept, want no failures and 10 kept", rep.NS, rep.NF, len(rep.Successes))
+	}
+}
+
+func ExampleRun() {
+	rep := Run(context.Background(), Config{Workers: 2, Iterations: 3}, func(ctx context.Context, w, i int) error {
+		// eg. a CHECK with pkg/cosign
+		if w == 2 && i == 3 {
+			return errors.New("533 not logged in")
+		}
+		return nil
+	})
+	fmt.Printf("SUCCESS/FAIL: %d/%d, errors: %v\n", rep.NS, rep.NF, rep.Errors)
+	// Output: SUCCESS/FAIL: 5/1, errors: map[533 not logged in:1]
+}
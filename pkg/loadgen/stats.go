@@ -0,0 +1,96 @@
+// Package loadgen is cosignperf's load engine without the cosign parts:
+// workers calling a function at a paced rate, and the latency samples and
+// statistics they add up to. Use it with pkg/cosign to put load on cosignd
+// from other tools, or with anything else that can be timed.
+package loadgen
+
+import (
+	"github.com/montanaflynn/stats"
+	"math/rand"
+	"time"
+)
+
+// Durations is a sample of latencies
+type Durations []time.Duration
+
+// Keep adds v, the nth value seen, to d. With a size above 0 it replaces a
+// random element once d has size of them so d stays a uniform sample of
+// everything seen (reservoir sampling).
+func (d Durations) Keep(v time.Duration, n, size int) Durations {
+	return Keep(d, v, n, size)
+}
+
+// Keep is Durations.Keep for a sample of anything
+func Keep[S ~[]E, E any](d S, v E, n, size int) S {
+	if size <= 0 || len(d) < size {
+		return append(d, v)
+	}
+	if j := rand.Intn(n); j < size {
+		d[j] = v
+	}
+	return d
+}
+
+// Combined merges the success and failure samples s and f of ns and nf
+// results. Kept to a size, they can be sampled at different rates, so the
+// one holding more per result is cut down to keep the mix as it was.
+func Combined(s Durations, ns int, f Durations, nf int) Durations {
+	if len(s) < ns || len(f) < nf {
+		// the fraction of results both can cover
+		c := 1.0
+		if ns > 0 && float64(len(s))/float64(ns) < c {
+			c = float64(len(s)) / float64(ns)
+		}
+		if nf > 0 && float64(len(f))/float64(nf) < c {
+			c = float64(len(f)) / float64(nf)
+		}
+		// reservoir samples are in no particular order, so a prefix is
+		// still a fair sample
+		s, f = s[:int(c*float64(ns))], f[:int(c*float64(nf))]
+	}
+	all := make(Durations, 0, len(s)+len(f))
+	return append(append(all, s...), f...)
+}
+
+// Stat is f, eg. stats.Mean, of d, or 0 if there's nothing to go on
+func (d Durations) Stat(f func(stats.Float64Data) (float64, error)) time.Duration {
+	s, err := f(d.floats())
+	if err != nil {
+		return 0
+	}
+	return time.Duration(s)
+}
+
+// Percentile is the pth percentile of d by the method f, eg.
+// stats.Percentile, or 0 if there's nothing to go on
+func (d Durations) Percentile(f func(stats.Float64Data, float64) (float64, error), p float64) time.Duration {
+	s, err := f(d.floats(), p)
+	if err != nil {
+		return 0
+	}
+	return time.Duration(s)
+}
+
+// Bootstrap estimates a 95% confidence interval for percentile p by the
+// method f by recomputing it over n resamples (with replacement) of d
+func (d Durations) Bootstrap(f func(stats.Float64Data, float64) (float64, error), p float64, n int) (time.Duration, time.Duration) {
+	estimates := make([]float64, n)
+	sample := make([]float64, len(d))
+	for i := range estimates {
+		for j := range sample {
+			sample[j] = float64(d[rand.Intn(len(d))])
+		}
+		estimates[i], _ = f(sample, p)
+	}
+	lo, _ := stats.Percentile(estimates, 2.5)
+	hi, _ := stats.Percentile(estimates, 97.5)
+	return time.Duration(lo), time.Duration(hi)
+}
+
+func (d Durations) floats() stats.Float64Data {
+	f := make(stats.Float64Data, len(d))
+	for i, v := range d {
+		f[i] = float64(v)
+	}
+	return f
+}
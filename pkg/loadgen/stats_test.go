@@ -0,0 +1,71 @@
+package loadgen
+
+import (
+	"github.com/montanaflynn/stats"
+	"testing"
+	"time"
+)
+
+func TestKeep(t *testing.T) {
+	var all, capped Durations
+	for n := 1; n <= 1000; n++ {
+		all = all.Keep(time.Duration(n), n, 0)
+		capped = capped.Keep(time.Duration(n), n, 100)
+	}
+	if len(all) != 1000 {
+		t.Errorf("kept %d with no size, want all 1000", len(all))
+	}
+	if len(capped) != 100 {
+		t.Errorf("kept %d with a size of 100, want 100", len(capped))
+	}
+	// a uniform sample of 1..1000 has its mean somewhere near 500
+	if mean := capped.Stat(stats.Mean); mean < 300 || mean > 700 {
+		t.Errorf("sample mean %d, want it near 500", mean)
+	}
+}
+
+func TestStat(t *testing.T) {
+	d := Durations{4 * time.Millisecond, 1 * time.Millisecond, 3 * time.Millisecond, 2 * time.Millisecond}
+	tests := []struct {
+		name string
+		got  time.Duration
+		want time.Duration
+	}{
+		{"mean", d.Stat(stats.Mean), 2500 * time.Microsecond},
+		{"max", d.Stat(stats.Max), 4 * time.Millisecond},
+		{"min", d.Stat(stats.Min), 1 * time.Millisecond},
+		{"p50", d.Percentile(stats.PercentileNearestRank, 50), 2 * time.Millisecond},
+		{"p100", d.Percentile(stats.PercentileNearestRank, 100), 4 * time.Millisecond},
+		{"empty", Durations{}.Stat(stats.Mean), 0},
+		{"empty percentile", Durations{}.Percentile(stats.Percentile, 99), 0},
+	}
+	for _, tt := range tests {
+		if tt.got != tt.want {
+			t.Errorf("%s = %s, want %s", tt.name, tt.got, tt.want)
+		}
+	}
+}
+
+func TestCombined(t *testing.T) {
+	s := Durations{1, 2, 3, 4}
+	f := Durations{5, 6}
+	if all := Combined(s, 4, f, 2); len(all) != 6 {
+		t.Errorf("got %d from complete samples, want all 6", len(all))
+	}
+	// all 4 of 4 successes but only 2 of 4 failures kept, so half of each
+	if all := Combined(s, 4, f, 4); len(all) != 4 {
+		t.Errorf("got %v, want 2 successes and 2 failures", all)
+	}
+}
+
+func TestBootstrap(t *testing.T) {
+	var d Durations
+	for n := 1; n <= 200; n++ {
+		d = append(d, time.Duration(n)*time.Millisecond)
+	}
+	p99 := d.Percentile(stats.Percentile, 99)
+	lo, hi := d.Bootstrap(stats.Percentile, 99, 200)
+	if lo > p99 || hi < p99 || lo <= 0 {
+		t.Errorf("interval %s-%s doesn't cover the p99 %s", lo, hi, p99)
+	}
+}
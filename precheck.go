@@ -0,0 +1,81 @@
+package cosignperf
+
+import (
+	"log"
+	"strings"
+	"time"
+)
+
+// precheck makes a single connection and sets up a session on it the way a
+// worker would, for --precheck and --verify-cert-accepted, so an obviously
+// down server or a rejected client cert is caught before the run starts. It
+// returns the phase that failed and why, or "" if it worked.
+func precheck(base request) (setup, status string) {
+	r := base
+	r.args.Quiet = true
+	r.conns, r.ids, r.closed, r.bytes = new(int64), new(int64), new(int64), new(int64)
+	r.tcp, r.idle, r.drain, r.handshake = nil, nil, nil, nil
+
+	resultc := make(chan result, 1)
+	conn, tlsconfig, _, start := open(1, r, resultc)
+	if conn == nil {
+		return "connect", strings.TrimSpace((<-resultc).status)
+	}
+	defer hangUp(conn, r)
+	var ph phases
+	tlsconn, _, setup, status := establish(conn, tlsconfig, r, &start, &ph)
+	if setup != "" {
+		return setup, strings.TrimSpace(status)
+	}
+	if r.args.QuitPolicy != "never" && r.args.CloseMode != "reset" {
+		tlsconn.Write([]byte("QUIT\r\n"))
+	}
+	return "", ""
+}
+
+// waitReady repeats the precheck with exponential backoff until it works or
+// timeout has passed, for --wait-for-ready, so a run started while the
+// server is still coming up waits for it. A rejected client cert won't fix
+// itself so isn't retried. It returns the last attempt's outcome.
+func waitReady(base request, timeout time.Duration) (setup, status string) {
+	deadline := time.Now().Add(timeout)
+	wait := 250 * time.Millisecond
+	for {
+		if setup, status = precheck(base); setup == "" || certRejected(setup, status) {
+			return setup, status
+		}
+		left := time.Until(deadline)
+		if left <= 0 {
+			return setup, status
+		}
+		if wait > left {
+			wait = left
+		}
+		log.Printf("wait-for-ready: %s: %s, retrying in %s\n", setup, status, wait)
+		time.Sleep(wait)
+		if wait *= 2; wait > 5*time.Second {
+			wait = 5 * time.Second
+		}
+	}
+}
+
+// certAlerts are the TLS alerts a server sends when it won't take a client
+// cert
+var certAlerts = []string{
+	"bad certificate", "unsupported certificate", "certificate revoked", "certificate expired",
+	"certificate unknown", "unknown certificate authority", "certificate required", "access denied",
+}
+
+// certRejected says whether a handshake failed because the server turned
+// down our client cert
+func certRejected(setup, status string) bool {
+	if setup != "handshake" || !strings.Contains(status, "alert ") {
+		return false
+	}
+	for _, a := range certAlerts {
+		if strings.Contains(status, a) {
+			return true
+		}
+	}
+	return false
+}
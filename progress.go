@@ -0,0 +1,62 @@
+package cosignperf
+
+import (
+	"fmt"
+	"log"
+	"time"
+)
+
+// progress counts results as they come in, for the --report-interval line
+// logged while a run is going. Its latencies are the successes since the
+// last line, so its percentiles follow the run rather than averaging all of
+// it.
+type progress struct {
+	last   time.Time
+	drain  *drainStats // for the connections open
+	done   int
+	failed int
+	n      int
+	nf     int
+	ns     int
+	s      durations
+}
+
+func newProgress(start time.Time, d *drainStats) *progress {
+	return &progress{last: start, drain: d}
+}
+
+func (p *progress) add(r result) {
+	if p == nil {
+		return
+	}
+	p.done++
+	p.n++
+	if r.success {
+		p.ns++
+		p.s = p.s.Keep(r.elapsed, p.ns, sampleSize)
+	} else {
+		p.failed++
+		p.nf++
+	}
+}
+
+// report logs the totals so far and the connections open, then the rate,
+// failures and percentiles since the last report, and starts a new interval
+func (p *progress) report(now time.Time) {
+	rps := float64(p.n) / now.Sub(p.last).Seconds()
+	pct := func(n float64) string {
+		if len(p.s) == 0 {
+			return "-"
+		}
+		return fmtd(p.s.Percentile(percentile, n))
+	}
+	// only the main run tracks its connections, not the ones of a sweep,
+	// --interval or --tls-compare
+	var open string
+	if p.drain != nil {
+		open = fmt.Sprintf(", %d connections open", p.drain.open())
+	}
+	log.Printf("progress: %d done, %d failed%s; last %s: %.2f req/s, %d failed, 50pct: %s, 95pct: %s, 99pct: %s\n",
+		p.done, p.failed, open, fmtd(now.Sub(p.last)), rps, p.nf, pct(50), pct(95), pct(99))
+	p.last, p.n, p.nf, p.ns, p.s = now, 0, 0, 0, nil
+}
@@ -0,0 +1,242 @@
+package cosignperf
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// histogram bucket upper bounds, in seconds
+var promBuckets = []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// exemplar is the sampled request that was last observed in a bucket
+type exemplar struct {
+	worker    int
+	iteration int
+	requestID string
+	value     float64
+	time      time.Time
+}
+
+type promHistogram struct {
+	counts    []int64 // per bucket, not cumulative; the last entry is +Inf
+	exemplars []*exemplar
+	sum       float64
+	count     int64
+}
+
+// promWriter aggregates results into counters and latency histograms and
+// writes them out in Prometheus text format when the run is done, for pickup
+// by the node_exporter textfile collector, and/or pushes them to a
+// Pushgateway. The one behind --prometheus-listen is also rendered while
+// results are still coming in, hence the lock.
+type promWriter struct {
+	mu         sync.Mutex
+	path       string
+	push       string // Pushgateway URL
+	openmetric bool
+	hist       map[string]*promHistogram // keyed by result label
+	codes      map[string]int64          // responses by status code
+	setup      map[string]int64          // connection setup failures by phase
+}
+
+func newPromWriter(path, push string, exemplars bool) *promWriter {
+	return &promWriter{path: path, push: push, openmetric: exemplars, hist: make(map[string]*promHistogram),
+		codes: make(map[string]int64), setup: make(map[string]int64)}
+}
+
+// setupPhases are the connection setup failure phases, always rendered so
+// alerts on them don't see an absent series before the first failure
+var setupPhases = []string{"connect", "starttls", "handshake", "preamble"}
+
+// servePrometheus serves live metrics for --prometheus-listen at /metrics on
+// addr. Unlike the textfile and Pushgateway ones they aren't reset between
+// --interval runs, since Prometheus expects counters to only go up.
+func servePrometheus(addr string, exemplars bool) (*promWriter, error) {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("--prometheus-listen: %s", err)
+	}
+	p := newPromWriter("", "", exemplars)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, req *http.Request) {
+		if p.openmetric {
+			w.Header().Set("Content-Type", "application/openmetrics-text; version=1.0.0; charset=utf-8")
+		} else {
+			w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		}
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		p.render(w, p.openmetric)
+	})
+	go http.Serve(l, mux)
+	return p, nil
+}
+
+func (p *promWriter) write(r result) {
+	if r.warmup || r.cooldown {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if r.code != "" {
+		p.codes[r.code]++
+	}
+	if r.setup != "" {
+		p.setup[r.setup]++
+	}
+	label := "success"
+	if !r.success {
+		label = "fail"
+	}
+	h, ok := p.hist[label]
+	if !ok {
+		h = &promHistogram{
+			counts:    make([]int64, len(promBuckets)+1),
+			exemplars: make([]*exemplar, len(promBuckets)+1),
+		}
+		p.hist[label] = h
+	}
+
+	v := r.elapsed.Seconds()
+	b := sort.SearchFloat64s(promBuckets, v)
+	h.counts[b]++
+	h.exemplars[b] = &exemplar{worker: r.worker, iteration: r.iteration, requestID: r.requestID, value: v, time: r.time}
+	h.sum += v
+	h.count++
+}
+
+func (p *promWriter) close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.push != "" {
+		// the Pushgateway only takes the plain text format, so no exemplars
+		var b bytes.Buffer
+		p.render(&b, false)
+		if err := pushMetrics(p.push, &b); err != nil {
+			return err
+		}
+	}
+	if p.path == "" {
+		return nil
+	}
+
+	// write to a temp file and rename so the collector never sees a partial file
+	tmp, err := os.CreateTemp(filepath.Dir(p.path), filepath.Base(p.path)+".tmp")
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(tmp)
+	p.render(w, p.openmetric)
+
+	if err := w.Flush(); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), p.path)
+}
+
+// pushMetrics replaces the cosignperf job's metrics on the Pushgateway at url
+func pushMetrics(url string, body io.Reader) error {
+	req, err := http.NewRequest(http.MethodPut, strings.TrimSuffix(url, "/")+"/metrics/job/cosignperf", body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "text/plain; version=0.0.4")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("pushgateway: %s", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("pushgateway: %s", resp.Status)
+	}
+	return nil
+}
+
+// render writes the metrics in Prometheus text format, or OpenMetrics with
+// exemplars if openmetric is set
+func (p *promWriter) render(w io.Writer, openmetric bool) {
+	labels := []string{"success", "fail"}
+	// --tag labels, added to every sample
+	var extra string
+	for _, t := range tags {
+		extra += fmt.Sprintf(",%s=%q", t.key, t.value)
+	}
+	fmt.Fprintf(w, "# HELP cosignperf_schema_version Version of the cosignperf metric names and labels.\n")
+	fmt.Fprintf(w, "# TYPE cosignperf_schema_version gauge\n")
+	if extra != "" {
+		fmt.Fprintf(w, "cosignperf_schema_version{%s} %d\n", extra[1:], schemaVersion)
+	} else {
+		fmt.Fprintf(w, "cosignperf_schema_version %d\n", schemaVersion)
+	}
+	fmt.Fprintf(w, "# HELP cosignperf_commands Commands issued, by result.\n")
+	fmt.Fprintf(w, "# TYPE cosignperf_commands counter\n")
+	for _, l := range labels {
+		var n int64
+		if h, ok := p.hist[l]; ok {
+			n = h.count
+		}
+		fmt.Fprintf(w, "cosignperf_commands_total{result=%q%s} %d\n", l, extra, n)
+	}
+
+	fmt.Fprintf(w, "# HELP cosignperf_command_duration_seconds Command latency, by result.\n")
+	fmt.Fprintf(w, "# TYPE cosignperf_command_duration_seconds histogram\n")
+	for _, l := range labels {
+		h, ok := p.hist[l]
+		if !ok {
+			continue
+		}
+		var cumulative int64
+		for i, n := range h.counts {
+			cumulative += n
+			le := "+Inf"
+			if i < len(promBuckets) {
+				le = strconv.FormatFloat(promBuckets[i], 'g', -1, 64)
+			}
+			fmt.Fprintf(w, "cosignperf_command_duration_seconds_bucket{result=%q%s,le=%q} %d", l, extra, le, cumulative)
+			if e := h.exemplars[i]; openmetric && e != nil {
+				fmt.Fprintf(w, " # {thread=\"%d\",iteration=\"%d\",request_id=%q} %g %.3f",
+					e.worker, e.iteration, e.requestID, e.value, float64(e.time.UnixNano())/1e9)
+			}
+			fmt.Fprintf(w, "\n")
+		}
+		fmt.Fprintf(w, "cosignperf_command_duration_seconds_sum{result=%q%s} %g\n", l, extra, h.sum)
+		fmt.Fprintf(w, "cosignperf_command_duration_seconds_count{result=%q%s} %d\n", l, extra, h.count)
+	}
+
+	fmt.Fprintf(w, "# HELP cosignperf_responses Responses, by status code.\n")
+	fmt.Fprintf(w, "# TYPE cosignperf_responses counter\n")
+	var codes []string
+	for c := range p.codes {
+		codes = append(codes, c)
+	}
+	sort.Strings(codes)
+	for _, c := range codes {
+		fmt.Fprintf(w, "cosignperf_responses_total{code=%q%s} %d\n", c, extra, p.codes[c])
+	}
+
+	fmt.Fprintf(w, "# HELP cosignperf_setup_failures Connections that failed to set up, by phase.\n")
+	fmt.Fprintf(w, "# TYPE cosignperf_setup_failures counter\n")
+	for _, ph := range setupPhases {
+		fmt.Fprintf(w, "cosignperf_setup_failures_total{phase=%q%s} %d\n", ph, extra, p.setup[ph])
+	}
+	if openmetric {
+		fmt.Fprintf(w, "# EOF\n")
+	}
+}
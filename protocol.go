@@ -0,0 +1,66 @@
+package cosignperf
+
+import (
+	"fmt"
+	"github.com/cobaugh/cosignperf/pkg/cosign"
+	"strconv"
+	"strings"
+)
+
+// protocolExpect is the response codes that mean a command did what it was
+// asked, for --strict-codes: 231 or 232 for a CHECK, a cookie the server
+// knows to be logged in, and any 2xx for everything else. The 4xx and 5xx
+// answers defaultExpect also takes are well-formed, but say no.
+func protocolExpect(verb string) map[string]bool {
+	set := make(map[string]bool)
+	if verb == "CHECK" {
+		set["231"], set["232"] = true, true
+		return set
+	}
+	for n := 200; n < 300; n++ {
+		set[strconv.Itoa(n)] = true
+	}
+	return set
+}
+
+// checkAssertions checks the payload of a successful CHECK response, line
+// being the response without its code, against --expect-principal and
+// --expect-factor, returning the failure status or "" if it passes. With
+// --strict-codes a payload that can't be parsed fails too.
+func checkAssertions(args Args, line, message string) string {
+	if args.Principal == "" && len(args.Factors) == 0 && !args.StrictCodes {
+		return ""
+	}
+	reply, ok := cosign.ParseCheck(line)
+	if !ok {
+		return fmt.Sprintf("BADCHECK want ip principal realm %s", message)
+	}
+	if args.Principal != "" && reply.Principal != args.Principal {
+		return fmt.Sprintf("PRINCIPALMISMATCH want %s got %s %s", args.Principal, reply.Principal, message)
+	}
+	for _, want := range args.Factors {
+		found := false
+		for _, f := range reply.Factors {
+			found = found || f == want
+		}
+		if !found {
+			return fmt.Sprintf("FACTORMISSING want %s %s", want, message)
+		}
+	}
+	return ""
+}
+
+// functionalFailure says whether a failure's status is the server answering
+// properly but not the way the command should have been answered, as
+// opposed to the connection or the protocol itself going wrong
+func functionalFailure(status string) bool {
+	f := strings.Fields(status)
+	if len(f) == 0 {
+		return false
+	}
+	switch f[0] {
+	case "FAILRESPONSE", "RESPONSEMISMATCH", "BADCHECK", "PRINCIPALMISMATCH", "FACTORMISSING":
+		return true
+	}
+	return false
+}
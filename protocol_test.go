@@ -0,0 +1,22 @@
+package cosignperf
+
+import "testing"
+
+func TestFunctionalFailure(t *testing.T) {
+	tests := []struct {
+		status string
+		want   bool
+	}{
+		{"FAILRESPONSE 510 unknown command", true},
+		{"BADCHECK 231", true},
+		{"COMMANDEOF server closed the connection mid-command: EOF", false},
+		{"TIMEOUT read no response after 30s", false},
+		{"", false},
+		{" \r\n", false},
+	}
+	for _, tt := range tests {
+		if got := functionalFailure(tt.status); got != tt.want {
+			t.Errorf("functionalFailure(%q) = %t, want %t", tt.status, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,50 @@
+package cosignperf
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+)
+
+// v2 header signature, see the HAProxy PROXY protocol spec
+var proxyV2Sig = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// proxyHeader builds a PROXY protocol header describing conn, so a load
+// balancer that requires one passes our real address on to cosignd
+func proxyHeader(version string, conn net.Conn) ([]byte, error) {
+	src, ok1 := conn.LocalAddr().(*net.TCPAddr)
+	dst, ok2 := conn.RemoteAddr().(*net.TCPAddr)
+	if !ok1 || !ok2 {
+		return nil, fmt.Errorf("PROXY header needs a TCP connection")
+	}
+	v4 := src.IP.To4() != nil && dst.IP.To4() != nil
+
+	switch version {
+	case "v1":
+		proto := "TCP6"
+		if v4 {
+			proto = "TCP4"
+		}
+		return []byte(fmt.Sprintf("PROXY %s %s %s %d %d\r\n", proto, src.IP, dst.IP, src.Port, dst.Port)), nil
+
+	case "v2":
+		var family byte = 0x21 // TCP over IPv6
+		srcIP, dstIP := src.IP.To16(), dst.IP.To16()
+		if v4 {
+			family = 0x11 // TCP over IPv4
+			srcIP, dstIP = src.IP.To4(), dst.IP.To4()
+		}
+
+		addrs := make([]byte, 0, 2*len(srcIP)+4)
+		addrs = append(addrs, srcIP...)
+		addrs = append(addrs, dstIP...)
+		addrs = binary.BigEndian.AppendUint16(addrs, uint16(src.Port))
+		addrs = binary.BigEndian.AppendUint16(addrs, uint16(dst.Port))
+
+		h := append([]byte{}, proxyV2Sig...)
+		h = append(h, 0x21, family) // version 2, PROXY command
+		h = binary.BigEndian.AppendUint16(h, uint16(len(addrs)))
+		return append(h, addrs...), nil
+	}
+	return nil, fmt.Errorf("unknown PROXY protocol version %q", version)
+}
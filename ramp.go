@@ -0,0 +1,121 @@
+package cosignperf
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// rampPoint is one line of a --ramp-profile: the aggregate rate to be running
+// at offset into the run
+type rampPoint struct {
+	offset time.Duration
+	rate   float64
+}
+
+// loadRamp reads a --ramp-profile file of "offset rate" lines, where offset
+// is a duration like 30s or a number of seconds. Blank lines and lines
+// starting with # are skipped, and offsets have to be increasing.
+func loadRamp(path string) ([]rampPoint, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var points []rampPoint
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("%s:%d: want \"offset rate\"", path, n)
+		}
+		offset, err := time.ParseDuration(fields[0])
+		if err != nil {
+			secs, serr := strconv.ParseFloat(fields[0], 64)
+			if serr != nil {
+				return nil, fmt.Errorf("%s:%d: bad offset %q", path, n, fields[0])
+			}
+			offset = time.Duration(secs * float64(time.Second))
+		}
+		rate, err := strconv.ParseFloat(fields[1], 64)
+		if err != nil || rate < 0 {
+			return nil, fmt.Errorf("%s:%d: bad rate %q", path, n, fields[1])
+		}
+		if len(points) > 0 && offset <= points[len(points)-1].offset {
+			return nil, fmt.Errorf("%s:%d: offsets must increase", path, n)
+		}
+		points = append(points, rampPoint{offset, rate})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(points) == 0 {
+		return nil, fmt.Errorf("%s: no points", path)
+	}
+	return points, nil
+}
+
+// rateAt interpolates linearly between the points either side of t, holding
+// the first rate before the first point and the last one after the last
+func rateAt(points []rampPoint, t time.Duration) float64 {
+	if t <= points[0].offset {
+		return points[0].rate
+	}
+	for i := 1; i < len(points); i++ {
+		if a, b := points[i-1], points[i]; t < b.offset {
+			frac := float64(t-a.offset) / float64(b.offset-a.offset)
+			return a.rate + frac*(b.rate-a.rate)
+		}
+	}
+	return points[len(points)-1].rate
+}
+
+// rampLimiter ticks at the rate given by points until stop is closed. Like a
+// time.Ticker it drops ticks nobody is waiting for rather than letting them
+// pile up.
+func rampLimiter(points []rampPoint, stop <-chan struct{}) <-chan time.Time {
+	ticks := make(chan time.Time, 1)
+	go func() {
+		start := time.Now()
+		last := start
+		// ticks owed so far; wake up at least every 100ms so a rate that
+		// starts low and ramps up isn't stuck waiting out a long interval
+		var credit float64
+		for {
+			wait := 100 * time.Millisecond
+			if rate := rateAt(points, last.Sub(start)); rate > 0 {
+				if d := time.Duration(float64(time.Second) / rate); d < wait {
+					wait = d
+				}
+			}
+			select {
+			case <-time.After(wait):
+			case <-stop:
+				return
+			}
+			now := time.Now()
+			credit += rateAt(points, now.Sub(start)) * now.Sub(last).Seconds()
+			last = now
+			if credit < 1 {
+				continue
+			}
+			if credit--; credit > 1 {
+				// ticks are being missed, drop the backlog like a Ticker
+				credit = 0
+			}
+			select {
+			case ticks <- now:
+			default:
+			}
+		}
+	}()
+	return ticks
+}
@@ -0,0 +1,80 @@
+package cosignperf
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// loadReplay reads the start times of the requests in a --raw-output file,
+// gzipped if it ends in .gz, and returns them as offsets from the first one
+// in the order they were sent
+func loadReplay(path string) ([]time.Duration, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var in io.Reader = f
+	if strings.HasSuffix(path, ".gz") {
+		zr, err := gzip.NewReader(f)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", path, err)
+		}
+		in = zr
+	}
+
+	// records are written as requests finish, not as they start
+	var times []time.Time
+	scanner := bufio.NewScanner(in)
+	for n := 1; scanner.Scan(); n++ {
+		var rec rawRecord
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			return nil, fmt.Errorf("%s:%d: %s", path, n, err)
+		}
+		times = append(times, rec.Time)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(times) == 0 {
+		return nil, fmt.Errorf("%s: no requests", path)
+	}
+	sort.Slice(times, func(i, j int) bool { return times[i].Before(times[j]) })
+
+	offsets := make([]time.Duration, len(times))
+	for i, t := range times {
+		offsets[i] = t.Sub(times[0])
+	}
+	return offsets, nil
+}
+
+// replayLimiter ticks at each of offsets divided by speed, until they run out
+// or stop is closed. Unlike rampLimiter it waits for every tick to be taken,
+// so the trace is replayed in full even if it falls behind.
+func replayLimiter(offsets []time.Duration, speed float64, stop <-chan struct{}) <-chan time.Time {
+	ticks := make(chan time.Time)
+	go func() {
+		start := time.Now()
+		for _, offset := range offsets {
+			at := start.Add(time.Duration(float64(offset) / speed))
+			select {
+			case <-time.After(time.Until(at)):
+			case <-stop:
+				return
+			}
+			select {
+			case ticks <- time.Now():
+			case <-stop:
+				return
+			}
+		}
+	}()
+	return ticks
+}
@@ -0,0 +1,37 @@
+package cosignperf
+
+import (
+	"fmt"
+	"github.com/cobaugh/cosignperf/pkg/loadgen"
+	"github.com/montanaflynn/stats"
+)
+
+// sizes holds the byte lengths of responses, for --response-sizes. Like
+// durations it's a sample of at most --sample-size of them.
+type sizes []int
+
+func (s sizes) keep(v, n int) sizes {
+	return loadgen.Keep(s, v, n, sampleSize)
+}
+
+func (s sizes) floats() stats.Float64Data {
+	f := make(stats.Float64Data, len(s))
+	for i, v := range s {
+		f[i] = float64(v)
+	}
+	return f
+}
+
+// String formats the avg, max, min, 99pct and 95pct size, in bytes
+func (s sizes) String() string {
+	if len(s) == 0 {
+		return "no samples"
+	}
+	f := s.floats()
+	avg, _ := stats.Mean(f)
+	max, _ := stats.Max(f)
+	min, _ := stats.Min(f)
+	p99, _ := percentile(f, 99)
+	p95, _ := percentile(f, 95)
+	return fmt.Sprintf("avg: %.1f, max: %.0f, min: %.0f, 99pct: %.0f, 95pct: %.0f", avg, max, min, p99, p95)
+}
@@ -0,0 +1,135 @@
+package cosignperf
+
+import (
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// rotatingFile is a per-request output file. With --rotate-size or
+// --rotate-interval it's moved aside under a timestamped name and started
+// afresh once it gets too big or its period is up, and reopened for
+// appending across --interval runs rather than overwritten. Writers ask due
+// between records and call rotate, so no record is split across files.
+type rotatingFile struct {
+	path     string
+	maxSize  int64
+	interval time.Duration
+	keep     int
+	f        *os.File
+	size     int64
+	period   time.Time // start of the --rotate-interval the file is for
+}
+
+func createOutput(path string, args Args) (*rotatingFile, error) {
+	rf := &rotatingFile{path: path, maxSize: args.RotateSize, interval: args.RotateEvery, keep: args.RotateKeep}
+	if err := rf.open(rf.rotating()); err != nil {
+		return nil, err
+	}
+	if rf.size > 0 && rf.due(0) {
+		// left over from a run in an earlier period
+		if err := rf.rotate(); err != nil {
+			return nil, err
+		}
+	}
+	return rf, nil
+}
+
+func (rf *rotatingFile) rotating() bool {
+	return rf.maxSize > 0 || rf.interval > 0
+}
+
+func (rf *rotatingFile) open(appending bool) error {
+	flags := os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	if appending {
+		flags = os.O_WRONLY | os.O_CREATE | os.O_APPEND
+	}
+	f, err := os.OpenFile(rf.path, flags, 0666)
+	if err != nil {
+		return err
+	}
+	st, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	rf.f, rf.size, rf.period = f, st.Size(), time.Now()
+	if rf.size > 0 {
+		rf.period = st.ModTime()
+	}
+	if rf.interval > 0 {
+		// line periods up with the clock, so hourly files start on the hour
+		rf.period = rf.period.Truncate(rf.interval)
+	}
+	return nil
+}
+
+func (rf *rotatingFile) Write(p []byte) (int, error) {
+	n, err := rf.f.Write(p)
+	rf.size += int64(n)
+	return n, err
+}
+
+func (rf *rotatingFile) Close() error {
+	return rf.f.Close()
+}
+
+// due says whether it's time to rotate, counting pending bytes the writer
+// has buffered but not written yet
+func (rf *rotatingFile) due(pending int) bool {
+	if rf.maxSize > 0 && rf.size+int64(pending) >= rf.maxSize {
+		return true
+	}
+	return rf.interval > 0 && time.Now().Truncate(rf.interval).After(rf.period)
+}
+
+// rotate moves the file aside, with the time inserted before its extension,
+// eg. raw.ndjson.gz becomes raw.20240102T150405.000Z.ndjson.gz, deletes the
+// oldest moved files beyond --rotate-keep and opens a new one. The writer
+// has to have flushed everything to it first.
+func (rf *rotatingFile) rotate() error {
+	if err := rf.f.Close(); err != nil {
+		log.Printf("rotate %s: %s\n", rf.path, err)
+	}
+	dir, stem, ext := rf.split()
+	aside := filepath.Join(dir, stem+"."+time.Now().UTC().Format("20060102T150405.000Z")+ext)
+	moved := true
+	if err := os.Rename(rf.path, aside); err != nil {
+		// keep writing to the same file rather than lose results
+		log.Printf("rotate %s: %s\n", rf.path, err)
+		moved = false
+	}
+	if moved && rf.keep > 0 {
+		rf.prune()
+	}
+	return rf.open(!moved)
+}
+
+// split splits the path at the first dot in its file name
+func (rf *rotatingFile) split() (dir, stem, ext string) {
+	dir, base := filepath.Split(rf.path)
+	stem, ext = base, ""
+	if i := strings.Index(base, "."); i > 0 {
+		stem, ext = base[:i], base[i:]
+	}
+	return dir, stem, ext
+}
+
+// prune deletes all but the newest --rotate-keep moved aside files
+func (rf *rotatingFile) prune() {
+	dir, stem, ext := rf.split()
+	old, err := filepath.Glob(filepath.Join(dir, stem+".*Z"+ext))
+	if err != nil || len(old) <= rf.keep {
+		return
+	}
+	// the timestamps sort in time order
+	sort.Strings(old)
+	for _, path := range old[:len(old)-rf.keep] {
+		if err := os.Remove(path); err != nil {
+			log.Printf("rotate %s: %s\n", rf.path, err)
+		}
+	}
+}
@@ -0,0 +1,225 @@
+package cosignperf
+
+import (
+	"bufio"
+	"encoding/csv"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// payload is a file of values for a --scenario-csv command to cycle
+// through, one per line, shared by every thread sending it
+type payload struct {
+	values []string
+	n      *int64
+}
+
+// loadPayload reads a payload_file, skipping blank lines. Lines are used as
+// they are, so values can have spaces in them.
+func loadPayload(path string) (*payload, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	p := &payload{n: new(int64)}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if line := strings.TrimRight(scanner.Text(), "\r"); strings.TrimSpace(line) != "" {
+			p.values = append(p.values, line)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(p.values) == 0 {
+		return nil, fmt.Errorf("%s: no values", path)
+	}
+	return p, nil
+}
+
+// next is the value after the last one handed out, going back to the start
+// at the end of the file
+func (p *payload) next() string {
+	return p.values[(atomic.AddInt64(p.n, 1)-1)%int64(len(p.values))]
+}
+
+// scenario is one client type from a --scenarios file, run alongside the
+// others with its own threads, rate and commands
+type scenario struct {
+	name     string
+	threads  int
+	rate     float64 // across the scenario's threads, 0 = unlimited
+	commands []command
+}
+
+// loadScenarios reads a --scenarios file of "name threads rate command"
+// lines, where command is the rest of the line and can be a sequence
+// separated by " ; ". A rate of 0 is unlimited. Blank lines and lines
+// starting with # are skipped.
+func loadScenarios(path string, args Args) ([]scenario, error) {
+	expect, err := parseExpect(args)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var scenarios []scenario
+	seen := make(map[string]bool)
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.SplitN(line, " ", 4)
+		if len(fields) != 4 {
+			return nil, fmt.Errorf("%s:%d: want \"name threads rate command\"", path, n)
+		}
+		s := scenario{name: fields[0]}
+		if seen[s.name] {
+			return nil, fmt.Errorf("%s:%d: scenario %s is repeated", path, n, s.name)
+		}
+		seen[s.name] = true
+		if s.threads, err = strconv.Atoi(fields[1]); err != nil || s.threads <= 0 {
+			return nil, fmt.Errorf("%s:%d: bad threads %q", path, n, fields[1])
+		}
+		if s.rate, err = strconv.ParseFloat(fields[2], 64); err != nil || s.rate < 0 {
+			return nil, fmt.Errorf("%s:%d: bad rate %q", path, n, fields[2])
+		}
+		for _, t := range strings.Split(fields[3], " ; ") {
+			c, err := newCommand(strings.TrimSpace(t), args, expect)
+			if err != nil {
+				return nil, fmt.Errorf("%s:%d: %s", path, n, err)
+			}
+			s.commands = append(s.commands, *c)
+		}
+		scenarios = append(scenarios, s)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(scenarios) == 0 {
+		return nil, fmt.Errorf("%s: no scenarios", path)
+	}
+	return scenarios, nil
+}
+
+// loadScenarioCSV reads a --scenario-csv file describing a mix of commands,
+// one per row, with columns command,weight,expected_codes,timeout,payload_file.
+// weight is a whole number, 1 if empty; expected_codes separated by spaces or
+// semicolons replace the usual ones for that command; timeout, if set, is
+// its --command-timeout; and payload_file is a file of values the command
+// takes in turn as {{.Payload}}. The last columns can be left off. A first row starting with "command" is taken as
+// a header, and rows starting with # are skipped. The commands are spread
+// through the sequence in proportion to their weights.
+func loadScenarioCSV(path string, args Args, expect map[string]map[string]bool) ([]*command, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	cr := csv.NewReader(f)
+	cr.Comment = '#'
+	cr.FieldsPerRecord = -1
+	cr.TrimLeadingSpace = true
+	rows, err := cr.ReadAll()
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+	if len(rows) > 0 && len(rows[0]) > 0 && strings.EqualFold(strings.TrimSpace(rows[0][0]), "command") {
+		rows = rows[1:]
+	}
+
+	var mix []*command
+	var weights []int
+	for n, row := range rows {
+		if len(row) == 0 || len(row) > 5 || strings.TrimSpace(row[0]) == "" {
+			return nil, fmt.Errorf("%s: row %d: want command,weight,expected_codes,timeout,payload_file", path, n+1)
+		}
+		for len(row) < 5 {
+			row = append(row, "")
+		}
+		c, err := newCommand(strings.TrimSpace(row[0]), args, expect)
+		if err != nil {
+			return nil, fmt.Errorf("%s: row %d: %s", path, n+1, err)
+		}
+		weight := 1
+		if w := strings.TrimSpace(row[1]); w != "" {
+			if weight, err = strconv.Atoi(w); err != nil || weight <= 0 {
+				return nil, fmt.Errorf("%s: row %d: bad weight %q, want a whole number", path, n+1, w)
+			}
+		}
+		if codes := strings.FieldsFunc(row[2], func(r rune) bool { return r == ' ' || r == ';' || r == ',' }); len(codes) > 0 {
+			c.expect = make(map[string]bool)
+			for _, code := range codes {
+				c.expect[code] = true
+			}
+		}
+		if t := strings.TrimSpace(row[3]); t != "" {
+			if c.timeout, err = time.ParseDuration(t); err != nil || c.timeout <= 0 {
+				return nil, fmt.Errorf("%s: row %d: bad timeout %q", path, n+1, t)
+			}
+		}
+		if file := strings.TrimSpace(row[4]); file != "" {
+			if !strings.Contains(c.text, ".Payload") {
+				return nil, fmt.Errorf("%s: row %d: payload_file given but the command doesn't use {{.Payload}}", path, n+1)
+			}
+			if c.payload, err = loadPayload(file); err != nil {
+				return nil, fmt.Errorf("%s: row %d: %s", path, n+1, err)
+			}
+		}
+		mix = append(mix, c)
+		weights = append(weights, weight)
+	}
+	if len(mix) == 0 {
+		return nil, fmt.Errorf("%s: no commands", path)
+	}
+	order, err := interleave(weights)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+	var seq []*command
+	for _, i := range order {
+		seq = append(seq, mix[i])
+	}
+	return seq, nil
+}
+
+// interleave returns a sequence of indexes into weights in which each one
+// turns up as many times as its weight, spread out by smooth weighted
+// round-robin so a 3:1 mix goes A A B A rather than A A A B and every
+// stretch of the run sees about the same mix
+func interleave(weights []int) ([]int, error) {
+	total := 0
+	for _, w := range weights {
+		total += w
+	}
+	if total > 10000 {
+		return nil, fmt.Errorf("weights add up to %d, keep them under 10000", total)
+	}
+	var order []int
+	current := make([]int, len(weights))
+	for k := 0; k < total; k++ {
+		best := 0
+		for i := range weights {
+			current[i] += weights[i]
+			if current[i] > current[best] {
+				best = i
+			}
+		}
+		current[best] -= total
+		order = append(order, best)
+	}
+	return order, nil
+}
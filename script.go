@@ -0,0 +1,81 @@
+package cosignperf
+
+import (
+	"bufio"
+	"fmt"
+	"hash/fnv"
+	"math/rand"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// scriptTokens are the %{...} substitutions a --script line can use, as the
+// command template fields they stand for
+var scriptTokens = map[string]string{
+	"worker":  "{{.Worker}}",
+	"iter":    "{{.Iteration}}",
+	"rand32":  "{{.Rand32}}",
+	"session": "{{.Session}}",
+}
+
+var scriptToken = regexp.MustCompile(`%\{([^}]*)\}`)
+
+// loadScript reads a --script file of commands, one per line, skipping blank
+// lines and # comments, and parses each with its %{...} tokens turned into
+// template fields. The commands keep the line as written to report them by.
+func loadScript(path string, args Args, expect map[string]map[string]bool) ([]*command, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var commands []*command
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		var bad string
+		t := scriptToken.ReplaceAllStringFunc(line, func(m string) string {
+			field, ok := scriptTokens[m[2:len(m)-1]]
+			if !ok && bad == "" {
+				bad = m
+			}
+			return field
+		})
+		if bad != "" {
+			return nil, fmt.Errorf("%s:%d: unknown token %s, want %%{worker}, %%{iter}, %%{rand32} or %%{session}", path, n, bad)
+		}
+		c, err := newCommand(t, args, expect)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %s", path, n, err)
+		}
+		c.script = line
+		commands = append(commands, c)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(commands) == 0 {
+		return nil, fmt.Errorf("%s: no commands", path)
+	}
+	return commands, nil
+}
+
+// Rand32 is a random 32 bit value in hex, for %{rand32}
+func (commandData) Rand32() string {
+	return fmt.Sprintf("%08x", rand.Uint32())
+}
+
+// Session is the %{session} value: random looking, but the same for every
+// command in one of the worker's passes through the commands, so the cookie
+// a REGISTER sets up can be CHECKed and LOGOUTed by the commands after it,
+// even over a reconnect
+func (d commandData) Session() string {
+	h := fnv.New32a()
+	fmt.Fprintf(h, "%s-%d-%d", d.runID, d.Worker, d.pass)
+	return fmt.Sprintf("%08x", h.Sum32())
+}
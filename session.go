@@ -0,0 +1,863 @@
+package cosignperf
+
+import (
+	"bufio"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"github.com/cobaugh/cosignperf/pkg/cosign"
+	"io"
+	"log"
+	"math/rand"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+func worker(w int, requestc <-chan request, resultc chan<- result) {
+	for r := range requestc {
+		work(w, r, resultc)
+	}
+}
+
+// work runs worker w's share of the run. With --host-strategy all that's
+// the whole share on each host in turn.
+func work(w int, r request, resultc chan<- result) {
+	if r.args.HostStrategy != "all" {
+		workOn(w, r, resultc)
+		return
+	}
+	for _, host := range r.args.hosts() {
+		if stopped(r) {
+			return
+		}
+		r.args.Hostname = host
+		workOn(w, r, resultc)
+	}
+}
+
+// workOn keeps opening connections until the session says we're done
+func workOn(w int, r request, resultc chan<- result) {
+	r.backoff = new(time.Duration)
+	r.branched = new(int)
+	r.retry = new(retry)
+	r.offset = stagger(r, w)
+	synWait(r, w)
+	for i, more := session(w, r, 1, resultc); more && !stopped(r); {
+		// spread reconnects out, before session() starts the clock
+		if r.args.ReconnJitter > 0 {
+			time.Sleep(time.Duration(rand.Int63n(int64(r.args.ReconnJitter))))
+		}
+		if rt := r.retry; rt.n > 0 && rt.i == i {
+			retryWait(r, rt.n)
+		}
+		i, more = session(w, r, i, resultc)
+	}
+}
+
+// synWait holds worker w's first connection back for --syn-spread, so the
+// workers' first SYNs go out one at a time rather than all at once.
+// Connections the open model adds later aren't held back.
+func synWait(r request, w int) {
+	if r.args.SynSpread > 0 && w >= 1 && w <= r.args.Threads {
+		time.Sleep(time.Until(r.startup.Add(time.Duration(w-1) * r.args.SynSpread)))
+	}
+}
+
+// session opens a single connection and runs commands on it starting at
+// iteration first, returning the next iteration and whether the worker should
+// reconnect and carry on
+func session(w int, r request, first int, resultc chan<- result) (int, bool) {
+	conn, tlsconfig, emit, start := open(w, r, resultc)
+	if conn == nil {
+		if first == 1 && r.prewarm != nil {
+			r.prewarm.Done()
+		}
+		return first, false
+	}
+	defer hangUp(conn, r)
+	return runSession(w, conn, tlsconfig, r, first, start, emit)
+}
+
+// open connects worker w to the server and sends any PROXY header. It returns
+// the connection with the TLS config to use on it, the func to pass its
+// results to and when the connection attempt started. If it fails the
+// failure has already been emitted and conn is nil.
+func open(w int, r request, resultc chan<- result) (net.Conn, *tls.Config, func(result), time.Time) {
+	// rotate through --sni names and client certs per connection
+	tlsconfig := r.tlsconfig
+	var sni string
+	if len(r.args.SNI) > 0 || len(r.certs) > 1 {
+		n := atomic.AddInt64(r.conns, 1) - 1
+		tlsconfig = r.tlsconfig.Clone()
+		if len(r.args.SNI) > 0 {
+			sni = r.args.SNI[n%int64(len(r.args.SNI))]
+			tlsconfig.ServerName = sni
+		}
+		if len(r.certs) > 1 {
+			if r.args.CertPerWorker {
+				n = int64(w - 1)
+			}
+			c := n % int64(len(r.certs))
+			tlsconfig.Certificates = r.certs[c : c+1]
+		}
+	}
+
+	// spread workers over the --port values, and the -H hosts
+	host, port := r.args.addr(w)
+	if r.args.FD >= 0 {
+		port = 0
+	}
+	if len(r.args.SNI) == 0 && tlsconfig.ServerName != host {
+		// so the cert is checked against the host we're connecting to
+		if tlsconfig == r.tlsconfig {
+			tlsconfig = r.tlsconfig.Clone()
+		}
+		tlsconfig.ServerName = host
+	}
+
+	var family string
+	emit := func(res result) {
+		res.worker, res.sni, res.group, res.port, res.family, res.host = w, sni, r.group, port, family, r.args.host(w)
+		if rt := r.retry; rt != nil && res.iteration > 0 && res.iteration == rt.i {
+			res.retries = rt.n
+		}
+		if r.args.Verbose && !r.args.Quiet {
+			if res.iteration > 0 {
+				log.Printf("[%d:%d] %s %s", w, res.iteration, fmtd(res.elapsed), res.status)
+			} else {
+				log.Printf("[%d] %s %s", w, fmtd(res.elapsed), res.status)
+			}
+		}
+		resultc <- res
+	}
+
+	start := time.Now()
+
+	// connect, or pick up the connection we were handed
+	var conn net.Conn
+	var err error
+	var attempts int
+	if r.args.FD >= 0 {
+		f := os.NewFile(uintptr(r.args.FD), "fd"+strconv.Itoa(r.args.FD))
+		conn, err = net.FileConn(f)
+		f.Close()
+	} else {
+		addr := net.JoinHostPort(host, strconv.Itoa(port))
+		conn, err = dial(addr, r.args.ConnectTO)
+		for n := 1; err != nil && n <= r.args.Retries && !stopped(r); n++ {
+			attempts = n
+			retryWait(r, n)
+			conn, err = dial(addr, r.args.ConnectTO)
+		}
+	}
+	if err != nil {
+		elapsed := time.Since(start)
+		emit(result{status: fmt.Sprintf("%s %s", dialFailure(err), err), elapsed: elapsed, time: start, phases: phases{connect: elapsed}, setup: "connect", retries: attempts})
+		return nil, nil, nil, start
+	}
+	if r.args.DualStack {
+		family = addrFamily(conn.RemoteAddr())
+	}
+	if r.args.ByteBudget > 0 {
+		conn = &countingConn{Conn: conn, n: r.bytes}
+	}
+	r.drain.track(conn)
+
+	// the PROXY header has to come before anything else on the connection
+	if r.args.ProxyProtocol != "" {
+		h, err := proxyHeader(r.args.ProxyProtocol, conn)
+		if err == nil {
+			err = writeAll(conn, h)
+		}
+		if err != nil {
+			emit(result{status: fmt.Sprintf("PROXYFAIL %s", err), elapsed: time.Since(start), time: start, setup: "connect"})
+			hangUp(conn, r)
+			return nil, nil, nil, start
+		}
+	}
+	return conn, tlsconfig, emit, start
+}
+
+// hangUp closes a connection from open, the way --close-mode says
+func hangUp(conn net.Conn, r request) {
+	raw := conn
+	if c, ok := raw.(*countingConn); ok {
+		raw = c.Conn
+	}
+	tc, _ := raw.(*net.TCPConn)
+	if r.tcp != nil && tc != nil {
+		r.tcp.sample(tc)
+	}
+	if r.args.CloseMode == "reset" && tc != nil {
+		// drop the connection without lingering so the kernel sends an
+		// RST rather than a FIN
+		tc.SetLinger(0)
+	}
+	conn.Close()
+	r.drain.done(conn)
+	atomic.AddInt64(r.closed, 1)
+}
+
+// runSession speaks the cosign protocol over conn: it sets up the session
+// with establish, then issues commands from iteration first on, passing each
+// result to emit. start is when the connection attempt was made, so the first
+// result includes connection setup time. It returns the next iteration and
+// whether there are more to run on a fresh connection.
+func runSession(w int, conn net.Conn, tlsconfig *tls.Config, r request, first int, start time.Time, emit func(result)) (int, bool) {
+	ph := phases{connect: time.Since(start)}
+	tlsconn, rd, setup, status := establish(conn, tlsconfig, r, &start, &ph)
+
+	// say goodbye on whichever layer we got to, but not in the middle of a
+	// failed handshake
+	var quit io.Writer
+	switch {
+	case r.args.QuitPolicy == "never" || r.args.CloseMode == "reset":
+	case tlsconn != nil:
+		quit = tlsconn
+	case setup == "starttls":
+		quit = conn
+	}
+	// set once the session's been ended already, with --quit-policy per-command
+	var ended bool
+	defer func() {
+		if r.idle != nil && setup == "" && r.idle.wait(tlsconn, rd, r.args.IdleQuit) {
+			// the server hung up first, so there's no one to say goodbye to
+			quit, ended = nil, true
+		}
+		if r.cleanup != nil && setup == "" && !ended {
+			r.cleanup.send(tlsconn, rd, r.args.MaxLine, cleanupBy(r))
+		}
+		if quit != nil {
+			bound(r, conn.SetWriteDeadline, r.args.WriteTO)
+			quit.Write([]byte("QUIT\r\n"))
+			if stopped(r) && rd != nil {
+				// draining: wait for the answer so the server is done with
+				// the connection before it's closed
+				conn.SetReadDeadline(r.drain.quitBy())
+				cosign.ReadLine(rd, r.args.MaxLine)
+			}
+		}
+	}()
+
+	if first == 1 && r.prewarm != nil {
+		// --prewarm: hold the first command until every worker is
+		// connected, and leave setting up out of its latency
+		r.prewarm.Done()
+		if setup == "" {
+			<-r.started
+			start, ph = time.Now(), phases{}
+		}
+	}
+
+	if setup != "" {
+		emit(result{status: status, elapsed: time.Since(start), time: start, phases: ph, setup: setup})
+		return first, false
+	}
+
+	// set when the last response calls for a --branch command
+	var next *command
+
+	// commands written but not answered yet; only ever more than one with
+	// --pipeline
+	var inflight []pending
+
+	// drain reads the responses to everything in flight, in the order the
+	// commands were sent. If the connection can't be used any more it
+	// returns false and the iteration to carry on from on a new one.
+	drain := func() (int, bool) {
+		for n := range inflight {
+			bound(r, conn.SetReadDeadline, r.args.ReadTO)
+			first := firstByte(r, rd)
+			message, err := cosign.ReadLine(rd, r.args.MaxLine)
+			bound(r, conn.SetReadDeadline, 0)
+			if r.args.Multiplex {
+				// responses can come back in any order, so find whose it is
+				match(inflight[n:], message)
+			}
+			c := inflight[n]
+			c.first = first
+			ph.command = time.Since(c.sent)
+			if err != nil {
+				// we've lost our place in the stream, or the connection's
+				// gone; start over on a new one
+				inflight = nil
+				if timedOut(r, err) && retrying(r, c.i, c.start) {
+					return c.i, false
+				}
+				status := lostConnection(r, err)
+				emit(result{status: status, elapsed: time.Since(c.start), iteration: c.i, requestID: c.id, time: c.start, phases: ph})
+				return c.i + 1, false
+			}
+
+			res := respond(r, c, message, ph, tlsconn.ConnectionState().Version)
+			next = c.cmd.next(res.code)
+			emit(res)
+			ph = phases{}
+
+			if r.args.QuitPolicy == "per-command" {
+				// wait for the server to acknowledge, so it has finished with
+				// the connection before we open the next one
+				if r.cleanup != nil {
+					r.cleanup.send(tlsconn, rd, r.args.MaxLine, cleanupBy(r))
+				}
+				bound(r, conn.SetDeadline, r.args.ReadTO)
+				tlsconn.Write([]byte("QUIT\r\n"))
+				cosign.ReadLine(rd, r.args.MaxLine)
+				bound(r, conn.SetDeadline, 0)
+				quit, ended = nil, true
+			}
+
+			// back off exponentially while the server says it's overloaded
+			if res.backoff {
+				if *r.backoff == 0 {
+					*r.backoff = r.args.BackoffStart
+				}
+				pause(r, tlsconn, rd, *r.backoff)
+				if *r.backoff *= 2; *r.backoff > r.args.BackoffMax {
+					*r.backoff = r.args.BackoffMax
+				}
+			} else {
+				*r.backoff = 0
+			}
+
+			// idle between bursts, outside of the timed window
+			if r.args.Profile == "burst" && c.i%r.args.BurstSize == 0 {
+				pause(r, tlsconn, rd, r.args.BurstGap)
+			}
+			if r.args.ThinkTime > 0 {
+				pause(r, tlsconn, rd, thinkTime(r.args))
+			}
+		}
+		inflight = inflight[:0]
+		return 0, true
+	}
+
+	i := first
+	for ; r.jobs != nil || r.args.Iterations == 0 || i <= r.args.Iterations; i++ {
+		if stopped(r) {
+			break
+		}
+		if r.args.ConnCommands > 0 && i-first >= r.args.ConnCommands {
+			if j, ok := drain(); !ok {
+				return j, true
+			}
+			return i, true
+		}
+		if r.budget != nil && atomic.AddInt64(r.budget, -1) < 0 {
+			break
+		}
+		if r.args.ByteBudget > 0 && atomic.LoadInt64(r.bytes) >= r.args.ByteBudget {
+			break
+		}
+		if r.args.TargetOK > 0 && atomic.LoadInt64(r.successes) >= r.args.TargetOK || tooManyErrors(r) || timeUp(r) {
+			break
+		}
+		if r.limiter != nil {
+			// don't count time spent waiting on the limiter
+			wait := time.Now()
+			idle(r, tlsconn, rd, r.limiter)
+			start = start.Add(time.Since(wait))
+			if timeUp(r) {
+				break
+			}
+		}
+		if r.jobs != nil {
+			// open model: time from when the command was scheduled, so any
+			// queueing behind a slow server is counted
+			t, ok := idle(r, tlsconn, rd, r.jobs)
+			if !ok {
+				break
+			}
+			start = t
+		}
+
+		// send command
+		var cmd command
+		n := i - 1 - *r.branched + r.offset
+		if next != nil {
+			cmd, next = *next, nil
+			*r.branched++
+		} else {
+			cmd = r.commands[n%len(r.commands)]
+		}
+		id := fmt.Sprintf("%s-%d", r.runID, atomic.AddInt64(r.ids, 1))
+		line := cmd.render(commandData{RequestID: id, Worker: w, Iteration: i, runID: r.runID, pass: n / len(r.commands)})
+		if !cmd.raw {
+			line += "\r\n"
+		}
+		if rt := r.retry; rt != nil && rt.i == i && rt.n > 0 {
+			// a retry is timed from the first attempt
+			start = rt.start
+		}
+		sent := time.Now()
+		bound(r, conn.SetWriteDeadline, r.args.WriteTO)
+		err := writeAll(tlsconn, []byte(line))
+		bound(r, conn.SetWriteDeadline, 0)
+		if err != nil {
+			// the connection's broken, so anything still in flight is lost
+			if timedOut(r, err) && retrying(r, i, start) {
+				return i, true
+			}
+			emit(result{status: writeFailure(r, err), elapsed: time.Since(start), iteration: i, requestID: id, script: cmd.script, time: start, phases: ph})
+			return i + 1, true
+		}
+		inflight = append(inflight, pending{cmd: cmd, i: i, id: id, start: start, sent: sent, token: token(r, line, id)})
+
+		// with --pipeline keep writing until there are that many
+		// outstanding, then collect all the responses
+		if len(inflight) >= r.args.Pipeline {
+			if j, ok := drain(); !ok {
+				return j, true
+			}
+		}
+		start = time.Now()
+	}
+	if j, ok := drain(); !ok {
+		return j, true
+	}
+	return i, false
+}
+
+// closed says whether err is the server closing the connection on us
+func closed(err error) bool {
+	return errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF)
+}
+
+// lostConnection is the status for a command whose response couldn't be
+// read, which leaves the connection unusable
+func lostConnection(r request, err error) string {
+	switch {
+	case err == cosign.ErrLineTooLong:
+		return protoViolation(r.args)
+	case closed(err):
+		return fmt.Sprintf("COMMANDEOF server closed the connection mid-command: %s", err)
+	case timedOut(r, err):
+		return fmt.Sprintf("TIMEOUT read no response after %s", r.args.ReadTO)
+	case renegotiation(err):
+		return fmt.Sprintf("RENEGOTIATION %s", err)
+	}
+	return fmt.Sprintf("READFAIL %s", err)
+}
+
+// writeFailure is the status for a write that failed with err
+func writeFailure(r request, err error) string {
+	if timedOut(r, err) {
+		return fmt.Sprintf("TIMEOUT write blocked for %s", r.args.WriteTO)
+	}
+	return fmt.Sprintf("WRITEFAIL %s", err)
+}
+
+func protoViolation(args Args) string {
+	return fmt.Sprintf("PROTOVIOLATION line exceeds %d bytes", args.MaxLine)
+}
+
+// clockOffset parses the server's unix time from a TIME response and returns
+// how far ahead of our clock it is, assuming it was read halfway through the
+// round trip
+func clockOffset(message string, sent time.Time, rtt time.Duration) (time.Duration, bool) {
+	f := strings.Fields(message)
+	if len(f) < 2 {
+		return 0, false
+	}
+	secs, err := strconv.ParseFloat(f[1], 64)
+	if err != nil {
+		return 0, false
+	}
+	server := time.Unix(0, int64(secs*float64(time.Second)))
+	if !strings.Contains(f[1], ".") {
+		// whole seconds are truncated, so the best guess is the middle of it
+		server = server.Add(time.Second / 2)
+	}
+	return server.Sub(sent.Add(rtt / 2)), true
+}
+
+// renegotiation reports whether err is from the server asking to renegotiate
+// when --renegotiation doesn't allow it. Go refuses with a no_renegotiation
+// alert, which otherwise just looks like a broken connection.
+func renegotiation(err error) bool {
+	return err != nil && strings.Contains(err.Error(), "renegotiation")
+}
+
+// countingConn adds the bytes read and written on a connection to n, for
+// --byte-budget
+type countingConn struct {
+	net.Conn
+	n *int64
+}
+
+func (c *countingConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	atomic.AddInt64(c.n, int64(n))
+	return n, err
+}
+
+func (c *countingConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	atomic.AddInt64(c.n, int64(n))
+	return n, err
+}
+
+// establish reads the greeting, does STARTTLS and the TLS handshake and sends
+// any --preamble, filling in the time each step took in ph. Time spent
+// waiting for a --slow-start slot or on the preamble is taken off by moving
+// start on. If a step fails it returns the phase it failed in and why, with
+// tlsconn only set if the handshake had completed.
+func establish(conn net.Conn, tlsconfig *tls.Config, r request, start *time.Time, ph *phases) (tlsconn *tls.Conn, rd *bufio.Reader, setup, status string) {
+	mark := time.Now()
+	rd = bufio.NewReader(conn)
+	// the greeting can be slow to arrive, or come in pieces, from a busy
+	// server, so give it a while on its own
+	if r.args.GreetingTO > 0 {
+		conn.SetReadDeadline(mark.Add(r.args.GreetingTO))
+	}
+	message, err := cosign.ReadLine(rd, r.args.MaxLine)
+	conn.SetReadDeadline(time.Time{})
+	ph.greeting = time.Since(mark)
+	ph.starttls = ph.greeting
+	if err == cosign.ErrLineTooLong {
+		return nil, nil, "starttls", protoViolation(r.args)
+	}
+	if errors.Is(err, os.ErrDeadlineExceeded) {
+		return nil, nil, "starttls", fmt.Sprintf("GREETINGTIMEOUT no greeting after %s, got %q", r.args.GreetingTO, message)
+	}
+	if code, _ := cosign.SplitStatus(message); code != "220" {
+		return nil, nil, "starttls", fmt.Sprintf("BADRESPONSE %s", message)
+	}
+
+	// ask to STARTTLS
+	bound(r, conn.SetWriteDeadline, r.args.WriteTO)
+	err = writeAll(conn, []byte("STARTTLS 2\r\n"))
+	bound(r, conn.SetWriteDeadline, 0)
+	if err != nil {
+		return nil, nil, "starttls", writeFailure(r, err)
+	}
+	bound(r, conn.SetReadDeadline, r.args.ReadTO)
+	message, err = cosign.ReadLine(rd, r.args.MaxLine)
+	// some versions answer with several lines, NNN-... up to a last NNN ...
+	for line := message; err == nil && cosign.Continued(line); message += line {
+		line, err = cosign.ReadLine(rd, r.args.MaxLine)
+	}
+	bound(r, conn.SetReadDeadline, 0)
+	ph.starttls = time.Since(mark)
+	if err == cosign.ErrLineTooLong {
+		return nil, nil, "starttls", protoViolation(r.args)
+	}
+	if errors.Is(err, os.ErrDeadlineExceeded) {
+		return nil, nil, "starttls", fmt.Sprintf("TIMEOUT starttls no response after %s", r.args.ReadTO)
+	}
+	if closed(err) {
+		return nil, nil, "starttls", fmt.Sprintf("STARTTLS EOF server closed the connection before answering STARTTLS: %s", err)
+	}
+	if err != nil {
+		return nil, nil, "starttls", fmt.Sprintf("STARTTLS FAIL %s", err)
+	}
+	if !starttlsOK(r.args, message) {
+		return nil, nil, "starttls", message
+	}
+
+	// create new tls Conn and do tls handshake
+	tlsconn = tls.Client(conn, tlsconfig)
+	if r.handshake != nil {
+		// wait for a free handshake slot, off the clock
+		wait := time.Now()
+		r.handshake <- struct{}{}
+		*start = start.Add(time.Since(wait))
+	}
+	mark = time.Now()
+	// a server too busy to finish handshakes stalls rather than refusing,
+	// so that's told apart from a rejected one. The deadline covers the
+	// banner as well, since with TLS 1.3 the client cert is only checked
+	// after our side of the handshake is done.
+	if r.args.HandshakeTO > 0 {
+		conn.SetDeadline(mark.Add(r.args.HandshakeTO))
+	}
+	err = tlsconn.Handshake()
+	if r.handshake != nil {
+		<-r.handshake
+	}
+	if err != nil {
+		conn.SetDeadline(time.Time{})
+		ph.handshake = time.Since(mark)
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			return nil, nil, "handshake", fmt.Sprintf("HANDSHAKETIMEOUT no handshake after %s", r.args.HandshakeTO)
+		}
+		if closed(err) {
+			// the server hung up on us, typically over our cert or
+			// parameters, rather than falling over mid-command
+			return nil, nil, "handshake", fmt.Sprintf("HANDSHAKEEOF server closed the connection during the handshake: %s", err)
+		}
+		return nil, nil, "handshake", fmt.Sprintf("HANDSHAKE FAIL %s: %s", handshakeFailure(err), err)
+	}
+	rd = bufio.NewReader(tlsconn)
+	// need to read cosignd's response to the starttls
+	_, err = cosign.ReadLine(rd, r.args.MaxLine)
+	conn.SetDeadline(time.Time{})
+	ph.handshake = time.Since(mark)
+	if err == cosign.ErrLineTooLong {
+		return tlsconn, rd, "handshake", protoViolation(r.args)
+	}
+	if errors.Is(err, os.ErrDeadlineExceeded) {
+		return tlsconn, rd, "handshake", fmt.Sprintf("HANDSHAKETIMEOUT no banner after %s", r.args.HandshakeTO)
+	}
+	if renegotiation(err) {
+		return tlsconn, rd, "handshake", fmt.Sprintf("RENEGOTIATION %s", err)
+	}
+	if closed(err) {
+		return tlsconn, rd, "handshake", fmt.Sprintf("HANDSHAKEEOF server closed the connection before its banner: %s", err)
+	}
+	var opErr *net.OpError
+	if errors.As(err, &opErr) && opErr.Op == "remote error" {
+		// with TLS 1.3 the server only checks our cert after our side of
+		// the handshake is done, so if it's rejected the alert turns up here
+		return tlsconn, rd, "handshake", fmt.Sprintf("HANDSHAKE FAIL %s: %s", handshakeFailure(err), err)
+	}
+	if r.resumed != nil && tlsconn.ConnectionState().DidResume {
+		atomic.AddInt64(r.resumed, 1)
+	}
+	if r.curves != nil {
+		r.curves.add(tlsconn.ConnectionState())
+	}
+	if r.negotiated != nil {
+		r.negotiated.add(tlsconn.ConnectionState())
+	}
+	r.server.once.Do(func() { r.server.inspect(r.args, tlsconn.ConnectionState()) })
+
+	if r.preamble != nil {
+		// timed on its own and left out of the first command's latency
+		mark = time.Now()
+		if err := writeAll(tlsconn, []byte(r.preamble.render(commandData{})+"\r\n")); err != nil {
+			return tlsconn, rd, "preamble", fmt.Sprintf("WRITEFAIL %s", err)
+		}
+		message, err = cosign.ReadLine(rd, r.args.MaxLine)
+		ph.preamble = time.Since(mark)
+		*start = start.Add(ph.preamble)
+		if err == cosign.ErrLineTooLong {
+			return tlsconn, rd, "preamble", protoViolation(r.args)
+		}
+		if res := classify(*r.preamble, message); !res.success {
+			return tlsconn, rd, "preamble", fmt.Sprintf("PREAMBLEFAIL %s", message)
+		}
+	}
+	return tlsconn, rd, "", ""
+}
+
+// starttlsOK says whether the response to STARTTLS has one of the
+// --starttls-ok-codes, 220 if none were given. Only the code counts, so
+// "220 Ready", "220 2.0.0 go ahead" and a multi-line 220-... all match 220.
+func starttlsOK(args Args, message string) bool {
+	code := message
+	if i := strings.IndexAny(message, " -\r\n"); i >= 0 {
+		code = message[:i]
+	}
+	if len(args.STARTTLSOK) == 0 {
+		return code == "220"
+	}
+	for _, ok := range args.STARTTLSOK {
+		if code == ok {
+			return true
+		}
+	}
+	return false
+}
+
+// stagger is where worker w starts in the command sequence, which is
+// different for each worker with --stagger-commands
+func stagger(r request, w int) int {
+	if !r.args.Stagger {
+		return 0
+	}
+	return (w - 1) % len(r.commands)
+}
+
+// match moves the command that message answers to the front of inflight,
+// going by the token echoed back in it. If it doesn't answer any of them the
+// order is left alone, and respond will call it UNMATCHED.
+func match(inflight []pending, message string) {
+	for j, c := range inflight {
+		if c.token != "" && strings.Contains(message, c.token) {
+			inflight[0], inflight[j] = inflight[j], inflight[0]
+			return
+		}
+	}
+}
+
+// pending is a command that has been written but not answered yet
+type pending struct {
+	cmd   command
+	i     int
+	id    string
+	start time.Time
+	sent  time.Time
+	first time.Time // when its response started to arrive, with --latency-window wire
+	token string    // to look for in the response, with --check-order
+}
+
+// firstByte waits for the next response to start arriving and returns when
+// it did, for --latency-window wire, or the zero time otherwise. Over TLS
+// that's when its first record has been read and decrypted.
+func firstByte(r request, rd *bufio.Reader) time.Time {
+	if r.args.Latency != "wire" {
+		return time.Time{}
+	}
+	rd.Peek(1)
+	return time.Now()
+}
+
+// token is what to expect echoed back in the response to line with
+// --check-order or --multiplex: its request id, if the id was sent
+func token(r request, line, id string) string {
+	if (r.args.CheckOrder || r.args.Multiplex) && strings.Contains(line, id) {
+		return id
+	}
+	return ""
+}
+
+// respond builds the result for the response message to c over a
+// connection that negotiated TLS version. ph holds the phase timings to
+// report with it, with the command round trip filled in.
+func respond(r request, c pending, message string, ph phases, version uint16) result {
+	res := classify(c.cmd, message)
+	res.size = len(message)
+	res.elapsed = time.Since(c.start)
+	if r.args.Latency == "wire" {
+		// just the server's share, from the write to the first of the
+		// response
+		res.elapsed = c.first.Sub(c.sent)
+	}
+	slow := r.args.SlowCommand
+	if c.cmd.timeout > 0 {
+		slow = c.cmd.timeout
+	}
+	if res.success && slow > 0 && res.elapsed > slow {
+		// a real client would have given up by now
+		res.success = false
+		res.status = fmt.Sprintf("SLOW %s", message)
+	}
+	if res.success && r.expectRE != nil && !r.expectRE.MatchString(strings.TrimRight(message, "\r\n")) {
+		res.success = false
+		res.status = fmt.Sprintf("RESPONSEMISMATCH %s", message)
+	}
+	if res.success && c.cmd.verb() == "CHECK" && (res.code == "231" || res.code == "232") {
+		if status := checkAssertions(r.args, res.message, message); status != "" {
+			res.success = false
+			res.status = status
+		}
+	}
+	if res.success && c.token != "" && !strings.Contains(message, c.token) {
+		// this is the answer to some other command
+		res.success = false
+		res.status = fmt.Sprintf("OUTOFORDER expected %s %s", c.token, message)
+		if r.args.Multiplex {
+			res.status = fmt.Sprintf("UNMATCHED %s", message)
+		}
+	}
+	if res.success && version < r.minTLS {
+		// the command worked but the server shouldn't have let us in
+		res.success = false
+		res.status = fmt.Sprintf("WEAKTLS %s below %s %s", tls.VersionName(version), tls.VersionName(r.minTLS), message)
+	}
+	res.iteration = c.i
+	res.requestID = c.id
+	res.command = c.cmd.verb()
+	res.script = c.cmd.script
+	res.time = c.start
+	res.phases = ph
+	res.backoff = backoffCode(r.args, res.code)
+	if r.args.MeasureSkew && res.success {
+		res.offset, res.hasOffset = clockOffset(message, c.sent, ph.command)
+	}
+	return res
+}
+
+// writeAll writes all of b, carrying on after short writes, so a command is
+// never sent truncated
+func writeAll(w io.Writer, b []byte) error {
+	for len(b) > 0 {
+		n, err := w.Write(b)
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			return io.ErrShortWrite
+		}
+		b = b[n:]
+	}
+	return nil
+}
+
+// backoffCode reports whether code is one of --backoff-codes
+func backoffCode(args Args, code string) bool {
+	for _, c := range args.BackoffCodes {
+		if c == code {
+			return true
+		}
+	}
+	return false
+}
+
+// classify checks a response line against the codes expected for cmd
+func classify(cmd command, message string) result {
+	code, line := cosign.SplitStatus(message)
+	if cmd.expect[code] {
+		return result{success: true, status: fmt.Sprintf("SUCCESS %s", message), code: code, message: line}
+	}
+	return result{status: fmt.Sprintf("FAILRESPONSE %s", message), code: code, message: line}
+}
+
+// dialFailure maps an error from connecting to a category, since a refused
+// connection, a timeout, a missing route and a failed lookup all have very
+// different causes
+func dialFailure(err error) string {
+	var dnsErr *net.DNSError
+	var netErr net.Error
+	switch {
+	case errors.Is(err, errPortsExhausted):
+		return "PORTSEXHAUSTED"
+	case errors.As(err, &dnsErr):
+		return "DNSFAIL"
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return "CONNREFUSED"
+	case errors.Is(err, syscall.EHOSTUNREACH), errors.Is(err, syscall.ENETUNREACH):
+		return "NOROUTE"
+	case errors.Is(err, syscall.ETIMEDOUT), errors.As(err, &netErr) && netErr.Timeout():
+		return "CONNTIMEOUT"
+	}
+	return "NOCONN"
+}
+
+// handshakeFailure maps an error from tls.Conn.Handshake() to a short
+// description of why the handshake failed
+func handshakeFailure(err error) string {
+	var unknownAuthority x509.UnknownAuthorityError
+	var invalid x509.CertificateInvalidError
+	var hostname x509.HostnameError
+	var recordHeader tls.RecordHeaderError
+	var opErr *net.OpError
+
+	switch {
+	case errors.As(err, &unknownAuthority):
+		return "unknown CA"
+	case errors.As(err, &invalid) && invalid.Reason == x509.Expired:
+		return "cert expired"
+	case errors.As(err, &invalid):
+		return "cert invalid"
+	case errors.As(err, &hostname):
+		return "hostname mismatch"
+	case errors.As(err, &recordHeader):
+		return "not TLS"
+	case errors.Is(err, io.EOF):
+		return "connection closed"
+	case strings.Contains(err.Error(), "protocol version"):
+		return "protocol mismatch"
+	case errors.As(err, &opErr) && opErr.Op == "remote error":
+		// alerts sent by the server, eg. "tls: handshake failure"
+		return "alert " + strings.TrimPrefix(opErr.Err.Error(), "tls: ")
+	}
+	return "other"
+}
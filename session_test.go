@@ -0,0 +1,203 @@
+package cosignperf
+
+import (
+	"bufio"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeCosignd is a scripted cosignd for testing the session against. An
+// empty greeting means it never sends one, an empty reply that it never
+// answers the command, and hangUp that it closes the connection instead,
+// or resets it with reset.
+type fakeCosignd struct {
+	greeting string
+	starttls string
+	reply    string
+	hangUp   bool
+	reset    bool
+}
+
+// start serves f on 127.0.0.1 until the test is over and returns its port
+func (f fakeCosignd) start(t *testing.T) int {
+	t.Helper()
+	cert, err := selfSigned()
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := &tls.Config{Certificates: []tls.Certificate{cert}}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go f.serve(conn, config)
+		}
+	}()
+	return l.Addr().(*net.TCPAddr).Port
+}
+
+func (f fakeCosignd) serve(conn net.Conn, config *tls.Config) {
+	defer conn.Close()
+	// waiting on the client to give up and close
+	hang := func(r io.Reader) { io.Copy(io.Discard, r) }
+	if f.greeting == "" {
+		hang(conn)
+		return
+	}
+	fmt.Fprint(conn, f.greeting)
+	rd := bufio.NewReader(conn)
+	if _, err := rd.ReadString('\n'); err != nil {
+		return
+	}
+	fmt.Fprint(conn, f.starttls)
+	if !strings.HasPrefix(f.starttls, "220") {
+		return
+	}
+	t := tls.Server(conn, config)
+	if err := t.Handshake(); err != nil {
+		return
+	}
+	fmt.Fprint(t, "220 2 Collaborative Web Single Sign-On [COSIGNv3]\r\n")
+	rd = bufio.NewReader(t)
+	for {
+		line, err := rd.ReadString('\n')
+		if err != nil {
+			return
+		}
+		switch {
+		case strings.HasPrefix(line, "QUIT"):
+			fmt.Fprint(t, "221 bye\r\n")
+			return
+		case f.hangUp:
+			return
+		case f.reset:
+			conn.(*net.TCPConn).SetLinger(0)
+			return
+		case f.reply == "":
+			hang(rd)
+			return
+		}
+		fmt.Fprint(t, f.reply)
+	}
+}
+
+// results is a sink that keeps every result
+type results []result
+
+func (rs *results) write(r result) { *rs = append(*rs, r) }
+func (rs *results) close() error   { return nil }
+
+// testRequest is a request for a run against 127.0.0.1:port, set up the
+// way main would with args
+func testRequest(t *testing.T, args Args, port int) request {
+	t.Helper()
+	args.Hostname, args.Port = "127.0.0.1", []int{port}
+	if args.Threads == 0 {
+		args.Threads, args.Iterations = 1, 1
+	}
+	args.SslSkipVerify, args.Quiet = true, true
+	cert, err := selfSigned()
+	if err != nil {
+		t.Fatal(err)
+	}
+	commands, preamble, err := parseCommands(args)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certs := []tls.Certificate{cert}
+	return request{
+		tlsconfig: &tls.Config{InsecureSkipVerify: true, Certificates: certs},
+		args:      args,
+		commands:  commands,
+		preamble:  preamble,
+		certs:     certs,
+		runID:     newRunID(),
+		server:    &serverInfo{},
+	}
+}
+
+func TestSession(t *testing.T) {
+	const greeting = "220 2 Collaborative Web Single Sign-On\r\n"
+	tests := []struct {
+		name    string
+		server  fakeCosignd
+		success bool
+		code    string
+		setup   string // phase setup should have failed in
+		status  string // start of the status
+	}{
+		{"command", fakeCosignd{greeting: greeting, starttls: "220 Ready to start TLS\r\n", reply: "250 Cosign v3 NOOP\r\n"},
+			true, "250", "", "SUCCESS 250"},
+		{"multi-line STARTTLS", fakeCosignd{greeting: greeting, starttls: "220-Ready\r\n220 go ahead\r\n", reply: "250 Cosign v3 NOOP\r\n"},
+			true, "250", "", "SUCCESS 250"},
+		{"failure response", fakeCosignd{greeting: greeting, starttls: "220 Ready\r\n", reply: "510 unknown command\r\n"},
+			false, "510", "", "FAILRESPONSE 510"},
+		{"no greeting", fakeCosignd{},
+			false, "", "starttls", "GREETINGTIMEOUT"},
+		{"greeting not 220", fakeCosignd{greeting: "421 busy\r\n"},
+			false, "", "starttls", "BADRESPONSE 421"},
+		{"closed before STARTTLS answer", fakeCosignd{greeting: greeting, hangUp: true},
+			false, "", "starttls", "STARTTLS EOF"},
+		{"STARTTLS refused", fakeCosignd{greeting: greeting, starttls: "502 no TLS\r\n"},
+			false, "", "starttls", "502 no TLS"},
+		{"no response", fakeCosignd{greeting: greeting, starttls: "220 Ready\r\n"},
+			false, "", "", "TIMEOUT read"},
+		{"closed mid-command", fakeCosignd{greeting: greeting, starttls: "220 Ready\r\n", hangUp: true},
+			false, "", "", "COMMANDEOF"},
+		{"reset mid-command", fakeCosignd{greeting: greeting, starttls: "220 Ready\r\n", reset: true},
+			false, "", "", "READFAIL"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			args := defaultArgs()
+			args.GreetingTO, args.ReadTO = 200*time.Millisecond, 200*time.Millisecond
+			var rs results
+			rep := run(testRequest(t, args, tt.server.start(t)), &rs)
+			if len(rs) != 1 {
+				t.Fatalf("got %d results, want 1: %+v", len(rs), rs)
+			}
+			r := rs[0]
+			if r.success != tt.success || r.code != tt.code || r.setup != tt.setup || !strings.HasPrefix(r.status, tt.status) {
+				t.Errorf("got success %t, code %q, setup %q, status %q; want %t, %q, %q, %q...",
+					r.success, r.code, r.setup, r.status, tt.success, tt.code, tt.setup, tt.status)
+			}
+			if tt.success && (rep.ns != 1 || rep.nf != 0) || !tt.success && (rep.ns != 0 || rep.nf != 1) {
+				t.Errorf("report has SUCCESS/FAIL %d/%d", rep.ns, rep.nf)
+			}
+		})
+	}
+}
+
+func TestStarttlsOK(t *testing.T) {
+	tests := []struct {
+		message string
+		ok      []string
+		want    bool
+	}{
+		{"220 Ready\r\n", nil, true},
+		{"220-Ready\r\n220 go ahead\r\n", nil, true},
+		{"220 2.0.0 go ahead\r\n", nil, true},
+		{"502 no\r\n", nil, false},
+		{"250 ok\r\n", []string{"250"}, true},
+		{"220 Ready\r\n", []string{"250"}, false},
+	}
+	for _, tt := range tests {
+		args := defaultArgs()
+		args.STARTTLSOK = tt.ok
+		if got := starttlsOK(args, tt.message); got != tt.want {
+			t.Errorf("starttlsOK(%q) with %v = %t, want %t", tt.message, tt.ok, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,538 @@
+package cosignperf
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"github.com/alexflint/go-arg"
+	"io"
+	"log"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// schemaVersion is written into every machine-readable output. Bump it
+// whenever a field is removed, renamed or changes meaning; adding a field
+// doesn't need a bump.
+const schemaVersion = 1
+
+// tag is a --tag key=value attached to every output of the run
+type tag struct {
+	key, value string
+}
+
+// tags are the --tag values, in the order given
+var tags []tag
+
+var tagKey = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+// parseTags parses --tag values. Keys have to be valid Prometheus label
+// names since they're used as labels there.
+func parseTags(list []string) ([]tag, error) {
+	var parsed []tag
+	seen := make(map[string]bool)
+	for _, t := range list {
+		k, v, ok := strings.Cut(t, "=")
+		if !ok || !tagKey.MatchString(k) {
+			return nil, fmt.Errorf("invalid --tag %q, want key=value with a key of letters, digits and _", t)
+		}
+		if seen[k] || k == "result" || k == "le" {
+			return nil, fmt.Errorf("--tag %s is repeated or reserved", k)
+		}
+		seen[k] = true
+		parsed = append(parsed, tag{k, v})
+	}
+	return parsed, nil
+}
+
+// tagMap returns tags as a map for JSON output, or nil if there are none
+func tagMap() map[string]string {
+	if len(tags) == 0 {
+		return nil
+	}
+	m := make(map[string]string)
+	for _, t := range tags {
+		m[t.key] = t.value
+	}
+	return m
+}
+
+// sink receives every result as it is collected, for writing out per-request
+// detail alongside the summary
+type sink interface {
+	write(r result)
+	close() error
+}
+
+// openSinks creates the per-request outputs enabled in args. sl and db are
+// the syslog connection and SQLite database, if any, which are only used here
+// for --syslog-events and --sqlite-requests.
+func openSinks(p *arg.Parser, args Args, runID string, sl *syslogWriter, db *sqliteWriter) []sink {
+	var sinks []sink
+	if args.VegetaOutput != "" {
+		w, err := newVegetaWriter(args.VegetaOutput, args, runID)
+		if err != nil {
+			p.Fail(err.Error())
+		}
+		sinks = append(sinks, w)
+	}
+	if sl != nil && args.SyslogEvents {
+		sinks = append(sinks, sl)
+	}
+	if db != nil && args.SqliteReqs {
+		sinks = append(sinks, db)
+	}
+	if args.RawOutput != "" {
+		gz := args.RawOutputGzip || strings.HasSuffix(args.RawOutput, ".gz")
+		w, err := newRawWriter(args.RawOutput, gz, args)
+		if err != nil {
+			p.Fail(err.Error())
+		}
+		sinks = append(sinks, w)
+	}
+	if args.BinaryOutput != "" {
+		w, err := newBinaryWriter(args.BinaryOutput, args)
+		if err != nil {
+			p.Fail(err.Error())
+		}
+		sinks = append(sinks, w)
+	}
+	if args.PhaseTrace != "" {
+		w, err := newPhaseWriter(args.PhaseTrace, args)
+		if err != nil {
+			p.Fail(err.Error())
+		}
+		sinks = append(sinks, w)
+	}
+	if args.LatencyFile != "" {
+		w, err := newLatencyWriter(args.LatencyFile, args)
+		if err != nil {
+			p.Fail(err.Error())
+		}
+		sinks = append(sinks, w)
+	}
+	if args.ErrorLog != "" {
+		w, err := newErrorWriter(args.ErrorLog, args)
+		if err != nil {
+			p.Fail(err.Error())
+		}
+		sinks = append(sinks, w)
+	}
+	if args.PromTextfile != "" || args.Pushgateway != "" {
+		sinks = append(sinks, newPromWriter(args.PromTextfile, args.Pushgateway, args.PromExemplars))
+	}
+	if exporter != nil {
+		sinks = append(sinks, exporter)
+	}
+	return sinks
+}
+
+func closeSinks(sinks []sink) {
+	for _, s := range sinks {
+		if err := s.close(); err != nil {
+			log.Printf("%s\n", err)
+		}
+	}
+}
+
+type rawRecord struct {
+	Schema    int               `json:"schema_version"`
+	Time      time.Time         `json:"time"`
+	Worker    int               `json:"worker"`
+	Iteration int               `json:"iteration"`
+	Success   bool              `json:"success"`
+	Status    string            `json:"status"`
+	Code      string            `json:"code,omitempty"`
+	Message   string            `json:"message,omitempty"`
+	Size      int               `json:"response_bytes,omitempty"`
+	ElapsedNs int64             `json:"elapsed_ns"`
+	SNI       string            `json:"sni,omitempty"`
+	RequestID string            `json:"request_id,omitempty"`
+	Warmup    bool              `json:"warmup,omitempty"`
+	Cooldown  bool              `json:"cooldown,omitempty"`
+	Retries   int               `json:"retries,omitempty"`
+	Tags      map[string]string `json:"tags,omitempty"`
+	Host      string            `json:"host,omitempty"`
+	Port      int               `json:"port,omitempty"`
+	Family    string            `json:"family,omitempty"`
+	Setup     string            `json:"setup_failed,omitempty"`
+	Phases    *rawPhases        `json:"phases,omitempty"`
+}
+
+// rawPhases is a raw record's phases, left out when they're all 0
+type rawPhases struct {
+	Connect   int64 `json:"connect_ns,omitempty"`
+	Starttls  int64 `json:"starttls_ns,omitempty"`
+	Greeting  int64 `json:"greeting_ns,omitempty"`
+	Handshake int64 `json:"handshake_ns,omitempty"`
+	Preamble  int64 `json:"preamble_ns,omitempty"`
+	Command   int64 `json:"command_ns,omitempty"`
+}
+
+// rawWriter streams results as NDJSON from its own goroutine so a slow disk
+// doesn't hold up the collector
+type rawWriter struct {
+	resultc chan result
+	done    chan error
+}
+
+func newRawWriter(path string, gz bool, args Args) (*rawWriter, error) {
+	f, err := createOutput(path, args)
+	if err != nil {
+		return nil, err
+	}
+
+	w := &rawWriter{resultc: make(chan result, 1024), done: make(chan error)}
+	go func() {
+		var zw *gzip.Writer
+		var buf *bufio.Writer
+		var enc *json.Encoder
+		begin := func() {
+			var out io.Writer = f
+			if gz {
+				// a gzip file per rotation, each complete on its own
+				zw = gzip.NewWriter(f)
+				out = zw
+			}
+			buf = bufio.NewWriter(out)
+			enc = json.NewEncoder(buf)
+		}
+		// end flushes everything down to the file
+		end := func() error {
+			err := buf.Flush()
+			if zw != nil {
+				if zerr := zw.Close(); err == nil {
+					err = zerr
+				}
+			}
+			return err
+		}
+		begin()
+
+		t := tagMap()
+		var werr error
+		for r := range w.resultc {
+			if werr != nil {
+				continue
+			}
+			var ph *rawPhases
+			if p := r.phases; p != (phases{}) {
+				ph = &rawPhases{int64(p.connect), int64(p.starttls), int64(p.greeting), int64(p.handshake), int64(p.preamble), int64(p.command)}
+			}
+			werr = enc.Encode(rawRecord{
+				Schema:    schemaVersion,
+				Time:      r.time,
+				Worker:    r.worker,
+				Iteration: r.iteration,
+				Success:   r.success,
+				Status:    strings.TrimSpace(r.status),
+				Code:      r.code,
+				Message:   r.message,
+				Size:      r.size,
+				ElapsedNs: int64(r.elapsed),
+				SNI:       r.sni,
+				RequestID: r.requestID,
+				Warmup:    r.warmup,
+				Cooldown:  r.cooldown,
+				Retries:   r.retries,
+				Tags:      t,
+				Host:      r.host,
+				Port:      r.port,
+				Family:    r.family,
+				Setup:     r.setup,
+				Phases:    ph,
+			})
+			// what's still in the gzip writer can't be counted, so
+			// compressed files come out a little over --rotate-size
+			pending := buf.Buffered()
+			if gz {
+				pending = 0
+			}
+			if werr == nil && f.due(pending) {
+				if werr = end(); werr == nil {
+					werr = f.rotate()
+				}
+				begin()
+			}
+		}
+
+		// flush everything down to the file before reporting back
+		if err := end(); werr == nil {
+			werr = err
+		}
+		if err := f.Close(); werr == nil {
+			werr = err
+		}
+		w.done <- werr
+	}()
+	return w, nil
+}
+
+func (w *rawWriter) write(r result) {
+	w.resultc <- r
+}
+
+func (w *rawWriter) close() error {
+	close(w.resultc)
+	return <-w.done
+}
+
+// phaseWriter writes one CSV row per result with the time spent in each
+// protocol phase, for building waterfall/stacked charts
+type phaseWriter struct {
+	f *rotatingFile
+	w *csv.Writer
+}
+
+func newPhaseWriter(path string, args Args) (*phaseWriter, error) {
+	f, err := createOutput(path, args)
+	if err != nil {
+		return nil, err
+	}
+	p := &phaseWriter{f: f}
+	p.begin()
+	return p, nil
+}
+
+// begin starts writing to the file, with the header unless it's being
+// appended to
+func (p *phaseWriter) begin() {
+	p.w = csv.NewWriter(p.f)
+	if p.f.size > 0 {
+		return
+	}
+	header := []string{"time", "worker", "iteration", "success", "connect_ns", "starttls_ns", "handshake_ns", "preamble_ns", "command_ns", "total_ns", "schema_version", "greeting_ns"}
+	for _, t := range tags {
+		header = append(header, "tag_"+t.key)
+	}
+	p.w.Write(header)
+}
+
+func (p *phaseWriter) write(r result) {
+	row := []string{
+		r.time.Format(time.RFC3339Nano),
+		strconv.Itoa(r.worker),
+		strconv.Itoa(r.iteration),
+		strconv.FormatBool(r.success),
+		strconv.FormatInt(int64(r.phases.connect), 10),
+		strconv.FormatInt(int64(r.phases.starttls), 10),
+		strconv.FormatInt(int64(r.phases.handshake), 10),
+		strconv.FormatInt(int64(r.phases.preamble), 10),
+		strconv.FormatInt(int64(r.phases.command), 10),
+		strconv.FormatInt(int64(r.elapsed), 10),
+		strconv.Itoa(schemaVersion),
+		// added after the rest so existing columns keep their places
+		strconv.FormatInt(int64(r.phases.greeting), 10),
+	}
+	for _, t := range tags {
+		row = append(row, t.value)
+	}
+	p.w.Write(row)
+	// the csv.Writer's own buffer isn't counted, so files can come out a
+	// few KB over --rotate-size
+	if p.f.due(0) {
+		p.w.Flush()
+		if err := p.f.rotate(); err != nil {
+			log.Printf("%s\n", err)
+		}
+		p.begin()
+	}
+}
+
+func (p *phaseWriter) close() error {
+	p.w.Flush()
+	if err := p.w.Error(); err != nil {
+		p.f.Close()
+		return err
+	}
+	return p.f.Close()
+}
+
+// latencyWriter writes one CSV row per result with just its latency and
+// outcome, for building histograms of the raw latencies elsewhere
+type latencyWriter struct {
+	f *rotatingFile
+	w *csv.Writer
+}
+
+func newLatencyWriter(path string, args Args) (*latencyWriter, error) {
+	f, err := createOutput(path, args)
+	if err != nil {
+		return nil, err
+	}
+	l := &latencyWriter{f: f}
+	l.begin()
+	return l, nil
+}
+
+// begin starts writing to the file, with the header unless it's being
+// appended to
+func (l *latencyWriter) begin() {
+	l.w = csv.NewWriter(l.f)
+	if l.f.size > 0 {
+		return
+	}
+	header := []string{"worker", "iteration", "time", "elapsed_ns", "success", "status", "schema_version", "command"}
+	for _, t := range tags {
+		header = append(header, "tag_"+t.key)
+	}
+	l.w.Write(header)
+}
+
+func (l *latencyWriter) write(r result) {
+	row := []string{
+		strconv.Itoa(r.worker),
+		strconv.Itoa(r.iteration),
+		r.time.Format(time.RFC3339Nano),
+		strconv.FormatInt(int64(r.elapsed), 10),
+		strconv.FormatBool(r.success),
+		strings.TrimSpace(r.status),
+		strconv.Itoa(schemaVersion),
+		// added after the rest so existing columns keep their places
+		r.command,
+	}
+	for _, t := range tags {
+		row = append(row, t.value)
+	}
+	l.w.Write(row)
+	if l.f.due(0) {
+		l.w.Flush()
+		if err := l.f.rotate(); err != nil {
+			log.Printf("%s\n", err)
+		}
+		l.begin()
+	}
+}
+
+func (l *latencyWriter) close() error {
+	l.w.Flush()
+	if err := l.w.Error(); err != nil {
+		l.f.Close()
+		return err
+	}
+	return l.f.Close()
+}
+
+// errorWriter logs every failed result in full, one per line, for chasing
+// failures that the aggregated error counts hide
+type errorWriter struct {
+	f *rotatingFile
+	w *bufio.Writer
+}
+
+func newErrorWriter(path string, args Args) (*errorWriter, error) {
+	f, err := createOutput(path, args)
+	if err != nil {
+		return nil, err
+	}
+	return &errorWriter{f: f, w: bufio.NewWriter(f)}, nil
+}
+
+func (e *errorWriter) write(r result) {
+	if r.success {
+		return
+	}
+	fmt.Fprintf(e.w, "%s thread=%d iteration=%d request_id=%s elapsed=%s status=%q\n",
+		r.time.Format(time.RFC3339Nano), r.worker, r.iteration, r.requestID, r.elapsed, strings.TrimSpace(r.status))
+	if e.f.due(e.w.Buffered()) {
+		rotateBuffered(e.f, e.w)
+	}
+}
+
+// rotateBuffered flushes w to the file it writes to and rotates that
+func rotateBuffered(f *rotatingFile, w *bufio.Writer) {
+	err := w.Flush()
+	if err == nil {
+		err = f.rotate()
+	}
+	if err != nil {
+		log.Printf("%s\n", err)
+	}
+	w.Reset(f)
+}
+
+func (e *errorWriter) close() error {
+	if err := e.w.Flush(); err != nil {
+		e.f.Close()
+		return err
+	}
+	return e.f.Close()
+}
+
+// vegetaResult is a result in vegeta's JSON encoding, so runs can be fed to
+// `vegeta report` and `vegeta plot`
+type vegetaResult struct {
+	Attack    string    `json:"attack"`
+	Seq       uint64    `json:"seq"`
+	Code      int       `json:"code"`
+	Timestamp time.Time `json:"timestamp"`
+	Latency   int64     `json:"latency"`
+	BytesOut  uint64    `json:"bytes_out"`
+	BytesIn   uint64    `json:"bytes_in"`
+	Error     string    `json:"error"`
+	Body      []byte    `json:"body"`
+	Method    string    `json:"method"`
+	URL       string    `json:"url"`
+}
+
+// vegetaWriter writes results for vegeta. vegeta counts codes 200-399 as
+// successes, so successes outside that range are written as 200 and failures
+// inside it as 0, with the cosign status in error.
+type vegetaWriter struct {
+	f     *rotatingFile
+	w     *bufio.Writer
+	enc   *json.Encoder
+	url   string
+	runID string
+	seq   uint64
+}
+
+func newVegetaWriter(path string, args Args, runID string) (*vegetaWriter, error) {
+	f, err := createOutput(path, args)
+	if err != nil {
+		return nil, err
+	}
+	w := bufio.NewWriter(f)
+	url := "cosign://" + args.target()
+	return &vegetaWriter{f: f, w: w, enc: json.NewEncoder(w), url: url, runID: runID}, nil
+}
+
+func (v *vegetaWriter) write(r result) {
+	code, _ := strconv.Atoi(r.code)
+	var msg string
+	switch {
+	case r.success && (code < 200 || code > 399):
+		code = 200
+	case !r.success:
+		if code >= 200 && code <= 399 {
+			code = 0
+		}
+		msg = strings.TrimSpace(r.status)
+	}
+	v.enc.Encode(vegetaResult{
+		Attack:    v.runID,
+		Seq:       v.seq,
+		Code:      code,
+		Timestamp: r.time,
+		Latency:   int64(r.elapsed),
+		Error:     msg,
+		Method:    "COSIGN",
+		URL:       v.url,
+	})
+	v.seq++
+	if v.f.due(v.w.Buffered()) {
+		rotateBuffered(v.f, v.w)
+	}
+}
+
+func (v *vegetaWriter) close() error {
+	if err := v.w.Flush(); err != nil {
+		v.f.Close()
+		return err
+	}
+	return v.f.Close()
+}
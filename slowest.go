@@ -0,0 +1,64 @@
+package cosignperf
+
+import (
+	"container/heap"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// slowest keeps the n slowest results seen, for --top-slow. It's a min-heap
+// on latency so the fastest of them is the one to drop when a slower result
+// comes in.
+type slowest struct {
+	n       int
+	results []result
+}
+
+func (s *slowest) Len() int           { return len(s.results) }
+func (s *slowest) Less(i, j int) bool { return s.results[i].elapsed < s.results[j].elapsed }
+func (s *slowest) Swap(i, j int)      { s.results[i], s.results[j] = s.results[j], s.results[i] }
+func (s *slowest) Push(x any)         { s.results = append(s.results, x.(result)) }
+func (s *slowest) Pop() any {
+	r := s.results[len(s.results)-1]
+	s.results = s.results[:len(s.results)-1]
+	return r
+}
+
+// add offers r, keeping it if it's one of the n slowest so far
+func (s *slowest) add(r result) {
+	if s == nil {
+		return
+	}
+	if len(s.results) < s.n {
+		heap.Push(s, r)
+	} else if r.elapsed > s.results[0].elapsed {
+		s.results[0] = r
+		heap.Fix(s, 0)
+	}
+}
+
+// print lists the results slowest first
+func (s *slowest) print() {
+	sorted := append([]result{}, s.results...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].elapsed > sorted[j].elapsed })
+
+	fmt.Printf("Slowest %d requests:\n", len(sorted))
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(w, "latency\tthread\titeration\tcommand\tcode\tbytes\ttime\tstatus\n")
+	for _, r := range sorted {
+		command, code := r.command, r.code
+		if command == "" {
+			command = r.setup
+		}
+		if code == "" {
+			code = "-"
+		}
+		fmt.Fprintf(w, "%s\t%d\t%d\t%s\t%s\t%d\t%s\t%s\n", fmtd(r.elapsed), r.worker, r.iteration, command, code, r.size,
+			r.time.Format(time.RFC3339Nano), strings.TrimSpace(r.status))
+	}
+	w.Flush()
+}
@@ -0,0 +1,132 @@
+package cosignperf
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	_ "modernc.org/sqlite"
+	"strings"
+	"time"
+)
+
+const sqliteSchema = `
+CREATE TABLE IF NOT EXISTS runs (
+	run_id TEXT PRIMARY KEY,
+	schema_version INTEGER,
+	time TEXT,
+	host TEXT,
+	port INTEGER,
+	threads INTEGER,
+	successes INTEGER,
+	failures INTEGER,
+	elapsed_ns INTEGER,
+	req_per_sec REAL,
+	avg_ns INTEGER,
+	p95_ns INTEGER,
+	p99_ns INTEGER,
+	result TEXT,
+	reason TEXT,
+	tags TEXT
+);
+CREATE TABLE IF NOT EXISTS requests (
+	run_id TEXT,
+	request_id TEXT,
+	time TEXT,
+	worker INTEGER,
+	iteration INTEGER,
+	success INTEGER,
+	status TEXT,
+	elapsed_ns INTEGER,
+	sni TEXT,
+	warmup INTEGER
+);
+CREATE INDEX IF NOT EXISTS requests_run_id ON requests (run_id);
+`
+
+// sqliteWriter records each run's summary, and every request with
+// --sqlite-requests, in a SQLite database that can be queried across runs.
+// Each run is written in one transaction, committed with its summary.
+type sqliteWriter struct {
+	db     *sql.DB
+	tx     *sql.Tx
+	insert *sql.Stmt
+	runID  string
+}
+
+// openSqlite opens the --sqlite database, creating the tables if need be, or
+// returns nil if it isn't set
+func openSqlite(args Args, runID string) (*sqliteWriter, error) {
+	if args.Sqlite == "" {
+		return nil, nil
+	}
+	db, err := sql.Open("sqlite", args.Sqlite)
+	if err != nil {
+		return nil, fmt.Errorf("sqlite: %s", err)
+	}
+	if _, err := db.Exec(sqliteSchema); err != nil {
+		return nil, fmt.Errorf("sqlite: %s: %s", args.Sqlite, err)
+	}
+	return &sqliteWriter{db: db, runID: runID}, nil
+}
+
+// begin starts the transaction for the current run if there isn't one yet
+func (s *sqliteWriter) begin() error {
+	if s.tx != nil {
+		return nil
+	}
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	insert, err := tx.Prepare(`INSERT INTO requests VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	s.tx, s.insert = tx, insert
+	return nil
+}
+
+func (s *sqliteWriter) write(r result) {
+	if err := s.begin(); err != nil {
+		return
+	}
+	s.insert.Exec(s.runID, r.requestID, r.time.Format(time.RFC3339Nano), r.worker, r.iteration,
+		r.success, strings.TrimSpace(r.status), int64(r.elapsed), r.sni, r.warmup)
+}
+
+// close is a no-op so the database stays open for the summary; see summary
+func (s *sqliteWriter) close() error {
+	return nil
+}
+
+// summary adds the run to the runs table and commits it along with its
+// requests. reason is the verdict, empty if the run passed.
+func (s *sqliteWriter) summary(args Args, sum summary, reason string) error {
+	result := "ok"
+	if reason != "" {
+		result = "fail"
+	}
+	tagJSON := "{}"
+	if m := tagMap(); m != nil {
+		b, _ := json.Marshal(m)
+		tagJSON = string(b)
+	}
+	if err := s.begin(); err != nil {
+		return fmt.Errorf("sqlite: %s", err)
+	}
+	defer func() { s.tx, s.insert = nil, nil }()
+	_, err := s.tx.Exec(`INSERT INTO runs VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		s.runID, schemaVersion, time.Now().Format(time.RFC3339Nano), args.Hostname, args.ports(), args.Threads,
+		sum.ns, sum.nf, int64(sum.elapsed), sum.rps,
+		int64(sum.success.avg), int64(sum.success.p95), int64(sum.success.p99),
+		result, reason, tagJSON)
+	if err != nil {
+		s.tx.Rollback()
+		return fmt.Errorf("sqlite: %s", err)
+	}
+	if err := s.tx.Commit(); err != nil {
+		return fmt.Errorf("sqlite: %s", err)
+	}
+	return nil
+}
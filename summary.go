@@ -0,0 +1,165 @@
+package cosignperf
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"github.com/montanaflynn/stats"
+	"os"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// latencies are the stats reported for a set of latency samples, worked out
+// from one sorted copy of them
+type latencies struct {
+	n                       int
+	avg, max, min, p95, p99 time.Duration
+}
+
+func newLatencies(d durations) latencies {
+	l := latencies{n: len(d)}
+	if l.n == 0 {
+		return l
+	}
+	f := make(stats.Float64Data, len(d))
+	for i, v := range d {
+		f[i] = float64(v)
+	}
+	// sorted up front, the percentiles' own sorts of their copies are cheap
+	sort.Float64s(f)
+	avg, _ := stats.Mean(f)
+	p95, _ := percentile(f, 95)
+	p99, _ := percentile(f, 99)
+	l.avg, l.p95, l.p99 = time.Duration(avg), time.Duration(p95), time.Duration(p99)
+	l.min, l.max = time.Duration(f[0]), time.Duration(f[len(f)-1])
+	return l
+}
+
+// String formats the avg, max, min, 99pct and 95pct in --unit
+func (l latencies) String() string {
+	if l.n == 0 {
+		return "no samples"
+	}
+	return fmt.Sprintf("avg: %s, max: %s, min: %s, 99pct: %s, 95pct: %s",
+		fmtd(l.avg), fmtd(l.max), fmtd(l.min), fmtd(l.p99), fmtd(l.p95))
+}
+
+// summary is a run's headline numbers, worked out once when it's over for
+// the report and every output that records them, so the samples are sorted
+// once however many outputs are on
+type summary struct {
+	started time.Time
+	elapsed time.Duration
+	ns, nf  int
+	rps     float64
+	success latencies
+	fail    latencies
+	skipped int64
+	errors  map[string]int
+	partial bool // interrupted, so only what was in by then
+}
+
+func summarize(rep *report) summary {
+	return summary{
+		started: rep.started,
+		elapsed: rep.elapsed,
+		ns:      rep.ns,
+		nf:      rep.nf,
+		rps:     rep.rps(),
+		success: newLatencies(rep.s),
+		fail:    newLatencies(rep.f),
+		skipped: rep.skipped,
+		errors:  rep.errors,
+		partial: rep.drain != nil && rep.drain.stopping,
+	}
+}
+
+// jsonLatencies is latencies the way --output-format json has them
+type jsonLatencies struct {
+	Count int   `json:"count"`
+	AvgNs int64 `json:"avg_ns"`
+	MinNs int64 `json:"min_ns"`
+	MaxNs int64 `json:"max_ns"`
+	P95Ns int64 `json:"p95_ns"`
+	P99Ns int64 `json:"p99_ns"`
+}
+
+func newJSONLatencies(l latencies) jsonLatencies {
+	return jsonLatencies{
+		Count: l.n,
+		AvgNs: int64(l.avg),
+		MinNs: int64(l.min),
+		MaxNs: int64(l.max),
+		P95Ns: int64(l.p95),
+		P99Ns: int64(l.p99),
+	}
+}
+
+// jsonSummary is the document --output-format json prints in place of the
+// text summary: what --on-complete is given, plus the run's parameters and
+// the latencies of the failures as well as the successes
+type jsonSummary struct {
+	runSummary
+	Hostname   string        `json:"hostname"`
+	Command    string        `json:"command"`
+	Iterations int           `json:"iterations"`
+	ElapsedNs  int64         `json:"elapsed_ns"`
+	Skipped    int64         `json:"skipped,omitempty"`
+	Success    jsonLatencies `json:"success"`
+	Failure    jsonLatencies `json:"failure"`
+}
+
+func newJSONSummary(args Args, sum summary, runID, reason string) jsonSummary {
+	return jsonSummary{
+		runSummary: newRunSummary(args, sum, runID, reason),
+		Hostname:   args.Hostname,
+		Command:    args.Command,
+		Iterations: args.Iterations,
+		ElapsedNs:  int64(sum.elapsed),
+		Skipped:    sum.skipped,
+		Success:    newJSONLatencies(sum.success),
+		Failure:    newJSONLatencies(sum.fail),
+	}
+}
+
+func printJSONSummary(args Args, sum summary, runID, reason string) error {
+	b, err := json.MarshalIndent(newJSONSummary(args, sum, runID, reason), "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = os.Stdout.Write(append(b, '\n'))
+	return err
+}
+
+// printCSVSummary prints the --output-format json fields as a CSV header
+// and a single row, for appending runs to a spreadsheet. The errors don't
+// fit in a row so are left out.
+func printCSVSummary(args Args, sum summary, runID, reason string) error {
+	s := newJSONSummary(args, sum, runID, reason)
+	i64 := func(n int64) string { return strconv.FormatInt(n, 10) }
+	header := []string{"schema_version", "run_id", "time", "target", "hostname", "command", "threads", "iterations",
+		"successes", "failures", "skipped", "elapsed_ns", "req_per_sec"}
+	row := []string{strconv.Itoa(s.Schema), s.RunID, s.Time.Format(time.RFC3339Nano), s.Target, s.Hostname, s.Command,
+		strconv.Itoa(s.Threads), strconv.Itoa(s.Iterations), strconv.Itoa(s.Successes), strconv.Itoa(s.Failures),
+		i64(s.Skipped), i64(s.ElapsedNs), strconv.FormatFloat(s.ReqPerSec, 'f', 2, 64)}
+	for _, l := range []struct {
+		name string
+		jsonLatencies
+	}{{"success", s.Success}, {"failure", s.Failure}} {
+		header = append(header, l.name+"_count", l.name+"_avg_ns", l.name+"_min_ns", l.name+"_max_ns", l.name+"_p95_ns", l.name+"_p99_ns")
+		row = append(row, strconv.Itoa(l.Count), i64(l.AvgNs), i64(l.MinNs), i64(l.MaxNs), i64(l.P95Ns), i64(l.P99Ns))
+	}
+	header = append(header, "result", "reason", "partial")
+	row = append(row, s.Result, s.Reason, strconv.FormatBool(s.Partial))
+	for _, t := range tags {
+		header = append(header, "tag_"+t.key)
+		row = append(row, t.value)
+	}
+	w := csv.NewWriter(os.Stdout)
+	w.Write(header)
+	w.Write(row)
+	w.Flush()
+	return w.Error()
+}
@@ -0,0 +1,140 @@
+package cosignperf
+
+import (
+	"encoding/csv"
+	"fmt"
+	"github.com/montanaflynn/stats"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// sweepRow is the outcome of one run of a --sweep-threads
+type sweepRow struct {
+	threads            int
+	rps                float64
+	ns, nf             int
+	avg, p50, p95, p99 time.Duration
+}
+
+// parseSweep parses a --sweep-threads list like 1,2,4,8, or a step load like
+// 10:500:+25/30s going from 10 threads to 500 in steps of 25, each step
+// lasting 30s. The step length is 0 if it isn't given.
+func parseSweep(list string) ([]int, time.Duration, error) {
+	if strings.Contains(list, ":") {
+		return parseSteps(list)
+	}
+	var counts []int
+	for _, f := range strings.Split(list, ",") {
+		n, err := strconv.Atoi(strings.TrimSpace(f))
+		if err != nil || n <= 0 {
+			return nil, 0, fmt.Errorf("invalid --sweep-threads %q, want thread counts like 1,2,4,8", list)
+		}
+		counts = append(counts, n)
+	}
+	return counts, 0, nil
+}
+
+// parseSteps parses the START:END:+STEP[/LENGTH] form of --sweep-threads.
+// The last step is END even if the steps don't land on it.
+func parseSteps(list string) ([]int, time.Duration, error) {
+	bad := fmt.Errorf("invalid --sweep-threads %q, want START:END:+STEP or START:END:+STEP/LENGTH like 10:500:+25/30s", list)
+	f := strings.Split(list, ":")
+	if len(f) != 3 {
+		return nil, 0, bad
+	}
+	step, length, timed := strings.Cut(strings.TrimPrefix(f[2], "+"), "/")
+	start, err1 := strconv.Atoi(f[0])
+	end, err2 := strconv.Atoi(f[1])
+	by, err3 := strconv.Atoi(step)
+	if err1 != nil || err2 != nil || err3 != nil || start <= 0 || end < start || by <= 0 {
+		return nil, 0, bad
+	}
+	var d time.Duration
+	if timed {
+		var err error
+		if d, err = time.ParseDuration(length); err != nil || d <= 0 {
+			return nil, 0, bad
+		}
+	}
+	var counts []int
+	for n := start; n < end; n += by {
+		counts = append(counts, n)
+	}
+	if len(counts) > 1000 {
+		return nil, 0, fmt.Errorf("--sweep-threads %q has %d steps, keep it under 1000", list, len(counts)+1)
+	}
+	return append(counts, end), d, nil
+}
+
+// sweepThreads does a run at each of the thread counts and prints a table of
+// how throughput and latency change with them, also writing it to csvPath if
+// that's set. It returns no_successes if any of the runs had none.
+func sweepThreads(base request, counts []int, csvPath string, sinks ...sink) string {
+	var rows []sweepRow
+	var reason string
+	for _, n := range counts {
+		base.args.Threads = n
+		rep := run(base, sinks...)
+		row := sweepRow{
+			threads: n,
+			rps:     rep.rps(),
+			ns:      rep.ns,
+			nf:      rep.nf,
+			avg:     rep.s.Stat(stats.Mean),
+			p50:     rep.s.Percentile(percentile, 50),
+			p95:     rep.s.Percentile(percentile, 95),
+			p99:     rep.s.Percentile(percentile, 99),
+		}
+		log.Printf("sweep threads: %d, req/s: %.2f, p99: %s, SUCCESS/FAIL: %d/%d", n, row.rps, fmtd(row.p99), row.ns, row.nf)
+		if rep.ns == 0 {
+			reason = "no_successes"
+		}
+		rows = append(rows, row)
+	}
+
+	if base.args.Duration > 0 {
+		fmt.Printf("\n===========\nThread sweep, %s per step\n", base.args.Duration)
+	} else {
+		fmt.Printf("\n===========\nThread sweep, Commands/thread: %d\n", base.args.Iterations)
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(w, "threads\treq/s\tSUCCESS/FAIL\tavg\t50pct\t95pct\t99pct\n")
+	for _, r := range rows {
+		fmt.Fprintf(w, "%d\t%.2f\t%d/%d\t%s\t%s\t%s\t%s\n", r.threads, r.rps, r.ns, r.nf, fmtd(r.avg), fmtd(r.p50), fmtd(r.p95), fmtd(r.p99))
+	}
+	w.Flush()
+
+	if csvPath != "" {
+		if err := writeSweep(csvPath, rows); err != nil {
+			log.Printf("sweep csv: %s\n", err)
+		}
+	}
+	return reason
+}
+
+// writeSweep writes the sweep table as CSV, with latencies in nanoseconds
+func writeSweep(path string, rows []sweepRow) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	cw := csv.NewWriter(f)
+	cw.Write([]string{"threads", "req_per_sec", "successes", "failures", "avg_ns", "p50_ns", "p95_ns", "p99_ns"})
+	for _, r := range rows {
+		cw.Write([]string{
+			strconv.Itoa(r.threads), strconv.FormatFloat(r.rps, 'f', 2, 64), strconv.Itoa(r.ns), strconv.Itoa(r.nf),
+			strconv.FormatInt(int64(r.avg), 10), strconv.FormatInt(int64(r.p50), 10),
+			strconv.FormatInt(int64(r.p95), 10), strconv.FormatInt(int64(r.p99), 10),
+		})
+	}
+	cw.Flush()
+	if err := cw.Error(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
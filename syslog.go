@@ -0,0 +1,84 @@
+package cosignperf
+
+import (
+	"fmt"
+	"log/syslog"
+	"strings"
+)
+
+var facilities = map[string]syslog.Priority{
+	"kern": syslog.LOG_KERN, "user": syslog.LOG_USER, "mail": syslog.LOG_MAIL,
+	"daemon": syslog.LOG_DAEMON, "auth": syslog.LOG_AUTH, "syslog": syslog.LOG_SYSLOG,
+	"lpr": syslog.LOG_LPR, "news": syslog.LOG_NEWS, "uucp": syslog.LOG_UUCP,
+	"cron": syslog.LOG_CRON, "authpriv": syslog.LOG_AUTHPRIV, "ftp": syslog.LOG_FTP,
+	"local0": syslog.LOG_LOCAL0, "local1": syslog.LOG_LOCAL1, "local2": syslog.LOG_LOCAL2,
+	"local3": syslog.LOG_LOCAL3, "local4": syslog.LOG_LOCAL4, "local5": syslog.LOG_LOCAL5,
+	"local6": syslog.LOG_LOCAL6, "local7": syslog.LOG_LOCAL7,
+}
+
+// syslogWriter sends the run summary, and per-request events with
+// --syslog-events, to the local syslog daemon as key=value fields so they
+// can be queried once collected centrally
+type syslogWriter struct {
+	w     *syslog.Writer
+	runID string
+}
+
+// openSyslog connects to syslog if --syslog is set, or returns nil
+func openSyslog(args Args, runID string) (*syslogWriter, error) {
+	if !args.Syslog {
+		return nil, nil
+	}
+	facility, ok := facilities[args.SyslogFacil]
+	if !ok {
+		return nil, fmt.Errorf("unknown --syslog-facility %s", args.SyslogFacil)
+	}
+	w, err := syslog.New(facility|syslog.LOG_INFO, args.SyslogTag)
+	if err != nil {
+		return nil, fmt.Errorf("syslog: %s", err)
+	}
+	return &syslogWriter{w: w, runID: runID}, nil
+}
+
+// fields returns the --tag values as extra key=value fields
+func (s *syslogWriter) fields() string {
+	var f string
+	for _, t := range tags {
+		f += fmt.Sprintf(" tag_%s=%q", t.key, t.value)
+	}
+	return f
+}
+
+func (s *syslogWriter) write(r result) {
+	msg := fmt.Sprintf("event=request schema_version=%d run_id=%s request_id=%s worker=%d iteration=%d success=%t elapsed_ns=%d status=%q",
+		schemaVersion, s.runID, r.requestID, r.worker, r.iteration, r.success, int64(r.elapsed), strings.TrimSpace(r.status)) + s.fields()
+	if r.success {
+		s.w.Info(msg)
+	} else {
+		s.w.Warning(msg)
+	}
+}
+
+// close is a no-op so the connection stays up for the summary after the
+// other sinks are closed; see summary
+func (s *syslogWriter) close() error {
+	return nil
+}
+
+// summary logs the outcome of the run. reason is the verdict, empty if the
+// run passed.
+func (s *syslogWriter) summary(args Args, sum summary, reason string) error {
+	result := "ok"
+	if reason != "" {
+		result = "fail"
+	}
+	msg := fmt.Sprintf("event=summary schema_version=%d run_id=%s host=%s port=%s threads=%d successes=%d failures=%d elapsed_ns=%d req_per_sec=%.2f avg=%s p95=%s p99=%s result=%s reason=%s",
+		schemaVersion, s.runID, args.Hostname, args.ports(), args.Threads, sum.ns, sum.nf, int64(sum.elapsed),
+		sum.rps,
+		sum.success.avg, sum.success.p95, sum.success.p99,
+		result, reason) + s.fields()
+	if reason != "" {
+		return s.w.Err(msg)
+	}
+	return s.w.Info(msg)
+}
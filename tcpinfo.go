@@ -0,0 +1,39 @@
+package cosignperf
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// tcpStats adds up the kernel's TCP_INFO for each connection as it's closed,
+// for --tcp-info, to tell packet loss apart from a slow server
+type tcpStats struct {
+	mu      sync.Mutex
+	n       int       // connections sampled
+	retrans int64     // segments retransmitted, over all connections
+	lossy   int       // connections that retransmitted at all
+	rtt     durations // smoothed RTT of each connection
+}
+
+// sample reads TCP_INFO from conn, if the OS exposes it
+func (t *tcpStats) sample(conn *net.TCPConn) {
+	info, ok := tcpInfo(conn)
+	if !ok {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.n++
+	t.retrans += int64(info.retrans)
+	if info.retrans > 0 {
+		t.lossy++
+	}
+	t.rtt = t.rtt.Keep(info.rtt, t.n, sampleSize)
+}
+
+// tcpSample is the part of TCP_INFO we report
+type tcpSample struct {
+	retrans uint32
+	rtt     time.Duration
+}
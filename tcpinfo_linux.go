@@ -0,0 +1,26 @@
+package cosignperf
+
+import (
+	"net"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+func tcpInfo(conn *net.TCPConn) (tcpSample, bool) {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return tcpSample{}, false
+	}
+	var info syscall.TCPInfo
+	var errno syscall.Errno
+	raw.Control(func(fd uintptr) {
+		size := uint32(syscall.SizeofTCPInfo)
+		_, _, errno = syscall.Syscall6(syscall.SYS_GETSOCKOPT, fd, syscall.SOL_TCP, syscall.TCP_INFO,
+			uintptr(unsafe.Pointer(&info)), uintptr(unsafe.Pointer(&size)), 0)
+	})
+	if errno != 0 {
+		return tcpSample{}, false
+	}
+	return tcpSample{retrans: info.Total_retrans, rtt: time.Duration(info.Rtt) * time.Microsecond}, true
+}
@@ -0,0 +1,12 @@
+//go:build !linux
+
+package cosignperf
+
+import (
+	"net"
+)
+
+// TCP_INFO is Linux only
+func tcpInfo(conn *net.TCPConn) (tcpSample, bool) {
+	return tcpSample{}, false
+}
@@ -0,0 +1,61 @@
+package cosignperf
+
+import (
+	"encoding/csv"
+	"os"
+	"strconv"
+	"time"
+)
+
+// timeline splits the measured part of a run into buckets of width for
+// --timeline-csv, each with its own report of the results that finished in it
+type timeline struct {
+	width   time.Duration
+	buckets map[int]*report
+}
+
+func (t *timeline) add(r result, measured time.Time) {
+	if t == nil {
+		return
+	}
+	b := int(r.time.Add(r.elapsed).Sub(measured) / t.width)
+	if t.buckets[b] == nil {
+		t.buckets[b] = newReport()
+	}
+	t.buckets[b].add(r)
+}
+
+// writeTimeline writes one CSV row per bucket from the start of the
+// measured run to its end, empty buckets included so the rows can be
+// graphed as they are. Latencies are of successes, in nanoseconds, and rps
+// counts both successes and failures.
+func writeTimeline(path string, rep *report) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	t := rep.timeline
+	cw := csv.NewWriter(f)
+	cw.Write([]string{"timestamp", "completed", "rps", "p50_ns", "p95_ns", "p99_ns", "failures"})
+	for b := 0; time.Duration(b)*t.width < rep.elapsed; b++ {
+		r := t.buckets[b]
+		if r == nil {
+			r = newReport()
+		}
+		cw.Write([]string{
+			rep.started.Add(time.Duration(b) * t.width).UTC().Format(time.RFC3339Nano),
+			strconv.Itoa(r.ns + r.nf),
+			strconv.FormatFloat(float64(r.ns+r.nf)/t.width.Seconds(), 'f', 2, 64),
+			strconv.FormatInt(int64(r.s.Percentile(percentile, 50)), 10),
+			strconv.FormatInt(int64(r.s.Percentile(percentile, 95)), 10),
+			strconv.FormatInt(int64(r.s.Percentile(percentile, 99)), 10),
+			strconv.Itoa(r.nf),
+		})
+	}
+	cw.Flush()
+	if err := cw.Error(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,83 @@
+package cosignperf
+
+import (
+	"errors"
+	"os"
+	"strings"
+	"time"
+)
+
+// bound sets a connection's read or write deadline with set to d from now,
+// for --read-timeout and --write-timeout, or clears it if d is 0
+func bound(r request, set func(time.Time) error, d time.Duration) {
+	var t time.Time
+	if d > 0 {
+		t = time.Now().Add(d)
+	}
+	r.drain.setDeadline(set, t)
+}
+
+// timedOut says whether err is from a --read-timeout or --write-timeout
+// running out, rather than an interrupt forcing the connection closed
+func timedOut(r request, err error) bool {
+	return errors.Is(err, os.ErrDeadlineExceeded) && !stopped(r)
+}
+
+// retry is the iteration a worker last retried with --retries, how many
+// times and when it was first tried, so the result it ends up with is timed
+// from the first attempt
+type retry struct {
+	i     int
+	n     int
+	start time.Time
+}
+
+// retryWait sleeps before retry n of a command or connection, for
+// --retry-backoff doubled for each retry before it, unless interrupted
+func retryWait(r request, n int) {
+	if r.args.RetryBackoff <= 0 {
+		return
+	}
+	t := time.NewTimer(r.args.RetryBackoff << (n - 1))
+	defer t.Stop()
+	select {
+	case <-t.C:
+	case <-r.stopping:
+	}
+}
+
+// timeoutKind says which timeout a failure's status is from, or "" if it
+// isn't one, for the summary's Timeouts line
+func timeoutKind(status string) string {
+	f := strings.Fields(status)
+	switch {
+	case len(f) == 0:
+		return ""
+	case f[0] == "TIMEOUT" && len(f) > 1:
+		return f[1]
+	case f[0] == "CONNTIMEOUT":
+		return "connect"
+	case f[0] == "GREETINGTIMEOUT":
+		return "greeting"
+	case f[0] == "HANDSHAKETIMEOUT":
+		return "handshake"
+	}
+	return ""
+}
+
+// retrying says whether iteration i, first tried at start, should be tried
+// again on a fresh connection rather than fail, counting the retry if so
+func retrying(r request, i int, start time.Time) bool {
+	rt := r.retry
+	if rt == nil || r.args.Retries == 0 || stopped(r) {
+		return false
+	}
+	if rt.i != i {
+		*rt = retry{i: i, start: start}
+	}
+	if rt.n >= r.args.Retries {
+		return false
+	}
+	rt.n++
+	return true
+}
@@ -0,0 +1,67 @@
+package cosignperf
+
+import (
+	"crypto/tls"
+	"fmt"
+	"github.com/montanaflynn/stats"
+	"log"
+	"os"
+	"text/tabwriter"
+)
+
+// tlsVariant is one of the handshake setups --tls-compare runs with. Go's
+// TLS client doesn't do False Start, so the optimizations that can be
+// turned on and off from our side are TLS 1.3's one round trip handshake
+// and session resumption.
+type tlsVariant struct {
+	name   string
+	max    uint16
+	resume bool
+}
+
+var tlsVariants = []tlsVariant{
+	{"tls1.2", tls.VersionTLS12, false},
+	{"tls1.2+resume", tls.VersionTLS12, true},
+	{"tls1.3", tls.VersionTLS13, false},
+	{"tls1.3+resume", tls.VersionTLS13, true},
+}
+
+// compareTLS does a run with each of the tlsVariants and prints a table of
+// how setup time and latency differ between them. Each variant gets a
+// session cache of its own so nothing carries over from the one before. It
+// returns no_successes if any of the runs had none.
+func compareTLS(base request, sinks ...sink) string {
+	var reason string
+	type row struct {
+		v   tlsVariant
+		rep *report
+	}
+	var rows []row
+	for _, v := range tlsVariants {
+		req := base
+		req.tlsconfig = base.tlsconfig.Clone()
+		req.tlsconfig.MaxVersion = v.max
+		if v.resume {
+			req.tlsconfig.ClientSessionCache = tls.NewLRUClientSessionCache(0)
+		}
+		rep := run(req, sinks...)
+		log.Printf("tls compare %s: setup avg: %s, p99: %s, resumed: %d/%d, SUCCESS/FAIL: %d/%d",
+			v.name, fmtd(rep.conn.Stat(stats.Mean)), fmtd(rep.s.Percentile(percentile, 99)), rep.resumed, rep.nconn, rep.ns, rep.nf)
+		if rep.ns == 0 {
+			reason = "no_successes"
+		}
+		rows = append(rows, row{v, rep})
+	}
+
+	fmt.Printf("\n===========\nTLS comparison, Threads: %d, Commands/thread: %d, Commands/connection: %d\n",
+		base.args.Threads, base.args.Iterations, base.args.ConnCommands)
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(w, "variant\tSUCCESS/FAIL\thandshakes\tresumed\tsetup avg\tsetup 95pct\tavg\t95pct\t99pct\n")
+	for _, r := range rows {
+		fmt.Fprintf(w, "%s\t%d/%d\t%d\t%d\t%s\t%s\t%s\t%s\t%s\n", r.v.name, r.rep.ns, r.rep.nf, r.rep.nconn, r.rep.resumed,
+			fmtd(r.rep.conn.Stat(stats.Mean)), fmtd(r.rep.conn.Percentile(percentile, 95)),
+			fmtd(r.rep.s.Stat(stats.Mean)), fmtd(r.rep.s.Percentile(percentile, 95)), fmtd(r.rep.s.Percentile(percentile, 99)))
+	}
+	w.Flush()
+	return reason
+}
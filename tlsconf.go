@@ -0,0 +1,92 @@
+package cosignperf
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// tlsVersions are the TLS versions flags take, by name
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// loadCAFile reads the PEM certs in path into a pool to verify the server
+// against, for --ca-file
+func loadCAFile(path string) (*x509.CertPool, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("--ca-file: %s", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(b) {
+		return nil, fmt.Errorf("--ca-file: no PEM certs in %s", path)
+	}
+	return pool, nil
+}
+
+// parseCiphers parses a --ciphers list of suite names like
+// TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256. Go doesn't let the TLS 1.3 suites
+// be chosen, so naming one is an error rather than silently doing nothing.
+func parseCiphers(list string) ([]uint16, error) {
+	suites := make(map[string]*tls.CipherSuite)
+	for _, s := range append(tls.CipherSuites(), tls.InsecureCipherSuites()...) {
+		suites[s.Name] = s
+	}
+	var ids []uint16
+	for _, f := range strings.Split(list, ",") {
+		name := strings.ToUpper(strings.TrimSpace(f))
+		s, ok := suites[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown cipher suite %q in --ciphers", f)
+		}
+		if len(s.SupportedVersions) == 1 && s.SupportedVersions[0] == tls.VersionTLS13 {
+			return nil, fmt.Errorf("--ciphers: %s is a TLS 1.3 suite, which can't be chosen; use --tls-max-version 1.2 to pick TLS 1.2 ones", name)
+		}
+		ids = append(ids, s.ID)
+	}
+	return ids, nil
+}
+
+// tlsStats counts the version and cipher suite each handshake negotiated,
+// for the summary's TLS line
+type tlsStats struct {
+	mu sync.Mutex
+	n  map[string]int
+}
+
+func (t *tlsStats) add(cs tls.ConnectionState) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.n[tls.VersionName(cs.Version)+" "+tls.CipherSuiteName(cs.CipherSuite)]++
+}
+
+// String lists what was negotiated by how many handshakes used it, most
+// first
+func (t *tlsStats) String() string {
+	var keys []string
+	for k := range t.n {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if t.n[keys[i]] != t.n[keys[j]] {
+			return t.n[keys[i]] > t.n[keys[j]]
+		}
+		return keys[i] < keys[j]
+	})
+	var parts []string
+	for _, k := range keys {
+		parts = append(parts, fmt.Sprintf("%s: %d", k, t.n[k]))
+	}
+	if len(parts) == 0 {
+		return "no handshakes"
+	}
+	return strings.Join(parts, ", ")
+}